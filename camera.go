@@ -42,3 +42,18 @@ func (c *Camera) MakeRay(x int, y int, img_w int, img_h int) Ray {
 
 	return ray
 }
+
+// Pixel coordinates of p on the image plane, the inverse of MakeRay. Not ok when p is behind the camera.
+func (c *Camera) project(p Vec3, img_w int, img_h int) (x, y float64, ok bool) {
+	to_plane := c.p00.Z - c.origin.Z
+	dir := p.Sub(c.origin)
+	if dir.Z*to_plane <= 0 {
+		return 0, 0, false
+	}
+	hit := c.origin.Add(dir.Scale(to_plane / dir.Z)).Sub(c.p00)
+	dx := 2 * c.aspect / float64(img_w)
+	dy := 2.0 / float64(img_h)
+	canvas_x := (hit.X - dx*0.5) / c.aspect
+	canvas_y := -(hit.Y + dy*0.5)
+	return (canvas_x + 1) / 2 * float64(img_w), (canvas_y + 1) / 2 * float64(img_h), true
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+// A sky-wide cloud layer between two altitudes, over flat ground or a planet.
+// Rays enter and leave it where they hit the bounding planes or spheres (no sphere tracing), and a tiling 2D weather map
+// decides where clouds are, which kind (height profile) and how much they rain.
+// https://www.guerrilla-games.com/read/the-real-time-volumetric-cloudscapes-of-horizon-zero-dawn
+
+type LayerGeometry = int
+
+const (
+	LayerGeometry_Plane  LayerGeometry = 0 // flat ground at y = 0
+	LayerGeometry_Sphere LayerGeometry = 1 // planet centered below the origin, its surface touching y = 0
+)
+
+type CloudLayer struct {
+	geometry      LayerGeometry
+	bottom, top   float64 // altitudes above the ground
+	planet_radius float64 // LayerGeometry_Sphere
+	weather       *WeatherMap
+	profiles      []HeightProfile // by cloud type, the weather map type channel blends along them
+	preset        string          // name of the CloudPreset it was built from, empty for none
+
+	shape           NoiseNode // base cloud noise in [0, 1]
+	detail          NoiseNode // erodes the base cloud edges, in [0, 1]
+	noise_stretch   Vec3      // per axis frequency multiplier of the noise lookups
+	shape_speed     float64   // multipliers of the wind velocity, the detail usually moves faster
+	detail_speed    float64
+	detail_strength float64
+	density_scale   float64
+	absorption      float64 // extinction per unit density and distance
+	phase           PhaseFunction
+	sun_dir         Vec3    // towards the sun, lights the layer instead of the point light position
+	max_distance    float64 // clouds fade out towards it, nothing is sampled beyond
+	emission        *Emission
+	rain            *RainShafts // below the base, nil for none
+}
+
+// Two Henyey-Greenstein lobes: a forward one for the silver lining and a weaker back scattering one
+type PhaseFunction struct {
+	forward, back, back_weight float64 // asymmetry of each lobe, mix towards the back lobe
+}
+
+// Scaled so an isotropic phase is 1
+func (f PhaseFunction) eval(mu float64) float64 {
+	return mix(HenyeyGreenstein(f.forward, mu), HenyeyGreenstein(f.back, mu), f.back_weight) * 4 * math.Pi
+}
+
+// Stretch of a ray between t0 and t1, where it is inside the layer or a volume's box
+type RayInterval struct {
+	t0, t1 float64
+}
+
+// Density fraction over the normalized layer height [0, 1], ramping up from bottom to full_bottom and down from full_top to top
+type HeightProfile struct {
+	bottom, full_bottom, full_top, top float64
+}
+
+func (h HeightProfile) eval(x float64) float64 {
+	return linear_step(h.bottom, h.full_bottom, x) * (1 - linear_step(h.full_top, h.top, x))
+}
+
+// stratus, cumulus, cumulonimbus for weather map types 0, 0.5 and 1
+var default_height_profiles = []HeightProfile{
+	{0, 0.05, 0.1, 0.2},
+	{0.02, 0.1, 0.35, 0.6},
+	{0, 0.1, 0.75, 1},
+}
+
+type WeatherMap struct {
+	coverage      *Matrix2D[float32] // fraction of the sky covered
+	cloud_type    *Matrix2D[float32] // position along the layer's height profiles
+	precipitation *Matrix2D[float32] // denser, darker clouds
+	size          float64            // world extent of the map on the xz plane, centered on the origin, it tiles beyond
+}
+
+type WeatherSample struct {
+	coverage, cloud_type, precipitation float64
+}
+
+func NewWeatherMap(w, h int, size float64) *WeatherMap {
+	return &WeatherMap{
+		coverage:      NewDataMatrix[float32](w, h),
+		cloud_type:    NewDataMatrix[float32](w, h),
+		precipitation: NewDataMatrix[float32](w, h),
+		size:          size,
+	}
+}
+
+func (m *WeatherMap) sample(x, z float64) WeatherSample {
+	u := (x/m.size+0.5)*float64(m.coverage.W) - 0.5
+	v := (z/m.size+0.5)*float64(m.coverage.H) - 0.5
+	return WeatherSample{
+		coverage:      matrix2D_sample_bilinear_wrap(m.coverage, u, v),
+		cloud_type:    matrix2D_sample_bilinear_wrap(m.cloud_type, u, v),
+		precipitation: matrix2D_sample_bilinear_wrap(m.precipitation, u, v),
+	}
+}
+
+// Tiling fbm weather: coverage around the given mean, a slowly varying cloud type around cloud_type, and rain where
+// tall clouds are dense. scale is the number of noise features across the map.
+func generate_weather_map(seed int64, resolution int, size, scale, coverage, cloud_type float64) *WeatherMap {
+	m := NewWeatherMap(resolution, resolution, size)
+	noise := NewFastNoise(seed)
+	n := float64(resolution)
+	fbm := func(x, y, z float64) float64 {
+		sum, amplitude := 0.0, 0.5
+		for range 4 {
+			sum += amplitude * noise.gradient3(x, y, z)
+			x, y, amplitude = x*2, y*2, amplitude*0.5
+		}
+		return sum
+	}
+	// blend the four periodic copies so the map wraps without seams, with period noise features across the map
+	tiled := func(x, y, z, period float64) float64 {
+		fx, fy := x/n, y/n
+		a := fbm(fx*period, fy*period, z)
+		b := fbm((fx-1)*period, fy*period, z)
+		c := fbm(fx*period, (fy-1)*period, z)
+		d := fbm((fx-1)*period, (fy-1)*period, z)
+		return mix(mix(a, b, fx), mix(c, d, fx), fy)
+	}
+	for y := range resolution {
+		for x := range resolution {
+			fx, fy := float64(x), float64(y)
+			cov := clamp01(coverage + 1.5*tiled(fx, fy, 0.5, scale))
+			kind := clamp01(cloud_type + tiled(fx, fy, 10.5, scale/2))
+			m.coverage.set(float32(cov), x, y)
+			m.cloud_type.set(float32(kind), x, y)
+			m.precipitation.set(float32(linear_step(0.6, 1, cov)*linear_step(0.6, 1, kind)), x, y)
+		}
+	}
+	return m
+}
+
+// Red is coverage, green cloud type, blue precipitation
+func load_weather_map(path string, size float64) (*WeatherMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b := img.Bounds()
+	m := NewWeatherMap(b.Dx(), b.Dy(), size)
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			m.coverage.set(float32(r)/0xffff, x, y)
+			m.cloud_type.set(float32(g)/0xffff, x, y)
+			m.precipitation.set(float32(bl)/0xffff, x, y)
+		}
+	}
+	return m, nil
+}
+
+func (l *CloudLayer) planet_center() Vec3 {
+	return Vec3{0, -l.planet_radius, 0}
+}
+
+func (l *CloudLayer) altitude(p Vec3) float64 {
+	if l.geometry == LayerGeometry_Sphere {
+		return p.Sub(l.planet_center()).Len() - l.planet_radius
+	}
+	return p.Y
+}
+
+// Profile for a weather map cloud type, blending the parameters of the neighbouring profiles
+func (l *CloudLayer) height_profile(cloud_type float64) HeightProfile {
+	if len(l.profiles) == 1 {
+		return l.profiles[0]
+	}
+	f := clamp01(cloud_type) * float64(len(l.profiles)-1)
+	i := min(int(f), len(l.profiles)-2)
+	a, b := l.profiles[i], l.profiles[i+1]
+	t := f - float64(i)
+	return HeightProfile{
+		bottom:      mix(a.bottom, b.bottom, t),
+		full_bottom: mix(a.full_bottom, b.full_bottom, t),
+		full_top:    mix(a.full_top, b.full_top, t),
+		top:         mix(a.top, b.top, t),
+	}
+}
+
+func (l *CloudLayer) density(p Vec3, noises *Noises, time float64) float64 {
+	h := (l.altitude(p) - l.bottom) / (l.top - l.bottom)
+	if h <= 0 || h >= 1 {
+		return 0
+	}
+	w := l.weather.sample(p.X, p.Z)
+	if w.coverage <= 0 {
+		return 0
+	}
+	profile := l.height_profile(w.cloud_type).eval(h)
+	if profile <= 0 {
+		return 0
+	}
+	shape_p, detail_p := noises.wind.advect_shape_detail(p, noises, time, (l.bottom+l.top)/2, l.shape_speed, l.detail_speed)
+	base := clamp01(l.shape.eval(shape_p.Mul(l.noise_stretch), noises, time)) * profile
+	// coverage decides how much of the noise becomes cloud
+	cloud := clamp01(remap(base, 1-w.coverage, 1, 0, 1)) * w.coverage
+	if cloud <= 0 {
+		return 0
+	}
+	detail := clamp01(l.detail.eval(detail_p.Mul(l.noise_stretch), noises, time))
+	cloud = clamp01(remap(cloud, detail*l.detail_strength, 1, 0, 1))
+	return cloud * l.density_scale * (1 + w.precipitation*LAYER_PRECIPITATION_DENSITY)
+}
+
+// Ray parameters inside the layer, nearest first, cut by the ground and max_distance
+func (l *CloudLayer) intersect(ray *Ray) (intervals [2]RayInterval, n int) {
+	return l.intersect_shell(ray, l.bottom, l.top)
+}
+
+// Ray parameters between two altitudes, nearest first, cut by the ground and max_distance
+func (l *CloudLayer) intersect_shell(ray *Ray, low, high float64) (intervals [2]RayInterval, n int) {
+	add := func(t0, t1 float64) {
+		t0, t1 = max(t0, 0), min(t1, l.max_distance)
+		if t1 > t0 {
+			intervals[n] = RayInterval{t0, t1}
+			n++
+		}
+	}
+
+	if l.geometry == LayerGeometry_Sphere {
+		center := l.planet_center()
+		a0, a1, hit := ray_sphere(ray, center, l.planet_radius+high)
+		if !hit || a1 < 0 {
+			return
+		}
+		if g0, _, hit := ray_sphere(ray, center, l.planet_radius); hit && g0 > 0 {
+			a1 = min(a1, g0) // the planet hides what's behind it
+		}
+		b0, b1, hit := ray_sphere(ray, center, l.planet_radius+low)
+		if !hit || b1 <= a0 || b0 >= a1 {
+			add(a0, a1)
+			return
+		}
+		// below low between b0 and b1
+		add(a0, b0)
+		add(b1, a1)
+		return
+	}
+
+	oy, dy := ray.origin.Y, ray.dir.Y
+	if math.Abs(dy) < 1e-9 {
+		if oy > low && oy < high {
+			add(0, math.Inf(1))
+		}
+		return
+	}
+	t0, t1 := (low-oy)/dy, (high-oy)/dy
+	if t0 > t1 {
+		t0, t1 = t1, t0
+	}
+	if oy >= 0 && dy < 0 {
+		t1 = min(t1, -oy/dy) // ground
+	}
+	add(t0, t1)
+	return
+}
+
+// Distances along the (normalized) ray direction where it enters and leaves the sphere, possibly negative
+func ray_sphere(ray *Ray, center Vec3, r float64) (t0, t1 float64, hit bool) {
+	oc := ray.origin.Sub(center)
+	b := oc.Dot(ray.dir)
+	disc := b*b - (oc.LenSq() - r*r)
+	if disc < 0 {
+		return 0, 0, false
+	}
+	s := math.Sqrt(disc)
+	return -b - s, -b + s, true
+}
+
+// Extinction towards the sun over the layer's thickness
+func (l *CloudLayer) optical_depth_to_sun(p Vec3, noises *Noises, time float64) float64 {
+	ds := (l.top - l.bottom) / LAYER_LIGHT_STEPS
+	depth := 0.0
+	for i := range LAYER_LIGHT_STEPS {
+		q := p.Add(l.sun_dir.Scale(ds * (float64(i) + 0.5)))
+		depth += l.density(q, noises, time) * ds
+	}
+	return depth * l.absorption
+}
+
+// Fraction of the light passing through the layer along the ray, for shadows on solids
+func (l *CloudLayer) transmittance(ray *Ray, noises *Noises, time float64) float64 {
+	intervals, n := l.intersect(ray)
+	depth := 0.0
+	for _, interval := range intervals[:n] {
+		ds := (interval.t1 - interval.t0) / LAYER_LIGHT_STEPS
+		for i := range LAYER_LIGHT_STEPS {
+			depth += l.density(ray.origin.Add(ray.dir.Scale(interval.t0+ds*(float64(i)+0.5))), noises, time) * ds
+		}
+	}
+	return beers_law(depth, l.absorption)
+}
+
+// Optical depth along the straight line between two points, for lights inside the layer
+func (l *CloudLayer) optical_depth_between(p, q Vec3, noises *Noises, time float64) float64 {
+	d := q.Sub(p).Scale(1.0 / LAYER_LIGHT_STEPS)
+	ds := d.Len()
+	depth := 0.0
+	for i := range LAYER_LIGHT_STEPS {
+		depth += l.density(p.Add(d.Scale(float64(i)+0.5)), noises, time) * ds
+	}
+	return depth * l.absorption
+}
+
+// Front to back integration of the layer along the ray, same Vec4 (color, alpha) as march_volume
+func march_cloud_layer(ray *Ray, render_params *RenderParameters) Vec4 {
+	l := render_params.layer
+	type span struct {
+		RayInterval
+		rain bool
+	}
+	var spans []span
+	intervals, n := l.intersect(ray)
+	for _, interval := range intervals[:n] {
+		spans = append(spans, span{interval, false})
+	}
+	if l.rain != nil {
+		intervals, n := l.intersect_shell(ray, 0, l.bottom)
+		for _, interval := range intervals[:n] {
+			spans = append(spans, span{interval, true})
+		}
+		sort.Slice(spans, func(i, j int) bool { return spans[i].t0 < spans[j].t0 })
+	}
+	if len(spans) == 0 {
+		return Vec4{}
+	}
+
+	phase := l.phase.eval(ray.dir.Dot(l.sun_dir))
+	min_ds := (l.top - l.bottom) / LAYER_STEPS_PER_THICKNESS
+
+	transmittance := 1.0
+	acc_light := 0.0
+	acc_rain := Vec3{} // colored
+	acc_emitted := Vec3{}
+	acc_flash := Vec3{} // lightning
+	occlusion := func(from, to Vec3) float64 {
+		return beers_law(l.optical_depth_between(from, to, render_params.noises, render_params.time), 1)
+	}
+march:
+	for _, interval := range spans {
+		if render_params.solid_depth > 0 {
+			interval.t1 = min(interval.t1, render_params.solid_depth)
+		}
+		length := interval.t1 - interval.t0
+		if length <= 0 {
+			continue
+		}
+		steps := int(clamp(math.Ceil(length/min_ds), 1, LAYER_MAX_STEPS))
+		if interval.rain {
+			steps = int(clamp(math.Ceil(length/(l.bottom/LAYER_RAIN_STEPS_PER_HEIGHT)), 1, LAYER_RAIN_MAX_STEPS))
+		}
+		ds := length / float64(steps)
+		for i := range steps {
+			t := interval.t0 + (float64(i)+0.5)*ds
+			p := ray.origin.Add(ray.dir.Scale(t))
+			fade := 1 - linear_step(l.max_distance*LAYER_FADE_START, l.max_distance, t)
+			if interval.rain {
+				density := l.rain.density_at(l, p, render_params.noises, render_params.time)
+				if density <= 0 {
+					continue
+				}
+				step_transmittance := beers_law(ds, density*fade)
+				light := l.rain.light_at(l, p, render_params.noises, render_params.time)
+				acc_rain = acc_rain.Add(l.rain.color.Scale(light * transmittance * (1 - step_transmittance)))
+				transmittance *= step_transmittance
+				if transmittance < 0.01 {
+					break march
+				}
+				continue
+			}
+
+			density := l.density(p, render_params.noises, render_params.time)
+			if density <= 0 {
+				continue
+			}
+			extinction := density * l.absorption * fade
+			sun := beers_law(l.optical_depth_to_sun(p, render_params.noises, render_params.time), 1)
+			h := (l.altitude(p) - l.bottom) / (l.top - l.bottom)
+			light := sun*phase + LAYER_AMBIENT*(0.5+0.5*h) // sky light is brighter towards the top
+
+			step_transmittance := beers_law(ds, extinction)
+			acc_light += light * transmittance * (1 - step_transmittance)
+			flash := render_params.lightning.light_at(p, render_params.time, occlusion)
+			acc_flash = acc_flash.Add(flash.Scale(transmittance * (1 - step_transmittance)))
+			if l.emission != nil && extinction > 0 { // light from a step, seen through itself
+				emitted := l.emission.emitted(p, density, render_params.noises)
+				acc_emitted = acc_emitted.Add(emitted.Scale(transmittance * (1 - step_transmittance) / extinction))
+			}
+			transmittance *= step_transmittance
+			if transmittance < 0.01 {
+				break march
+			}
+		}
+	}
+	alpha := 1 - transmittance
+	if alpha <= 0 {
+		return Vec4{}
+	}
+	diffuse := cloud_color.Mul(render_params.light.color.Scale(acc_light).Add(acc_flash))
+	diffuse = diffuse.Add(render_params.light.color.Mul(acc_rain)).Scale(1 / alpha)
+	return add_emission(Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}, acc_emitted)
+}
+
+// Scene file representation of a cloud layer, see build_cloud_layer for defaults
+type CloudLayerDef struct {
+	Geometry     string     `json:"geometry"` // plane (default) or sphere
+	Bottom       float64    `json:"bottom"`
+	Top          float64    `json:"top"`
+	PlanetRadius float64    `json:"planet_radius,omitempty"`
+	Sun          [3]float64 `json:"sun,omitempty"` // direction towards the sun
+
+	// fills in everything below that isn't set, see cloud_presets
+	Preset string `json:"preset,omitempty"`
+
+	Profile        []float64    `json:"profile,omitempty"` // bottom, full_bottom, full_top, top in [0, 1], replaces the per type profiles
+	ShapeScale     float64      `json:"shape_scale,omitempty"`
+	ShapeStretch   [3]float64   `json:"shape_stretch,omitempty"`
+	DetailScale    float64      `json:"detail_scale,omitempty"`
+	DetailStrength float64      `json:"detail_strength,omitempty"`
+	ShapeSpeed     float64      `json:"shape_speed,omitempty"` // times the scene's wind
+	DetailSpeed    float64      `json:"detail_speed,omitempty"`
+	DensityScale   float64      `json:"density_scale,omitempty"`
+	Absorption     float64      `json:"absorption,omitempty"`
+	Phase          []float64    `json:"phase,omitempty"` // forward and back lobe asymmetry, back lobe weight
+	MaxDistance    float64      `json:"max_distance,omitempty"`
+	Emission       *EmissionDef `json:"emission,omitempty"` // glowing cores, blackbody temperatures follow the density
+	Rain           *RainDef     `json:"rain,omitempty"`     // shafts under the base where the weather map rains
+
+	Weather WeatherMapDef `json:"weather"`
+}
+
+type WeatherMapDef struct {
+	Path string  `json:"path,omitempty"` // PNG, otherwise generated
+	Size float64 `json:"size,omitempty"` // world extent
+
+	// generated
+	Seed       int64    `json:"seed,omitempty"`
+	Resolution int      `json:"resolution,omitempty"`
+	Scale      float64  `json:"scale,omitempty"` // noise features across the map
+	Coverage   float64  `json:"coverage,omitempty"`
+	CloudType  *float64 `json:"cloud_type,omitempty"` // 0 stratus, 0.5 cumulus, 1 cumulonimbus
+}
+
+func build_cloud_layer(def *CloudLayerDef) (*CloudLayer, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+
+	preset := &default_cloud_layer
+	profiles := default_height_profiles
+	if def.Preset != "" {
+		var err error
+		if preset, err = find_cloud_preset(def.Preset); err != nil {
+			return nil, err
+		}
+		profiles = []HeightProfile{preset.profile}
+	}
+	if len(def.Profile) > 0 {
+		if len(def.Profile) != 4 {
+			return nil, fmt.Errorf("profile needs 4 values, got %d", len(def.Profile))
+		}
+		profiles = []HeightProfile{{def.Profile[0], def.Profile[1], def.Profile[2], def.Profile[3]}}
+	}
+
+	layer := CloudLayer{
+		bottom:          or_default(def.Bottom, preset.bottom),
+		top:             or_default(def.Top, preset.top),
+		planet_radius:   or_default(def.PlanetRadius, 600),
+		profiles:        profiles,
+		preset:          def.Preset,
+		noise_stretch:   preset.shape_stretch,
+		detail_strength: or_default(def.DetailStrength, preset.detail_strength),
+		shape_speed:     or_default(def.ShapeSpeed, 1),
+		detail_speed:    or_default(def.DetailSpeed, 1.5),
+		density_scale:   or_default(def.DensityScale, preset.density_scale),
+		absorption:      or_default(def.Absorption, preset.absorption),
+		phase:           preset.phase,
+		max_distance:    or_default(def.MaxDistance, 60),
+	}
+	if def.ShapeStretch != ([3]float64{}) {
+		layer.noise_stretch = Vec3{def.ShapeStretch[0], def.ShapeStretch[1], def.ShapeStretch[2]}
+	}
+	if len(def.Phase) > 0 {
+		if len(def.Phase) != 3 {
+			return nil, fmt.Errorf("phase needs 3 values, got %d", len(def.Phase))
+		}
+		layer.phase = PhaseFunction{def.Phase[0], def.Phase[1], def.Phase[2]}
+	}
+	switch def.Geometry {
+	case "", "plane":
+		layer.geometry = LayerGeometry_Plane
+	case "sphere":
+		layer.geometry = LayerGeometry_Sphere
+	default:
+		return nil, fmt.Errorf("unknown layer geometry %q", def.Geometry)
+	}
+	if layer.top <= layer.bottom {
+		return nil, fmt.Errorf("layer top %v must be above bottom %v", layer.top, layer.bottom)
+	}
+	layer.sun_dir = Vec3{def.Sun[0], def.Sun[1], def.Sun[2]}
+	if layer.sun_dir == (Vec3{}) {
+		layer.sun_dir = Vec3{-0.4, 0.6, -0.7}
+	}
+	layer.sun_dir = layer.sun_dir.Normalized()
+
+	layer.shape = cloud_layer_noise(or_default(def.ShapeScale, preset.shape_scale), 4)
+	layer.detail = cloud_layer_noise(or_default(def.DetailScale, preset.detail_scale), 2)
+
+	weather := &def.Weather
+	size := or_default(weather.Size, 40)
+	if weather.Path != "" {
+		m, err := load_weather_map(weather.Path, size)
+		if err != nil {
+			return nil, err
+		}
+		layer.weather = m
+	} else {
+		cloud_type := preset.cloud_type
+		if weather.CloudType != nil {
+			cloud_type = *weather.CloudType
+		}
+		layer.weather = generate_weather_map(weather.Seed, or_default_int(weather.Resolution, 256), size,
+			or_default(weather.Scale, 6), or_default(weather.Coverage, preset.coverage), cloud_type)
+	}
+	if def.Rain != nil {
+		rain, err := build_rain(def.Rain)
+		if err != nil {
+			return nil, fmt.Errorf("rain: %w", err)
+		}
+		layer.rain = rain
+	}
+	if def.Emission != nil {
+		emission, err := build_emission(def.Emission)
+		if err != nil {
+			return nil, fmt.Errorf("emission: %w", err)
+		}
+		layer.emission = emission
+	}
+	return &layer, nil
+}
+
+// fbm gradient noise remapped to about [0, 1]
+func cloud_layer_noise(scale float64, octaves int) NoiseNode {
+	return &RemapNode{
+		input: &FbmNode{
+			input:      &NoiseSourceNode{kind: NoiseKind_Gradient, scale: scale},
+			octaves:    octaves,
+			lacunarity: 2,
+			gain:       0.5,
+		},
+		in_min: -0.5, in_max: 0.5, out_min: 0, out_max: 1,
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCloudLayerIntersect(t *testing.T) {
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+	// half chord of a sphere of radius r, cut by a line passing d from its center
+	chord := func(r, d float64) float64 {
+		return math.Sqrt(r*r - d*d)
+	}
+	up := Vec3{0, 1, 0}
+	tests := []struct {
+		name      string
+		geometry  LayerGeometry
+		ray       Ray
+		intervals []RayInterval
+	}{
+		{"plane up", LayerGeometry_Plane, Ray{Vec3{0, 0.5, 0}, up}, []RayInterval{{1, 3}}},
+		{"plane slanted", LayerGeometry_Plane, Ray{Vec3{}, Vec3{0, 1, 1}.Normalized()}, []RayInterval{{1.5 * math.Sqrt2, 3.5 * math.Sqrt2}}},
+		{"plane inside", LayerGeometry_Plane, Ray{Vec3{0, 2, 0}, Vec3{0, 0, -1}}, []RayInterval{{0, 50}}},
+		{"plane from above", LayerGeometry_Plane, Ray{Vec3{0, 5, 0}, up.Scale(-1)}, []RayInterval{{1.5, 3.5}}},
+		{"plane below horizon", LayerGeometry_Plane, Ray{Vec3{0, 0.5, 0}, Vec3{0, -1, 1}.Normalized()}, nil},
+		{"sphere up", LayerGeometry_Sphere, Ray{Vec3{}, up}, []RayInterval{{1.5, 3.5}}},
+		// from above the layer straight down, the planet ends the ray
+		{"sphere from above", LayerGeometry_Sphere, Ray{Vec3{0, 10, 0}, up.Scale(-1)}, []RayInterval{{6.5, 8.5}}},
+		// starting inside the layer, horizontal at altitude 3 the ray only rises
+		{"sphere horizontal", LayerGeometry_Sphere, Ray{Vec3{0, 3, 0}, Vec3{0, 0, -1}}, []RayInterval{{0, chord(103.5, 103)}}},
+		// dips under the layer (closest to the planet at altitude 1, z = 0) and comes back out
+		{"sphere dip", LayerGeometry_Sphere, Ray{Vec3{0, 1, 20}, Vec3{0, 0, -1}}, []RayInterval{
+			{0, 20 - chord(101.5, 101)},
+			{20 + chord(101.5, 101), 20 + chord(103.5, 101)},
+		}},
+	}
+	for _, test := range tests {
+		layer := CloudLayer{geometry: test.geometry, bottom: 1.5, top: 3.5, planet_radius: 100, max_distance: 50}
+		intervals, n := layer.intersect(&test.ray)
+		if n != len(test.intervals) {
+			t.Errorf("%s: got %v, want %v", test.name, intervals[:n], test.intervals)
+			continue
+		}
+		for i, want := range test.intervals {
+			if !near(intervals[i].t0, want.t0) || !near(intervals[i].t1, want.t1) {
+				t.Errorf("%s: got %v, want %v", test.name, intervals[:n], test.intervals)
+			}
+		}
+	}
+}
+
+// Every channel of the generated map wraps: stepping from the last row or column onto the first is no bigger a
+// change than the steps inside the map
+func TestWeatherMapWraps(t *testing.T) {
+	n := 64
+	m := generate_weather_map(3, n, 10, 4, 0.7, 0.7)
+	for name, channel := range map[string]*Matrix2D[float32]{"coverage": m.coverage, "cloud_type": m.cloud_type, "precipitation": m.precipitation} {
+		step := func(x0, y0, x1, y1 int) float64 {
+			return math.Abs(float64(channel.get(x0, y0) - channel.get(x1, y1)))
+		}
+		inside := 0.0
+		for y := range n {
+			for x := range n - 1 {
+				inside = max(inside, step(x, y, x+1, y), step(y, x, y, x+1))
+			}
+		}
+		if inside == 0 {
+			t.Fatalf("%s is constant", name)
+		}
+		for i := range n {
+			if wrap := max(step(n-1, i, 0, i), step(i, n-1, i, 0)); wrap > 1.5*inside {
+				t.Fatalf("%s: a step of %v across the edge at %d, at most %v inside", name, wrap, i, inside)
+			}
+		}
+	}
+}
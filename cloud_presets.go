@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cloud genus presets for the cloud layer (CloudLayerDef.Preset, P key), altitudes in world units above the ground.
+
+type CloudPreset struct {
+	name            string
+	bottom, top     float64       // layer altitudes
+	profile         HeightProfile // replaces the per type profiles, ignored by default_cloud_layer
+	cloud_type      float64       // generated weather maps, only drives precipitation when the preset has its own profile
+	coverage        float64
+	shape_scale     float64
+	shape_stretch   Vec3 // per axis noise frequency, 4 on y flattens features into sheets, 0.2 on x streaks them along x
+	detail_scale    float64
+	detail_strength float64
+	density_scale   float64
+	absorption      float64
+	phase           PhaseFunction
+}
+
+// layer settings when no preset is picked, cloud types vary over the weather map
+var default_cloud_layer = CloudPreset{
+	bottom:          1.5,
+	top:             3.5,
+	cloud_type:      0.5,
+	coverage:        0.6,
+	shape_scale:     0.4,
+	shape_stretch:   Vec3{1, 1, 1},
+	detail_scale:    2.5,
+	detail_strength: 0.35,
+	density_scale:   1,
+	absorption:      4,
+	phase:           PhaseFunction{forward: 0.6, back: -0.3, back_weight: 0.3},
+}
+
+var cloud_presets = []CloudPreset{
+	// fair weather heaps with flat bases and billowing tops
+	{
+		name:            "cumulus",
+		bottom:          1.5,
+		top:             3.5,
+		profile:         HeightProfile{0, 0.08, 0.45, 0.95},
+		cloud_type:      0.5,
+		coverage:        0.55,
+		shape_scale:     0.4,
+		shape_stretch:   Vec3{1, 1, 1},
+		detail_scale:    2.5,
+		detail_strength: 0.35,
+		density_scale:   1,
+		absorption:      4,
+		phase:           PhaseFunction{forward: 0.6, back: -0.3, back_weight: 0.3},
+	},
+	// low, featureless grey sheet covering most of the sky
+	{
+		name:            "stratus",
+		bottom:          0.8,
+		top:             1.4,
+		profile:         HeightProfile{0, 0.25, 0.6, 1},
+		cloud_type:      0,
+		coverage:        0.85,
+		shape_scale:     0.15,
+		shape_stretch:   Vec3{1, 3, 1},
+		detail_scale:    1.5,
+		detail_strength: 0.2,
+		density_scale:   0.6,
+		absorption:      3,
+		phase:           PhaseFunction{forward: 0.4, back: -0.2, back_weight: 0.4},
+	},
+	// low rolls and patches with gaps of sky between them
+	{
+		name:            "stratocumulus",
+		bottom:          1.2,
+		top:             2,
+		profile:         HeightProfile{0, 0.15, 0.5, 0.9},
+		cloud_type:      0.25,
+		coverage:        0.75,
+		shape_scale:     0.6,
+		shape_stretch:   Vec3{1, 1.5, 1},
+		detail_scale:    3,
+		detail_strength: 0.3,
+		density_scale:   0.9,
+		absorption:      4,
+		phase:           PhaseFunction{forward: 0.6, back: -0.3, back_weight: 0.3},
+	},
+	// high, thin ice streaks, mostly forward scattering
+	{
+		name:            "cirrus",
+		bottom:          6,
+		top:             6.6,
+		profile:         HeightProfile{0, 0.3, 0.6, 1},
+		cloud_type:      0,
+		coverage:        0.6,
+		shape_scale:     0.25,
+		shape_stretch:   Vec3{0.15, 2, 1},
+		detail_scale:    4,
+		detail_strength: 0.3,
+		density_scale:   1,
+		absorption:      3,
+		phase:           PhaseFunction{forward: 0.8, back: -0.2, back_weight: 0.15},
+	},
+	// towering storm clouds from the low base to the top of the troposphere, dense and raining
+	{
+		name:            "cumulonimbus",
+		bottom:          1.2,
+		top:             7,
+		profile:         HeightProfile{0, 0.05, 0.8, 1},
+		cloud_type:      1,
+		coverage:        0.5,
+		shape_scale:     0.25,
+		shape_stretch:   Vec3{1, 1, 1},
+		detail_scale:    2,
+		detail_strength: 0.3,
+		density_scale:   1.5,
+		absorption:      6,
+		phase:           PhaseFunction{forward: 0.5, back: -0.3, back_weight: 0.35},
+	},
+}
+
+func find_cloud_preset(name string) (*CloudPreset, error) {
+	names := make([]string, len(cloud_presets))
+	for i := range cloud_presets {
+		if cloud_presets[i].name == name {
+			return &cloud_presets[i], nil
+		}
+		names[i] = cloud_presets[i].name
+	}
+	return nil, fmt.Errorf("unknown cloud preset %q, available: %s", name, strings.Join(names, ", "))
+}
+
+// Rebuilds the layer with the preset after the current one, on top of the scene file's layer settings.
+// After the last preset it goes back to the scene file's layer, or to the shape when there's none.
+func cycle_cloud_preset(state *State) error {
+	next := 0
+	if state.layer != nil && state.layer.preset != "" {
+		for i := range cloud_presets {
+			if cloud_presets[i].name == state.layer.preset {
+				next = i + 1
+			}
+		}
+	}
+
+	def := CloudLayerDef{}
+	if state.layer_def != nil {
+		def = *state.layer_def
+	}
+	if next == len(cloud_presets) {
+		if state.layer_def == nil || state.layer_def.Preset != "" {
+			state.layer = nil
+			return nil
+		}
+	} else {
+		def.Preset = cloud_presets[next].name
+	}
+	layer, err := build_cloud_layer(&def)
+	if err != nil {
+		return err
+	}
+	state.layer = layer
+	return nil
+}
+
+func layer_label(layer *CloudLayer) string {
+	switch {
+	case layer == nil:
+		return "off"
+	case layer.preset == "":
+		return "scene"
+	}
+	return layer.preset
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test -run CloudPresetThumbnails -args -thumbnails export/presets
+var thumbnail_dir = flag.String("thumbnails", "", "write the cloud preset thumbnails to this directory")
+
+// Renders every preset with the headless renderer, looking up at the sky from the ground
+func TestCloudPresetThumbnails(t *testing.T) {
+	const w, h = 96, 64
+	dir := *thumbnail_dir
+	if dir == "" {
+		dir = t.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	covered := map[string]float64{}
+	for _, preset := range cloud_presets {
+		layer, err := build_cloud_layer(&CloudLayerDef{Preset: preset.name, Weather: WeatherMapDef{Resolution: 64}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := ImageTarget{Pixels: make([]Pixel, w*h), W: w, H: h}
+		render_params := RenderParameters{
+			img:    &img,
+			camera: &Camera{origin: Vec3{0, 0.1, 0}, p00: Vec3{0, 0.7, 1}, aspect: float64(w) / h},
+			light:  &Light{color: Vec3Fill(1)},
+			layer:  layer,
+			noises: &Noises{fast_noise: NewFastNoise(1234)},
+		}
+		ray_march(&render_params)
+
+		// over the app's clear color
+		thumbnail := image.NewRGBA(image.Rect(0, 0, w, h))
+		background := color.RGBA{5, 10, 30, 255}
+		cloudy := 0
+		for i, p := range img.Pixels {
+			a := float64(p.A) / 255
+			if a > 0.1 {
+				cloudy++
+			}
+			blend := func(c, bg uint8) uint8 {
+				return uint8(float64(c)*a + float64(bg)*(1-a))
+			}
+			thumbnail.Set(i%w, i/w, color.RGBA{blend(p.R, background.R), blend(p.G, background.G), blend(p.B, background.B), 255})
+		}
+		covered[preset.name] = float64(cloudy) / (w * h)
+
+		f, err := os.Create(filepath.Join(dir, preset.name+".png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(f, thumbnail)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, c := range covered {
+		if c < 0.02 || c > 0.99 {
+			t.Errorf("%s: %.0f%% of the thumbnail is cloud", name, c*100)
+		}
+	}
+	// the overcast sheet covers more sky than the scattered heaps
+	if covered["stratus"] <= covered["cumulus"] {
+		t.Errorf("stratus covers %.2f, cumulus %.2f", covered["stratus"], covered["cumulus"])
+	}
+}
+
+func TestCloudPresetCycle(t *testing.T) {
+	state := State{}
+	var seen []string
+	for range len(cloud_presets) + 1 {
+		if err := cycle_cloud_preset(&state); err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, layer_label(state.layer))
+	}
+	if seen[0] != cloud_presets[0].name || seen[len(seen)-2] != cloud_presets[len(cloud_presets)-1].name || seen[len(seen)-1] != "off" {
+		t.Errorf("cycled through %v", seen)
+	}
+}
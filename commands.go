@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headless commands, run as `goclouds <command> [flags]` instead of opening the window
+
+func run_command(name string, args []string) {
+	var err error
+	switch name {
+	case "bake":
+		err = bake_command(args)
+	case "export":
+		err = export_command(args)
+	case "mesh":
+		err = mesh_command(args)
+	case "simulate":
+		err = simulate_command(args)
+	default:
+		err = fmt.Errorf("unknown command %q, available: bake, export, mesh, simulate", name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Regenerates the noise volumes and writes them to the cache NewNoises loads from
+func bake_command(args []string) error {
+	flags := flag.NewFlagSet("bake", flag.ContinueOnError)
+	out_dir := flags.String("out", noise_cache_dir, "output directory")
+	flags.IntVar(&bake_workers, "workers", bake_workers, "number of goroutines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bakes := []struct {
+		name     string
+		params   NoiseGridParams
+		generate NoiseGridGenerator
+	}{
+		{"perlin_values.gcvol", perlin_values_params, generate_perlin_faded},
+		{"perlin_values_tiled.gcvol", perlin_values_tiled_params, generate_perlin_tiled},
+	}
+	for _, b := range bakes {
+		path := filepath.Join(*out_dir, b.name)
+		start := time.Now()
+		last_percent := -1
+		m := b.generate(b.params, func(done, total int) {
+			if percent := done * 100 / total; percent/10 != last_percent/10 {
+				fmt.Printf("\r%s: %3d%%", path, percent)
+				last_percent = percent
+			}
+		})
+		if err := write_volume_file(path, m, b.params); err != nil {
+			return err
+		}
+		fmt.Printf("\r%s: %dx%dx%d in %v\n", path, m.W, m.H, m.D, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Samples a density type over a world box and writes voxel files for other tools
+func export_command(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "export/density", "output path without extension")
+	density_name := flags.String("density", "perlin_precalc", "density type: "+strings.Join(sorted_keys(density_type_names), ", "))
+	scene_path := flags.String("scene", SCENE_FILE, "scene file for the graph and voxel densities")
+	bounds_min := vec3_flag(flags, "min", Vec3{-1, -1, 1}, "world box min corner x,y,z")
+	bounds_max := vec3_flag(flags, "max", Vec3{1, 1, 3}, "world box max corner x,y,z")
+	res_flag := flags.String("res", "64", "resolution, n or x,y,z")
+	density_time := flags.Float64("time", 0, "animation time in seconds")
+	format := flags.String("format", "both", "raw, nrrd or both")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dt, ok := density_type_names[*density_name]
+	if !ok {
+		return fmt.Errorf("unknown density %q", *density_name)
+	}
+	res, err := parse_resolution(*res_flag)
+	if err != nil {
+		return err
+	}
+	if *format != "raw" && *format != "nrrd" && *format != "both" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if bounds_max.X <= bounds_min.X || bounds_max.Y <= bounds_min.Y || bounds_max.Z <= bounds_min.Z {
+		return fmt.Errorf("-max %v must be above -min %v on every axis", *bounds_max, *bounds_min)
+	}
+
+	state := State{noises: NewNoises()}
+	if err := apply_scene_file(*scene_path, &state); err != nil {
+		return err
+	}
+	density_type = dt
+
+	start := time.Now()
+	m := sample_density_grid(sample_density, state.noises, *density_time, *bounds_min, *bounds_max, res, nil)
+	voxel := voxel_size(*bounds_min, *bounds_max, res)
+	meta := VoxelExportMeta{
+		BoundsMin:   [3]float64{bounds_min.X, bounds_min.Y, bounds_min.Z},
+		BoundsMax:   [3]float64{bounds_max.X, bounds_max.Y, bounds_max.Z},
+		VoxelSize:   [3]float64{voxel.X, voxel.Y, voxel.Z},
+		Resolution:  res,
+		DensityType: *density_name,
+		Time:        *density_time,
+	}
+	if err := export_density_grid(*out, m, meta, *format != "nrrd", *format != "raw"); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %dx%dx%d in %v\n", *out, res[0], res[1], res[2], time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Polygonizes a density type inside the marched shape at an iso level, for engine proxies and collision
+func mesh_command(args []string) error {
+	flags := flag.NewFlagSet("mesh", flag.ContinueOnError)
+	out := flags.String("out", "export/cloud", "output path without extension")
+	density_name := flags.String("density", "perlin_precalc", "density type: "+strings.Join(sorted_keys(density_type_names), ", "))
+	scene_path := flags.String("scene", SCENE_FILE, "scene file for the graph and voxel densities")
+	center := vec3_flag(flags, "center", Vec3{0, 0, 2}, "sphere center x,y,z, unless the scene sets a shape")
+	radius := flags.Float64("radius", 1, "sphere radius, unless the scene sets a shape")
+	edge := flags.Float64("edge", 0.1, "distance over which density fades out towards the shape surface")
+	res := flags.Int("res", 96, "grid points across the shape's bounding sphere")
+	iso := flags.Float64("iso", 0.1, "density iso level")
+	density_time := flags.Float64("time", 0, "animation time in seconds")
+	decimate := flags.Float64("decimate", 0, "vertex clustering cell size in world units, 0 to keep the full mesh")
+	format := flags.String("format", "both", "obj, ply or both")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dt, ok := density_type_names[*density_name]
+	if !ok {
+		return fmt.Errorf("unknown density %q", *density_name)
+	}
+	if *res < 2 {
+		return fmt.Errorf("invalid resolution %d", *res)
+	}
+	if *edge <= 0 {
+		return fmt.Errorf("-edge %g must be above 0", *edge)
+	}
+	if *format != "obj" && *format != "ply" && *format != "both" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	state := State{noises: NewNoises(), shape: &Sphere{C: *center, R: *radius}}
+	if err := apply_scene_file(*scene_path, &state); err != nil {
+		return err
+	}
+	density_type = dt
+
+	start := time.Now()
+	mesh := density_mesh(sample_density, state.noises, *density_time, state.shape, *edge, *iso, *res, nil)
+	if *decimate > 0 {
+		mesh = decimate_mesh(mesh, *decimate)
+	}
+	for _, ext := range []string{"obj", "ply"} {
+		if *format != ext && *format != "both" {
+			continue
+		}
+		if err := write_mesh(*out+"."+ext, mesh); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s: %d vertices, %d triangles in %v\n", *out, len(mesh.positions), len(mesh.triangles), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Runs the smoke simulation offline with its fixed time step and writes the density and temperature grids
+func simulate_command(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	out := flags.String("out", "export/fluid", "output path without extension")
+	scene_path := flags.String("scene", SCENE_FILE, "scene file with the fluid settings, defaults otherwise")
+	steps := flags.Int("steps", 150, "time steps to simulate")
+	every := flags.Int("every", 0, "also write every n steps, numbered, 0 for only the last")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of goroutines, doesn't change the result")
+	format := flags.String("format", "both", "raw, nrrd or both")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "raw" && *format != "nrrd" && *format != "both" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	def := &FluidSimDef{}
+	if _, err := os.Stat(*scene_path); err == nil {
+		scene, err := load_scene(*scene_path)
+		if err != nil {
+			return err
+		}
+		if scene.Fluid != nil {
+			def = scene.Fluid
+		}
+	}
+	sim, err := build_fluid_sim(def)
+	if err != nil {
+		return err
+	}
+	sim.workers = *workers
+
+	write := func(base string) error {
+		lo, hi := sim.bounds()
+		m := sim.density
+		meta := VoxelExportMeta{
+			BoundsMin:  [3]float64{lo.X, lo.Y, lo.Z},
+			BoundsMax:  [3]float64{hi.X, hi.Y, hi.Z},
+			VoxelSize:  [3]float64{sim.cell, sim.cell, sim.cell},
+			Resolution: [3]int{m.W, m.H, m.D},
+			Time:       sim.time(),
+		}
+		for _, field := range []struct {
+			suffix, density_type string
+			m                    *Matrix3D[float32]
+		}{{"density", "fluid", sim.density}, {"temperature", "fluid_temperature", sim.temperature}} {
+			meta.DensityType = field.density_type
+			if err := export_density_grid(base+"_"+field.suffix, field.m, meta, *format != "nrrd", *format != "raw"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := time.Now()
+	for i := 1; i <= *steps; i++ {
+		sim.step()
+		if *every > 0 && i%*every == 0 {
+			if err := write(fmt.Sprintf("%s_%04d", *out, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := write(*out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d steps, %.2fs simulated in %v\n", *out, *steps, sim.time(), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func vec3_flag(flags *flag.FlagSet, name string, value Vec3, usage string) *Vec3 {
+	v := value
+	flags.Func(name, fmt.Sprintf("%s (default %g,%g,%g)", usage, v.X, v.Y, v.Z), func(s string) error {
+		parsed, err := parse_vec3(s)
+		if err != nil {
+			return err
+		}
+		v = parsed
+		return nil
+	})
+	return &v
+}
+
+func parse_vec3(s string) (Vec3, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return Vec3{}, fmt.Errorf("expected x,y,z, got %q", s)
+	}
+	var xyz [3]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return Vec3{}, err
+		}
+		xyz[i] = f
+	}
+	return Vec3{xyz[0], xyz[1], xyz[2]}, nil
+}
+
+func parse_resolution(s string) ([3]int, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 1 {
+		parts = []string{s, s, s}
+	}
+	if len(parts) != 3 {
+		return [3]int{}, fmt.Errorf("expected n or x,y,z resolution, got %q", s)
+	}
+	var res [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n <= 0 {
+			return [3]int{}, fmt.Errorf("invalid resolution %q", s)
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"cmp"
+	"os"
+	"runtime"
+)
+
 const WINDOW_WIDTH = 640
 const WINDOW_HEIGHT = 480
 
@@ -9,14 +15,58 @@ const VOL_VIEWPORT_H = WINDOW_HEIGHT / 2
 
 const SHADING_TYPE = ShadingType_RayMarchedLight
 const MAX_JUMPS = 40                  // max jumps for a single ray
+const MIN_JUMP = 0.001                // sphere tracing never reaches a surface it approaches at an angle, step over it
 const SCALE_STEP_RES_TO_OBJECT = true // scale ray advance step based on object size
 const NUM_STEPS_OBJECT_SCALING = 10
 const VOLUME_RESOLUTION = 0.1 // when not scaling
 const EASE_IN_EDGES = true
 const EASE_IN_INSIDE_VOLUMES = true
 
+// cloud layer (scene file "layer")
+const LAYER_STEPS_PER_THICKNESS = 24 // step size along view rays, relative to the layer thickness
+const LAYER_MAX_STEPS = 96           // per ray interval, grazing rays take longer steps
+const LAYER_LIGHT_STEPS = 6
+const LAYER_FADE_START = 0.6 // fraction of max_distance where clouds start fading into the horizon
+const LAYER_AMBIENT = 0.35
+const LAYER_PRECIPITATION_DENSITY = 1.5 // extra density where it rains
+const LAYER_RAIN_STEPS_PER_HEIGHT = 8   // step size through the rain, relative to the height of the cloud base
+const LAYER_RAIN_MAX_STEPS = 24
+
+// solids (scene file "solids")
+const SOLID_MAX_STEPS = 256
+const SOLID_MAX_DISTANCE = 100
+const SOLID_HIT_DISTANCE = 0.001 // relative to the distance along the ray
+const SOLID_AMBIENT = 0.15
+const GOD_RAYS_STEPS_LOW = 12
+const GOD_RAYS_STEPS_HIGH = 48
+const GOD_RAYS_SCREEN_SAMPLES = 48
+const GOD_RAYS_SCREEN_DECAY = 0.97 // weight of each blur sample relative to the previous one
+const GOD_RAYS_SCREEN_EXPOSURE = 0.3
+const GOD_RAYS_SCREEN_WORKERS = 8
+const SHADOW_GRID_RESOLUTION = 32
+const MACRO_GRID_RESOLUTION = 16
+const MACRO_GRID_SUBSAMPLES = 4         // lattice points per macro cell edge the maximum density is taken from
+const MACRO_GRID_EMPTY_DENSITY = 0.0001 // a macro cell below it is skipped
+const VOLUME_BVH_BINS = 12              // candidate split planes per axis of the surface area heuristic
+const VOLUME_BVH_MAX_LEAF = 8           // volumes a leaf may hold when splitting it wouldn't pay off
+const VOLUME_BVH_TRAVERSAL_COST = 1     // of visiting a node, relative to evaluating a volume's sdf
+const VOLUME_BVH_REBUILD_RATIO = 1.5    // refitted trees this much costlier than a fresh build are rebuilt
+const CLOUD_SHADOW_ABSORPTION = 3       // extinction per unit density of the shape's volume, for shadows on solids
+
 var cloud_color = Vec3{0.95, 0.95, 0.95}
-var density_type = DensityType_PerlinPreCalc // updated by key shortcuts 1,2,3
+var density_type = DensityType_PerlinPreCalc // updated by key shortcuts 1-8
+
+const FLUID_MAX_STEPS_PER_FRAME = 2 // the simulation slows down rather than taking longer frames
+
+const LIGHTNING_LIGHTS = 12         // point lights along a bolt
+const LIGHTNING_STROKE_DECAY = 0.08 // seconds for a return stroke to fade to a third
+
+const SCENE_FILE = "scene.json" // optional, see scenes/ for examples
+
+// baked noise volumes, see `goclouds bake`; the GOCLOUDS_CACHE environment variable moves them
+var noise_cache_dir = cmp.Or(os.Getenv("GOCLOUDS_CACHE"), "cache")
+
+var bake_workers = runtime.NumCPU() // goroutines filling noise volumes, doesn't change the result
 
 const RENDER_LIGHT_SOURCE = false
 const ANIMATE_LIGHT_POSITION = false
@@ -1,7 +1,5 @@
 package main
 
-import "math"
-
 func sample_density(point Vec3, noises *Noises, time float64) float64 {
 	switch density_type {
 	case DensityType_PerlinPreCalc:
@@ -10,83 +8,140 @@ func sample_density(point Vec3, noises *Noises, time float64) float64 {
 		// return sample_density_2D_texture(point, noises, time)
 	case DensityType_PerlinRuntime:
 		return sample_density_runtime_perlin(point, noises, time)
+	case DensityType_Graph:
+		return sample_density_graph(point, noises, time)
+	case DensityType_Wispy:
+		return sample_density_wispy(point, noises, time)
+	case DensityType_Voxel:
+		return sample_density_voxel(point, noises, time)
+	case DensityType_Fluid:
+		return sample_density_fluid(point, noises, time)
+	case DensityType_FluidTemperature:
+		return sample_density_fluid_temperature(point, noises, time)
 	default:
 		return 0.05
 	}
 }
 
 func sample_density_runtime_perlin(point Vec3, noises *Noises, time float64) float64 {
+	return graph_runtime_perlin.eval(point, noises, time)
+}
 
-	var p1 float64 = 123
-	{
-		scale := 2.0
-		phase := time * 0.5
-		p1 = noises.perlin_gen.Noise3D(
-			point.X*scale+phase*1,
-			point.Y*scale+phase*0,
-			point.Z*scale+phase*2,
-		)
-		p1 = clamp01(p1)
-	}
+func sample_density_pre_calc_perlin_1(point Vec3, noises *Noises, time float64) float64 {
+	return graph_pre_calc_perlin_1.eval(point, noises, time)
+}
 
-	var p2 float64
-	{
-		scale := 7.0
-		phase := time * 1
-		p2 = noises.perlin_gen.Noise3D(
-			point.X*scale+phase*1,
-			point.Y*scale+phase*0,
-			math.Abs(point.Z)*scale+phase*1, // see Noise3D implementation, falls back to 3D if z < 0
-		)
-		p2 = clamp01(p2)
-	}
+func sample_density_pre_calc_perlin_2(point Vec3, noises *Noises, time float64) float64 {
+	return graph_pre_calc_perlin_2.eval(point, noises, time)
+}
 
-	p := mix(p1, p2, 0.5)
-	return p
+func sample_density_voxel(point Vec3, noises *Noises, time float64) float64 {
+	if noises.voxel_volume == nil {
+		return 0
+	}
+	return noises.voxel_volume.sample(point)
 }
 
-func sample_density_pre_calc_perlin_1(point Vec3, noises *Noises, time float64) float64 {
-	scale := 0.8
-	phase := time * 0.08
-	coords := point.Scale(scale).Add(Vec3{phase * 1, phase * 0, phase * 2})
-	coords = coords.Add(Vec3{0.2, 0.2, 0.2}) // avoid tiling edges where it's all zeros
-	perlin_1 := noises.perlin_values.getFromVectorWrap(coords)
-	perlin_1 = clamp01(perlin_1)
-	return perlin_1
+// Whether the fluid simulation is what is rendered
+func rendering_fluid(noises *Noises) bool {
+	return noises.fluid != nil && (density_type == DensityType_Fluid || density_type == DensityType_FluidTemperature)
 }
 
-func sample_density_pre_calc_perlin_2(point Vec3, noises *Noises, time float64) float64 {
-	var p1 float64
-	{
-		scale := 0.4
-		phase := time * 0.08
-		coords := point.Scale(scale).Add(Vec3{phase * 1, phase * 0, phase * 2})
-		coords = coords.Add(Vec3{0.05, 0.1, 0.15}) // avoid tiling edges where it's all zeros
-		p1 = noises.perlin_values.getFromVectorWrap(coords)
-		p1 = clamp01(p1)
+// the simulation's own time, not the render time
+func sample_density_fluid(point Vec3, noises *Noises, time float64) float64 {
+	if noises.fluid == nil {
+		return 0
 	}
-	var p2 float64
-	{
-		scale := 0.8
-		phase := time * 0.08
-		coords := point.Scale(scale).Add(Vec3{phase * 1, phase * 0, phase * 2})
-		coords = coords.Add(Vec3{0.05, 0.1, 0.15}) // avoid tiling edges where it's all zeros
-		p2 = noises.perlin_values.getFromVectorWrap(coords)
-		p2 = clamp01(p2)
+	return noises.fluid.sample(noises.fluid.density, point)
+}
+
+func sample_density_fluid_temperature(point Vec3, noises *Noises, time float64) float64 {
+	if noises.fluid == nil {
+		return 0
 	}
-	p := mix(p1, p2, 0.5)
-	return p
+	return noises.fluid.sample(noises.fluid.temperature, point)
+}
+
+// sample_density_pre_calc_perlin_2 swirled by wind-driven curl noise and warping instead of only translated
+func sample_density_wispy(point Vec3, noises *Noises, time float64) float64 {
+	return graph_wispy.eval(point, noises, time)
 }
 
 func sample_density_2D_texture(point Vec3, noises *Noises, time float64) float64 {
-	noise_scale := 20.0
-	noise_phase := time * 4
-	noise_x := int(math.Abs(point.X*noise_scale + noise_phase*1))
-	noise_y := int(math.Abs(point.Y*noise_scale + noise_phase*1))
-	// noise_z := int(math.Abs(point.Z*noise_scale*2 + noise_phase*1))
-	noise1 := noises.tex_values.getWrap(noise_x, noise_y)
-	// noise2 := noises.tex_values.get(noise_y, noise_z)
-	// noisef_0 := (noise1 + noise2) * 0.5
-	noisef := noise1
-	return noisef
+	return graph_2D_texture.eval(point, noises, time)
+}
+
+func sample_density_graph(point Vec3, noises *Noises, time float64) float64 {
+	if noises.density_graph == nil {
+		return 0
+	}
+	return noises.density_graph.eval(point, noises, time)
+}
+
+// two octaves of runtime noise carried by the wind, the detail faster than the shape
+var graph_runtime_perlin NoiseNode = &AddNode{
+	inputs: []NoiseNode{
+		&ClampNode{
+			input: &WindAdvectNode{speed: 1, input: &NoiseSourceNode{kind: NoiseKind_Gradient, scale: 2.0}},
+			min:   0, max: 1,
+		},
+		&ClampNode{
+			input: &WindAdvectNode{speed: 1.6, input: &NoiseSourceNode{kind: NoiseKind_Gradient, scale: 7.0}},
+			min:   0, max: 1,
+		},
+	},
+	weights: []float64{0.5, 0.5},
+}
+
+var graph_pre_calc_perlin_1 NoiseNode = &ClampNode{
+	input: &NoiseSourceNode{
+		kind:     NoiseKind_PerlinGrid,
+		scale:    0.8,
+		velocity: Vec3{0.08, 0, 0.16},
+		offset:   Vec3{0.2, 0.2, 0.2}, // avoid tiling edges where it's all zeros
+	},
+	min: 0, max: 1,
+}
+
+var graph_pre_calc_perlin_2 NoiseNode = &AddNode{
+	inputs: []NoiseNode{
+		&ClampNode{
+			input: &NoiseSourceNode{
+				kind:     NoiseKind_PerlinGrid,
+				scale:    0.4,
+				velocity: Vec3{0.08, 0, 0.16},
+				offset:   Vec3{0.05, 0.1, 0.15}, // avoid tiling edges where it's all zeros
+			},
+			min: 0, max: 1,
+		},
+		&ClampNode{
+			input: &NoiseSourceNode{
+				kind:     NoiseKind_PerlinGrid,
+				scale:    0.8,
+				velocity: Vec3{0.08, 0, 0.16},
+				offset:   Vec3{0.05, 0.1, 0.15},
+			},
+			min: 0, max: 1,
+		},
+	},
+	weights: []float64{0.5, 0.5},
+}
+
+var graph_wispy NoiseNode = &CurlWarpNode{
+	scale:     0.8,
+	amplitude: 1.2, // about as far as the curl swirled it before it was capped
+	steps:     2,
+	wind:      Vec3{0.2, 0.05, 0.3},
+	input: &DomainWarpNode{
+		scale:     2.0,
+		amplitude: 0.06, // finer wisps on top of the large swirls
+		wind:      Vec3{0.4, 0, 0.6},
+		input:     graph_pre_calc_perlin_2,
+	},
+}
+
+var graph_2D_texture NoiseNode = &NoiseSourceNode{
+	kind:     NoiseKind_Texture,
+	scale:    20.0,
+	velocity: Vec3{4, 4, 0},
 }
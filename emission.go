@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Light given off by a volume, for fire, explosions and glowing storm cores. Emission is radiance per unit length,
+// added along view rays behind whatever is in front of it, it isn't lit, shadowed or scattered.
+
+type EmissionType = int
+
+const (
+	EmissionType_Constant  = iota // the same glow wherever the volume is
+	EmissionType_Density          // proportional to the density
+	EmissionType_Blackbody        // color and brightness from the temperature
+)
+
+var emission_type_names = map[string]EmissionType{
+	"constant":  EmissionType_Constant,
+	"density":   EmissionType_Density,
+	"blackbody": EmissionType_Blackbody,
+}
+
+type Emission struct {
+	kind      EmissionType
+	color     Vec3
+	intensity float64
+
+	// blackbody, the temperature is the fluid simulation's when it is rendered, the density otherwise
+	kelvin_scale     float64 // Kelvin per unit of temperature
+	kelvin_offset    float64 // Kelvin at temperature 0
+	reference_kelvin float64 // glows with intensity at this temperature
+}
+
+// nothing visible glows below this, Kelvin
+const DRAPER_POINT = 798.0
+
+// Emitted radiance per unit length at p, nil emits nothing
+func (e *Emission) emitted(p Vec3, density float64, noises *Noises) Vec3 {
+	if e == nil {
+		return Vec3{}
+	}
+	switch e.kind {
+	case EmissionType_Density:
+		return e.color.Scale(e.intensity * density)
+	case EmissionType_Blackbody:
+		kelvin := e.kelvin_offset + e.kelvin_scale*sample_temperature(p, density, noises)
+		return kelvin_to_rgb(kelvin).Scale(e.intensity * blackbody_brightness(kelvin, e.reference_kelvin))
+	}
+	return e.color.Scale(e.intensity)
+}
+
+// Radiated power relative to the reference temperature (Stefan-Boltzmann), starting from 0 at the Draper point
+func blackbody_brightness(kelvin, reference float64) float64 {
+	if kelvin <= DRAPER_POINT {
+		return 0
+	}
+	d4 := math.Pow(DRAPER_POINT, 4)
+	return (math.Pow(kelvin, 4) - d4) / (math.Pow(reference, 4) - d4)
+}
+
+// Temperature driving blackbody emission: the simulated one when the fluid is rendered, otherwise the density, so
+// noise volumes burn hottest where they are thickest
+func sample_temperature(p Vec3, density float64, noises *Noises) float64 {
+	if rendering_fluid(noises) {
+		return noises.fluid.sample(noises.fluid.temperature, p)
+	}
+	return density
+}
+
+// Color of a blackbody, normalized so the brightest channel is 1. Fit to the CIE 1964 10° color matching functions,
+// good from 1000 K to 40000 K, 6600 K is white.
+// https://tannerhelland.com/2012/09/18/convert-temperature-rgb-algorithm-code.html
+func kelvin_to_rgb(kelvin float64) Vec3 {
+	t := clamp(kelvin, 1000, 40000) / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	return Vec3{clamp(r, 0, 255), clamp(g, 0, 255), clamp(b, 0, 255)}.Scale(1.0 / 255)
+}
+
+// Adds light emitted along a ray (premultiplied, already attenuated by what's in front) to a non-premultiplied color.
+// A glow can be brighter than its volume is opaque, the alpha then grows to carry it, exact over a black background.
+func add_emission(c Vec4, emitted Vec3) Vec4 {
+	if emitted == (Vec3{}) {
+		return c
+	}
+	premultiplied := Vec3{c.X, c.Y, c.Z}.Scale(c.W).Add(emitted)
+	alpha := clamp01(max(c.W, premultiplied.X, premultiplied.Y, premultiplied.Z))
+	if alpha == 0 {
+		return c
+	}
+	color := premultiplied.Scale(1 / alpha)
+	return Vec4{color.X, color.Y, color.Z, alpha}
+}
+
+// Scene file representation of an emission, see build_emission for defaults
+type EmissionDef struct {
+	Type      string     `json:"type"`             // constant, density or blackbody
+	Color     [3]float64 `json:"color,omitempty"`  // constant and density
+	Kelvin    float64    `json:"kelvin,omitempty"` // constant and density, color of a blackbody instead of color
+	Intensity float64    `json:"intensity,omitempty"`
+
+	KelvinScale     float64 `json:"kelvin_scale,omitempty"`
+	KelvinOffset    float64 `json:"kelvin_offset,omitempty"`
+	ReferenceKelvin float64 `json:"reference_kelvin,omitempty"`
+}
+
+func build_emission(def *EmissionDef) (*Emission, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	kind, ok := emission_type_names[def.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown emission type %q, available: constant, density, blackbody", def.Type)
+	}
+	e := Emission{
+		kind:             kind,
+		color:            Vec3{def.Color[0], def.Color[1], def.Color[2]},
+		intensity:        or_default(def.Intensity, 1),
+		kelvin_scale:     or_default(def.KelvinScale, 1000),
+		kelvin_offset:    or_default(def.KelvinOffset, 300),
+		reference_kelvin: or_default(def.ReferenceKelvin, 1500),
+	}
+	if def.Kelvin != 0 {
+		e.color = kelvin_to_rgb(def.Kelvin)
+	} else if e.color == (Vec3{}) {
+		e.color = kelvin_to_rgb(1800) // embers
+	}
+	if e.reference_kelvin <= DRAPER_POINT {
+		return nil, fmt.Errorf("reference_kelvin %v doesn't glow, it must be above %v", e.reference_kelvin, DRAPER_POINT)
+	}
+	return &e, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestKelvinToRGB(t *testing.T) {
+	ember, white, blue := kelvin_to_rgb(1500), kelvin_to_rgb(6600), kelvin_to_rgb(20000)
+	if !(ember.X > ember.Y && ember.Y > ember.Z) {
+		t.Errorf("1500 K is %v, should be red to orange", ember)
+	}
+	if white.X < 0.99 || white.Y < 0.99 || white.Z < 0.99 {
+		t.Errorf("6600 K is %v, should be white", white)
+	}
+	if !(blue.Z > blue.Y && blue.Y > blue.X) {
+		t.Errorf("20000 K is %v, should be blue", blue)
+	}
+}
+
+func TestBlackbodyEmission(t *testing.T) {
+	e, err := build_emission(&EmissionDef{Type: "blackbody", KelvinScale: 1000, KelvinOffset: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noises := &Noises{}
+	if c := e.emitted(Vec3{}, 0, noises); c != (Vec3{}) {
+		t.Errorf("500 K glows %v", c)
+	}
+	if c := e.emitted(Vec3{}, 1, noises); c.X < 0.99 || c.X > 1.01 {
+		t.Errorf("the reference temperature glows %v, should have intensity 1 in red", c)
+	}
+	if hot, cool := e.emitted(Vec3{}, 2.5, noises), e.emitted(Vec3{}, 0.5, noises); hot.X <= cool.X {
+		t.Errorf("3000 K glows %v, less than 1000 K %v", hot, cool)
+	}
+}
+
+func TestAddEmission(t *testing.T) {
+	cases := []struct {
+		name    string
+		color   Vec4
+		emitted Vec3
+		want    Vec4
+	}{
+		{"none", Vec4{0.5, 0.5, 0.5, 0.5}, Vec3{}, Vec4{0.5, 0.5, 0.5, 0.5}},
+		{"glow in empty space", Vec4{}, Vec3{0.4, 0.2, 0}, Vec4{1, 0.5, 0, 0.4}},
+		{"over an opaque volume", Vec4{0.2, 0.2, 0.2, 1}, Vec3{0.5, 0, 0}, Vec4{0.7, 0.2, 0.2, 1}},
+		{"inside a translucent volume", Vec4{0.5, 0.5, 0.5, 0.5}, Vec3{0.2, 0.1, 0}, Vec4{0.9, 0.7, 0.5, 0.5}},
+	}
+	for _, c := range cases {
+		got := add_emission(c.color, c.emitted)
+		d := got.Sub(c.want)
+		if d.X*d.X+d.Y*d.Y+d.Z*d.Z+d.W*d.W > 1e-12 {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
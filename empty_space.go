@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// Empty-space skipping: a coarse grid over the shape's bounds holding the highest density in each macro cell over a
+// window of time, sampled on a finer lattice. View rays leap whole steps through runs of empty cells instead of
+// sampling them, never further than the distance to the shape's surface, so the samples they do take are where they
+// would have been. Marches towards the light leap the empty runs along their way the same way.
+
+type MacroGrid struct {
+	resolution int     // cells along each axis
+	window     float64 // seconds the maxima hold for, animated densities are sampled across it
+
+	max      *Matrix3D[float32]
+	min      Vec3    // corner of the first cell
+	cell     float64 // world size of a cell
+	shape    Shape
+	density  DensityType
+	voxels   *VoxelVolume
+	built_at float64 // start of the window
+}
+
+// Rebuilds the grid if it is out of date, before the frame is rendered
+func (m *MacroGrid) update(render_params *RenderParameters) {
+	if m == nil || render_params.layer != nil || render_params.shape == nil {
+		return
+	}
+	t, window := volume_time(render_params), m.window
+	if rendering_fluid(render_params.noises) {
+		window = 0 // the maxima can't be known ahead of the simulation
+	}
+	if m.max != nil && m.shape == render_params.shape && m.density == density_type &&
+		m.voxels == render_params.noises.voxel_volume && t >= m.built_at && t <= m.built_at+window {
+		return
+	}
+	m.build(render_params, t, window)
+}
+
+func (m *MacroGrid) build(render_params *RenderParameters, t, window float64) {
+	shape, noises := render_params.shape, render_params.noises
+	bounds := shape.bounding_sphere()
+	n, sub := m.resolution, MACRO_GRID_SUBSAMPLES
+	m.cell = 2 * bounds.R / float64(n)
+	m.min = bounds.C.Sub(Vec3Fill(bounds.R))
+	m.shape, m.density, m.voxels, m.built_at = shape, density_type, noises.voxel_volume, t
+	if m.max == nil || m.max.W != n {
+		m.max = NewMatrix3D[float32](n, n, n)
+	}
+
+	times := []float64{render_params.time}
+	if window > 0 {
+		times = []float64{t, t + window/2, t + window}
+	}
+	// lattice points on the cell corners and between them, shared by neighbouring cells
+	l := n*sub + 1
+	spacing := m.cell / float64(sub)
+	lattice := NewMatrix3D[float32](l, l, l)
+	fill_matrix3D_parallel(lattice, runtime.NumCPU(), nil, func(x, y, z int) float32 {
+		p := m.min.Add(Vec3{float64(x), float64(y), float64(z)}.Scale(spacing))
+		highest := 0.0
+		for _, t := range times {
+			highest = max(highest, sample_density(p, noises, t))
+		}
+		return float32(highest)
+	})
+	fill_matrix3D_parallel(m.max, runtime.NumCPU(), nil, func(x, y, z int) float32 {
+		highest := float32(0)
+		for ly := y * sub; ly <= (y+1)*sub; ly++ {
+			for lx := x * sub; lx <= (x+1)*sub; lx++ {
+				for lz := z * sub; lz <= (z+1)*sub; lz++ {
+					highest = max(highest, lattice.values[ly*l*l+lx*l+lz])
+				}
+			}
+		}
+		return highest
+	})
+}
+
+// Macro cell containing p, not ok outside the grid
+func (m *MacroGrid) cell_at(p Vec3) (x, y, z int, ok bool) {
+	c := p.Sub(m.min).Scale(1 / m.cell)
+	x, y, z = int(math.Floor(c.X)), int(math.Floor(c.Y)), int(math.Floor(c.Z))
+	ok = x >= 0 && y >= 0 && z >= 0 && x < m.resolution && y < m.resolution && z < m.resolution
+	return
+}
+
+func (m *MacroGrid) empty(x, y, z int) bool {
+	return float64(m.max.get(x, y, z)) <= MACRO_GRID_EMPTY_DENSITY
+}
+
+// Number of samples ds apart from the ray's origin on that are all in empty cells, walking the cells along the ray
+// (Amanatides-Woo). inside is how far the ray is sure to stay inside the shape, it never leaps further.
+func (m *MacroGrid) leap(ray *Ray, ds, inside float64) int {
+	if m == nil || m.max == nil || inside <= 0 {
+		return 0
+	}
+	x, y, z, ok := m.cell_at(ray.origin)
+	if !ok || !m.empty(x, y, z) {
+		return 0
+	}
+	cell := [3]int{x, y, z}
+	origin := [3]float64{ray.origin.X, ray.origin.Y, ray.origin.Z}
+	dir := [3]float64{ray.dir.X, ray.dir.Y, ray.dir.Z}
+	corner := [3]float64{m.min.X, m.min.Y, m.min.Z}
+	var step [3]int
+	var next, delta [3]float64 // distance to the next boundary on each axis, and between boundaries
+	for i := range 3 {
+		switch {
+		case dir[i] > 0:
+			step[i] = 1
+			next[i] = (corner[i] + float64(cell[i]+1)*m.cell - origin[i]) / dir[i]
+			delta[i] = m.cell / dir[i]
+		case dir[i] < 0:
+			step[i] = -1
+			next[i] = (corner[i] + float64(cell[i])*m.cell - origin[i]) / dir[i]
+			delta[i] = -m.cell / dir[i]
+		default:
+			next[i], delta[i] = math.Inf(1), math.Inf(1)
+		}
+	}
+	t := 0.0
+	for t < inside {
+		axis := 0
+		if next[1] < next[axis] {
+			axis = 1
+		}
+		if next[2] < next[axis] {
+			axis = 2
+		}
+		t = next[axis]
+		cell[axis] += step[axis]
+		next[axis] += delta[axis]
+		if cell[axis] < 0 || cell[axis] >= m.resolution || !m.empty(cell[0], cell[1], cell[2]) {
+			break
+		}
+	}
+	// the samples at j*ds before there
+	return int(math.Ceil(min(t, inside) / ds))
+}
+
+// Skipping changes nothing only where empty space gives off no light
+func skipping_allowed(render_params *RenderParameters) bool {
+	e := render_params.emission
+	return render_params.macro_grid != nil && (e == nil || e.kind == EmissionType_Density)
+}
+
+// Scene file representation of the macro grid
+type MacroGridDef struct {
+	Resolution int     `json:"resolution,omitempty"`
+	Window     float64 `json:"window,omitempty"` // seconds, negative samples only the current time
+}
+
+func build_macro_grid(def *MacroGridDef) (*MacroGrid, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	m := MacroGrid{
+		resolution: or_default_int(def.Resolution, MACRO_GRID_RESOLUTION),
+		window:     max(0, or_default(def.Window, 1)),
+	}
+	if m.resolution < 1 || m.resolution > 128 {
+		return nil, fmt.Errorf("resolution %d, between 1 and 128", m.resolution)
+	}
+	return &m, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// go test -run EmptySpaceSkipping -v reports the frame times and the difference
+func TestEmptySpaceSkipping(t *testing.T) {
+	prev := density_type
+	density_type = DensityType_Graph
+	defer func() { density_type = prev }()
+
+	// clamped coarse noise, empty where it is negative
+	rp := bench_render_parameters()
+	rp.noises.density_graph = &ClampNode{input: &NoiseSourceNode{kind: NoiseKind_Gradient, scale: 1.5}, min: 0, max: 1}
+	render := func(macro_grid *MacroGrid) ([]Pixel, time.Duration) {
+		rp.img = &ImageTarget{Pixels: make([]Pixel, 320*240), W: 320, H: 240}
+		rp.macro_grid = macro_grid
+		start := time.Now()
+		ray_march(rp)
+		return rp.img.Pixels, time.Since(start)
+	}
+	full, full_time := render(nil)
+	macro_grid, err := build_macro_grid(&MacroGridDef{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	render(macro_grid) // builds the grid
+	skipped, skip_time := render(macro_grid)
+
+	empty := 0
+	for _, v := range macro_grid.max.values {
+		if float64(v) <= MACRO_GRID_EMPTY_DENSITY {
+			empty++
+		}
+	}
+	sum, worst := 0.0, 0.0
+	for i := range full {
+		for _, d := range []float64{
+			float64(full[i].R) - float64(skipped[i].R),
+			float64(full[i].G) - float64(skipped[i].G),
+			float64(full[i].B) - float64(skipped[i].B),
+			float64(full[i].A) - float64(skipped[i].A),
+		} {
+			sum += math.Abs(d) / 255
+			worst = max(worst, math.Abs(d)/255)
+		}
+	}
+	mean := sum / float64(4*len(full))
+	t.Logf("full %v, skipping %v with %d of %d macro cells empty, mean difference %.5f, worst %.3f",
+		full_time, skip_time, empty, len(macro_grid.max.values), mean, worst)
+	if empty == 0 {
+		t.Error("no empty macro cells")
+	}
+	if mean > 0.002 || worst > 0.1 {
+		t.Errorf("mean difference %v, worst %v", mean, worst)
+	}
+}
+
+func TestMacroGridLeap(t *testing.T) {
+	// 4 cells of 1 along x from 0, the third one dense
+	m := MacroGrid{resolution: 4, max: NewMatrix3D[float32](4, 4, 4), cell: 1}
+	for y := range 4 {
+		for z := range 4 {
+			m.max.set(1, 2, y, z)
+		}
+	}
+	ray := Ray{origin: Vec3{0.25, 0.5, 0.5}, dir: Vec3{1, 0, 0}}
+	// empty up to x = 2, samples at 0.25, 0.55, ... 1.75 are in it
+	if n := m.leap(&ray, 0.3, 10); n != 6 {
+		t.Errorf("leapt %d samples, want 6", n)
+	}
+	if n := m.leap(&ray, 0.3, 1); n != 4 {
+		t.Errorf("leapt %d samples 1 inside the shape, want 4", n)
+	}
+	ray.origin.X = 2.5
+	if n := m.leap(&ray, 0.3, 10); n != 0 {
+		t.Errorf("leapt %d samples from a dense cell", n)
+	}
+	// back from the last cell, to the dense one
+	ray = Ray{origin: Vec3{3.9, 0.5, 0.5}, dir: Vec3{-1, 0, 0}}
+	if n := m.leap(&ray, 0.5, 10); n != 2 {
+		t.Errorf("leapt %d samples backwards, want 2", n)
+	}
+	empty_at := func(p Vec3) bool {
+		x, y, z, ok := m.cell_at(p)
+		return ok && m.empty(x, y, z)
+	}
+	if !empty_at(Vec3{1.5, 3.5, 0.1}) || empty_at(Vec3{2.5, 0.1, 0.1}) || empty_at(Vec3{-1, 0, 0}) {
+		t.Error("cell_at disagrees with the cells")
+	}
+}
+
+// density 1 between lo and hi along x, counting its samples
+type slab_density struct {
+	lo, hi  float64
+	samples int
+}
+
+func (s *slab_density) eval(p Vec3, noises *Noises, time float64) float64 {
+	s.samples++
+	if p.X >= s.lo && p.X < s.hi {
+		return 1
+	}
+	return 0
+}
+
+// The march towards the light samples the density along its way, and leaping the empty cells changes nothing but
+// the number of samples
+func TestLightMarchMacroGrid(t *testing.T) {
+	prev := density_type
+	density_type = DensityType_Graph
+	defer func() { density_type = prev }()
+
+	slab := &slab_density{lo: 0.2, hi: 0.6}
+	rp := bench_render_parameters()
+	rp.shape = &Sphere{R: 1}
+	rp.light = &Light{origin: Vec3{5, 0, 0}, color: Vec3Fill(1)}
+	rp.noises.density_graph = slab
+	// samples 0.1 apart from -0.95 to 0.95, four of them in the slab
+	start := Vec3{-0.95, 0, 0}
+	distance, density := march_through_volume_to_light(start, rp.shape, nil, rp.light, rp.noises, 0)
+	marched := slab.samples
+	if math.Abs(density-4) > 1e-9 || math.Abs(distance-1.95) > 1e-9 {
+		t.Errorf("marched a distance of %v through a density of %v, want 1.95 and 4", distance, density)
+	}
+
+	rp.macro_grid, _ = build_macro_grid(&MacroGridDef{Window: -1})
+	rp.macro_grid.update(rp)
+	slab.samples = 0
+	leapt_distance, leapt_density := march_through_volume_to_light(start, rp.shape, rp.macro_grid, rp.light, rp.noises, 0)
+	if math.Abs(leapt_distance-distance) > 1e-9 || math.Abs(leapt_density-density) > 1e-9 {
+		t.Errorf("leaping the empty cells marched %v through %v, without %v through %v", leapt_distance, leapt_density, distance, density)
+	}
+	if slab.samples >= marched {
+		t.Errorf("%d samples leaping the empty cells, %d without", slab.samples, marched)
+	}
+	// the start is in an empty cell, the slab still shadows it
+	if light, want := shape_light_amount(start, rp), beers_law(leapt_distance, leapt_density); light != want {
+		t.Errorf("light amount %v in an empty cell, want %v", light, want)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"math"
+	"os"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// 2D masks (PNG silhouettes or rendered text) extruded into 3D shapes with a rounded profile.
+// The mask goes through an exact euclidean distance transform, the extrusion is
+// https://iquilezles.org/articles/distfunctions/ (Extrusion) with the 2D shape inset by the rounding radius.
+
+const EXTRUDE_MASK_PADDING = 4 // outside pixels around the mask, so its edges have a boundary to measure from
+
+type ExtrudedShape struct {
+	dist       *Matrix2D[float32] // signed distance to the mask edge in pixels, negative inside, row 0 at the top
+	pixel      float64            // world size of a pixel
+	center     Vec3
+	half_depth float64
+	rounding   float64
+	deepest    float64 // largest inset of the 2D mask, world units
+}
+
+// Signed distance in pixels for a mask of inside cells, measured between pixel centers and corrected by half a pixel
+// so the zero crossing is on the pixel edges
+func signed_distance_2d(inside *Matrix2D[bool]) *Matrix2D[float32] {
+	to_inside := distance_transform_2d(inside, true)
+	to_outside := distance_transform_2d(inside, false)
+	dist := NewDataMatrix[float32](inside.W, inside.H)
+	for i, in := range inside.values {
+		if in {
+			dist.values[i] = float32(0.5 - math.Sqrt(to_outside[i]))
+		} else {
+			dist.values[i] = float32(math.Sqrt(to_inside[i]) - 0.5)
+		}
+	}
+	return dist
+}
+
+// Squared distance from every cell to the nearest cell where mask == target, separable in columns then rows.
+// Felzenszwalb, Huttenlocher: Distance Transforms of Sampled Functions
+func distance_transform_2d(mask *Matrix2D[bool], target bool) []float64 {
+	const far = 1e20
+	w, h := mask.W, mask.H
+	d := make([]float64, w*h)
+	for i, v := range mask.values {
+		if v != target {
+			d[i] = far
+		}
+	}
+
+	n := max(w, h)
+	f, out := make([]float64, n), make([]float64, n)
+	v, z := make([]int, n), make([]float64, n+1)
+	for x := range w {
+		for y := range h {
+			f[y] = d[y*w+x]
+		}
+		distance_transform_1d(f[:h], out[:h], v, z)
+		for y := range h {
+			d[y*w+x] = out[y]
+		}
+	}
+	for y := range h {
+		copy(f, d[y*w:(y+1)*w])
+		distance_transform_1d(f[:w], out[:w], v, z)
+		copy(d[y*w:(y+1)*w], out[:w])
+	}
+	return d
+}
+
+// Lower envelope of the parabolas (q - p)^2 + f[p], v and z are scratch space
+func distance_transform_1d(f, out []float64, v []int, z []float64) {
+	k := 0
+	v[0] = 0
+	z[0], z[1] = math.Inf(-1), math.Inf(1)
+	intersection := func(q, p int) float64 {
+		return ((f[q] + float64(q*q)) - (f[p] + float64(p*p))) / float64(2*q-2*p)
+	}
+	for q := 1; q < len(f); q++ {
+		s := intersection(q, v[k])
+		for s <= z[k] {
+			k--
+			s = intersection(q, v[k])
+		}
+		k++
+		v[k] = q
+		z[k], z[k+1] = s, math.Inf(1)
+	}
+	k = 0
+	for q := range f {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		out[q] = float64((q-v[k])*(q-v[k])) + f[v[k]]
+	}
+}
+
+// Inside where the (alpha premultiplied) luminance is above half, or below with invert
+func load_png_mask(path string, invert bool) (*Matrix2D[bool], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b := img.Bounds()
+	mask := NewDataMatrix[bool](b.Dx()+2*EXTRUDE_MASK_PADDING, b.Dy()+2*EXTRUDE_MASK_PADDING)
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			gray := color.Gray16Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16)
+			in := gray.Y > 0x7fff
+			if invert {
+				in = !in
+			}
+			mask.set(in, x+EXTRUDE_MASK_PADDING, y+EXTRUDE_MASK_PADDING)
+		}
+	}
+	return mask, nil
+}
+
+// Rasterizes text with the embedded Go Bold font, line_height pixels per line, lines split on \n
+func text_mask(text string, line_height int) (*Matrix2D[bool], error) {
+	ttf, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: float64(line_height), DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	lines := strings.Split(text, "\n")
+	metrics := face.Metrics()
+	ascent, line := metrics.Ascent.Ceil(), metrics.Height.Ceil()
+	width := 0
+	for _, l := range lines {
+		width = max(width, font.MeasureString(face, l).Ceil())
+	}
+	if width == 0 {
+		return nil, fmt.Errorf("text %q has no visible glyphs", text)
+	}
+	height := line*(len(lines)-1) + ascent + metrics.Descent.Ceil()
+	img := image.NewAlpha(image.Rect(0, 0, width+2*EXTRUDE_MASK_PADDING, height+2*EXTRUDE_MASK_PADDING))
+	drawer := font.Drawer{Dst: img, Src: image.Opaque, Face: face}
+	for i, l := range lines {
+		// centered lines
+		x := EXTRUDE_MASK_PADDING + (width-font.MeasureString(face, l).Ceil())/2
+		drawer.Dot = fixed.P(x, EXTRUDE_MASK_PADDING+ascent+i*line)
+		drawer.DrawString(l)
+	}
+
+	mask := NewDataMatrix[bool](img.Rect.Dx(), img.Rect.Dy())
+	for i, a := range img.Pix {
+		mask.values[i] = a > 127
+	}
+	return mask, nil
+}
+
+// Extrudes the mask along z, centered on center in the xy plane, scaled so the mask's largest side is size.
+// rounding <= 0 picks half the deepest inset of the mask (half the stroke width for text), capped by half_depth.
+func NewExtrudedShape(mask *Matrix2D[bool], center Vec3, size, depth, rounding float64) *ExtrudedShape {
+	dist := signed_distance_2d(mask)
+	pixel := size / float64(max(mask.W, mask.H))
+	half_depth := depth / 2
+	deepest := float32(0)
+	for _, d := range dist.values {
+		deepest = min(deepest, d)
+	}
+	inset := -float64(deepest) * pixel
+	if rounding <= 0 {
+		rounding = inset * 0.5
+	}
+	return &ExtrudedShape{
+		dist:       dist,
+		pixel:      pixel,
+		center:     center,
+		half_depth: half_depth,
+		rounding:   min(rounding, half_depth),
+		deepest:    max(inset, pixel),
+	}
+}
+
+func (s *ExtrudedShape) sdf(p Vec3) float64 {
+	local := p.Sub(s.center)
+	// world to pixel coordinates, image rows go down
+	half_w, half_h := float64(s.dist.W-1)/2, float64(s.dist.H-1)/2
+	u := local.X/s.pixel + half_w
+	v := half_h - local.Y/s.pixel
+	cu, cv := clamp(u, 0, 2*half_w), clamp(v, 0, 2*half_h)
+	d2 := matrix2D_sample_bilinear(s.dist, cu, cv) * s.pixel
+	if cu != u || cv != v {
+		// outside the image, lower bound like MeshSdf
+		to_rect := math.Hypot(u-cu, v-cv) * s.pixel
+		d2 = max(to_rect, d2-to_rect)
+	}
+
+	r := s.rounding
+	wx, wz := d2+r, math.Abs(local.Z)-(s.half_depth-r)
+	outside := math.Hypot(max(wx, 0), max(wz, 0))
+	return min(max(wx, wz), 0) + outside - r
+}
+
+func (s *ExtrudedShape) depth() float64 {
+	return min(s.deepest, s.half_depth)
+}
+
+func (s *ExtrudedShape) bounding_sphere() Sphere {
+	half := Vec3{float64(s.dist.W) * s.pixel / 2, float64(s.dist.H) * s.pixel / 2, s.half_depth}
+	return Sphere{C: s.center, R: half.Len()}
+}
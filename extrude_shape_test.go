@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSignedDistance2D(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	mask := NewDataMatrix[bool](37, 23)
+	for i := range mask.values {
+		mask.values[i] = rng.Float64() < 0.2
+	}
+	dist := signed_distance_2d(mask)
+	for y := range mask.H {
+		for x := range mask.W {
+			nearest := math.Inf(1)
+			for y2 := range mask.H {
+				for x2 := range mask.W {
+					if mask.get(x2, y2) != mask.get(x, y) {
+						nearest = min(nearest, math.Hypot(float64(x-x2), float64(y-y2)))
+					}
+				}
+			}
+			want := nearest - 0.5
+			if mask.get(x, y) {
+				want = -want
+			}
+			if got := float64(dist.get(x, y)); math.Abs(got-want) > 1e-5 {
+				t.Fatalf("distance at %d,%d: got %g, want %g", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestTextShape(t *testing.T) {
+	shape, err := build_shape(&ShapeDef{Type: "text", Text: "HI", Size: 2, Depth: 0.4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left stem of the H, between the letters, and in front of the text
+	if d := shape.sdf(Vec3{-0.75, 0, 0}); d >= 0 {
+		t.Errorf("inside the H: sdf %g", d)
+	}
+	if d := shape.sdf(Vec3{0.2, 0, 0}); d <= 0 {
+		t.Errorf("between the letters: sdf %g", d)
+	}
+	if d := shape.sdf(Vec3{-0.75, 0, 0.5}); d < 0.29 || d > 0.31 {
+		t.Errorf("in front of the H: sdf %g, expected 0.3", d)
+	}
+}
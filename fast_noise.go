@@ -0,0 +1,286 @@
+package main
+
+import (
+	"math/rand/v2"
+)
+
+// Native 3D noise: simplex, value, gradient (Perlin) and curl noise, with analytic derivatives.
+// Seedable, float64 only: a float32 variant measured no faster, see the README.
+//
+// https://weber.itn.liu.se/~stegu/simplexnoise/simplexnoise.pdf
+// https://iquilezles.org/articles/gradientnoise/
+// https://iquilezles.org/articles/morenoise/
+// https://www.cs.ubc.ca/~rbridson/docs/bridson-siggraph2007-curlnoise.pdf
+
+type FastNoise struct {
+	seed         int64
+	perm         [256]uint8      // permutation table, indexed with wrapping uint8 arithmetic
+	grads        [256][3]float64 // gradient per hash value
+	corner_grads [256][3]float64 // grads[perm[i]], the gradient of a corner from its row hash in one lookup
+	vals         [256]float64    // value noise lattice values per hash value, [-1, 1]
+}
+
+// 12 cube edge directions (improved noise), repeated to fill 16 slots so hash&15 selects one
+var fast_noise_gradients = [16][3]float64{
+	{1, 1, 0}, {-1, 1, 0}, {1, -1, 0}, {-1, -1, 0},
+	{1, 0, 1}, {-1, 0, 1}, {1, 0, -1}, {-1, 0, -1},
+	{0, 1, 1}, {0, -1, 1}, {0, 1, -1}, {0, -1, -1},
+	{1, 1, 0}, {0, -1, 1}, {-1, 1, 0}, {0, -1, -1},
+}
+
+func NewFastNoise(seed int64) *FastNoise {
+	n := FastNoise{seed: seed}
+	r := rand.New(rand.NewPCG(uint64(seed), 0x9e3779b97f4a7c15))
+	for i, p := range r.Perm(256) {
+		n.perm[i] = uint8(p)
+	}
+	for i := range 256 {
+		n.grads[i] = fast_noise_gradients[i&15]
+		n.vals[i] = r.Float64()*2 - 1
+	}
+	for i := range 256 {
+		n.corner_grads[i] = n.grads[n.perm[i]]
+	}
+	return &n
+}
+
+func fast_floor(x float64) int {
+	i := int(x)
+	if float64(i) > x {
+		i--
+	}
+	return i
+}
+
+func (n *FastNoise) hash(i, j, k int) uint8 {
+	p := &n.perm
+	return p[p[p[uint8(k)]+uint8(j)]+uint8(i)]
+}
+
+// row hashes of the cell at (i, j, k): the corner (i+dx, j+dy, k+dz) hashes to perm[row_dy_dz + dx]
+func (n *FastNoise) hash_rows(i, j, k int) (r00, r10, r01, r11 uint8) {
+	p := &n.perm
+	x, y, z := uint8(i), uint8(j), uint8(k)
+	a := p[z] + y
+	b := p[z+1] + y
+	return p[a] + x, p[a+1] + x, p[b] + x, p[b+1] + x
+}
+
+// quintic fade
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+// quintic fade and its derivative
+func fade_quintic(t float64) (float64, float64) {
+	u := t * t * t * (t*(t*6-15) + 10)
+	du := 30 * t * t * (t*(t-2) + 1)
+	return u, du
+}
+
+// trilinear blend of the 8 cell corners a..h, ordered x, then y, then z
+func trilerp(a, b, c, d, e, f, g, h, ux, uy, uz float64) float64 {
+	ab := a + ux*(b-a)
+	cd := c + ux*(d-c)
+	ef := e + ux*(f-e)
+	gh := g + ux*(h-g)
+	abcd := ab + uy*(cd-ab)
+	efgh := ef + uy*(gh-ef)
+	return abcd + uz*(efgh-abcd)
+}
+
+// Gradient (Perlin) noise, roughly in [-1, 1]
+func (n *FastNoise) gradient3(x, y, z float64) float64 {
+	ix, iy, iz := fast_floor(x), fast_floor(y), fast_floor(z)
+	fx, fy, fz := x-float64(ix), y-float64(iy), z-float64(iz)
+	ux := fade(fx)
+	uy := fade(fy)
+	uz := fade(fz)
+
+	r00, r10, r01, r11 := n.hash_rows(ix, iy, iz)
+	g := &n.corner_grads
+	ga, gb, gc, gd := &g[r00], &g[r00+1], &g[r10], &g[r10+1]
+	ge, gf, gg, gh := &g[r01], &g[r01+1], &g[r11], &g[r11+1]
+
+	va := ga[0]*fx + ga[1]*fy + ga[2]*fz
+	vb := gb[0]*(fx-1) + gb[1]*fy + gb[2]*fz
+	vc := gc[0]*fx + gc[1]*(fy-1) + gc[2]*fz
+	vd := gd[0]*(fx-1) + gd[1]*(fy-1) + gd[2]*fz
+	ve := ge[0]*fx + ge[1]*fy + ge[2]*(fz-1)
+	vf := gf[0]*(fx-1) + gf[1]*fy + gf[2]*(fz-1)
+	vg := gg[0]*fx + gg[1]*(fy-1) + gg[2]*(fz-1)
+	vh := gh[0]*(fx-1) + gh[1]*(fy-1) + gh[2]*(fz-1)
+
+	return trilerp(va, vb, vc, vd, ve, vf, vg, vh, ux, uy, uz)
+}
+
+// Gradient (Perlin) noise with its analytic partial derivatives
+func (n *FastNoise) gradient3_deriv(x, y, z float64) (v, dx, dy, dz float64) {
+	ix, iy, iz := fast_floor(x), fast_floor(y), fast_floor(z)
+	fx, fy, fz := x-float64(ix), y-float64(iy), z-float64(iz)
+	ux, dux := fade_quintic(fx)
+	uy, duy := fade_quintic(fy)
+	uz, duz := fade_quintic(fz)
+
+	r00, r10, r01, r11 := n.hash_rows(ix, iy, iz)
+	g := &n.corner_grads
+	ga, gb, gc, gd := &g[r00], &g[r00+1], &g[r10], &g[r10+1]
+	ge, gf, gg, gh := &g[r01], &g[r01+1], &g[r11], &g[r11+1]
+
+	va := ga[0]*fx + ga[1]*fy + ga[2]*fz
+	vb := gb[0]*(fx-1) + gb[1]*fy + gb[2]*fz
+	vc := gc[0]*fx + gc[1]*(fy-1) + gc[2]*fz
+	vd := gd[0]*(fx-1) + gd[1]*(fy-1) + gd[2]*fz
+	ve := ge[0]*fx + ge[1]*fy + ge[2]*(fz-1)
+	vf := gf[0]*(fx-1) + gf[1]*fy + gf[2]*(fz-1)
+	vg := gg[0]*fx + gg[1]*(fy-1) + gg[2]*(fz-1)
+	vh := gh[0]*(fx-1) + gh[1]*(fy-1) + gh[2]*(fz-1)
+
+	k0 := vb - va
+	k1 := vc - va
+	k2 := ve - va
+	k3 := va - vb - vc + vd
+	k4 := va - vc - ve + vg
+	k5 := va - vb - ve + vf
+	k6 := -va + vb + vc - vd + ve - vf - vg + vh
+
+	v = va + ux*k0 + uy*k1 + uz*k2 + ux*uy*k3 + uy*uz*k4 + uz*ux*k5 + ux*uy*uz*k6
+
+	// derivative of the blended gradients plus derivative of the interpolation weights
+	blend := func(a, b, c, d, e, f, g, h float64) float64 {
+		return a + ux*(b-a) + uy*(c-a) + uz*(e-a) +
+			ux*uy*(a-b-c+d) + uy*uz*(a-c-e+g) + uz*ux*(a-b-e+f) +
+			ux*uy*uz*(-a+b+c-d+e-f-g+h)
+	}
+	dx = blend(ga[0], gb[0], gc[0], gd[0], ge[0], gf[0], gg[0], gh[0]) + dux*(k0+uy*k3+uz*k5+uy*uz*k6)
+	dy = blend(ga[1], gb[1], gc[1], gd[1], ge[1], gf[1], gg[1], gh[1]) + duy*(k1+uz*k4+ux*k3+uz*ux*k6)
+	dz = blend(ga[2], gb[2], gc[2], gd[2], ge[2], gf[2], gg[2], gh[2]) + duz*(k2+ux*k5+uy*k4+ux*uy*k6)
+	return v, dx, dy, dz
+}
+
+// Value noise in [-1, 1]
+func (n *FastNoise) value3(x, y, z float64) float64 {
+	ix, iy, iz := fast_floor(x), fast_floor(y), fast_floor(z)
+	ux := fade(x - float64(ix))
+	uy := fade(y - float64(iy))
+	uz := fade(z - float64(iz))
+
+	r00, r10, r01, r11 := n.hash_rows(ix, iy, iz)
+	p, vals := &n.perm, &n.vals
+	return trilerp(
+		vals[p[r00]], vals[p[r00+1]], vals[p[r10]], vals[p[r10+1]],
+		vals[p[r01]], vals[p[r01+1]], vals[p[r11]], vals[p[r11+1]],
+		ux, uy, uz,
+	)
+}
+
+// Value noise with its analytic partial derivatives
+func (n *FastNoise) value3_deriv(x, y, z float64) (v, dx, dy, dz float64) {
+	ix, iy, iz := fast_floor(x), fast_floor(y), fast_floor(z)
+	ux, dux := fade_quintic(x - float64(ix))
+	uy, duy := fade_quintic(y - float64(iy))
+	uz, duz := fade_quintic(z - float64(iz))
+
+	r00, r10, r01, r11 := n.hash_rows(ix, iy, iz)
+	p, vals := &n.perm, &n.vals
+	va, vb, vc, vd := vals[p[r00]], vals[p[r00+1]], vals[p[r10]], vals[p[r10+1]]
+	ve, vf, vg, vh := vals[p[r01]], vals[p[r01+1]], vals[p[r11]], vals[p[r11+1]]
+
+	k0 := vb - va
+	k1 := vc - va
+	k2 := ve - va
+	k3 := va - vb - vc + vd
+	k4 := va - vc - ve + vg
+	k5 := va - vb - ve + vf
+	k6 := -va + vb + vc - vd + ve - vf - vg + vh
+
+	v = va + ux*k0 + uy*k1 + uz*k2 + ux*uy*k3 + uy*uz*k4 + uz*ux*k5 + ux*uy*uz*k6
+	dx = dux * (k0 + uy*k3 + uz*k5 + uy*uz*k6)
+	dy = duy * (k1 + uz*k4 + ux*k3 + uz*ux*k6)
+	dz = duz * (k2 + ux*k5 + uy*k4 + ux*uy*k6)
+	return v, dx, dy, dz
+}
+
+// Simplex noise, roughly in [-1, 1]
+func (n *FastNoise) simplex3(x, y, z float64) float64 {
+	v, _, _, _ := n.simplex3_deriv(x, y, z)
+	return v
+}
+
+// Simplex noise with its analytic partial derivatives
+func (n *FastNoise) simplex3_deriv(x, y, z float64) (v, dx, dy, dz float64) {
+	const f3 = 1.0 / 3.0
+	const g3 = 1.0 / 6.0
+
+	// skew to find the simplex cell
+	s := (x + y + z) * f3
+	i, j, k := fast_floor(x+s), fast_floor(y+s), fast_floor(z+s)
+	t := float64(i+j+k) * g3
+	x0, y0, z0 := x-(float64(i)-t), y-(float64(j)-t), z-(float64(k)-t)
+
+	// offsets of the second and third corners
+	var i1, j1, k1, i2, j2, k2 int
+	if x0 >= y0 {
+		if y0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 1, 0
+		} else if x0 >= z0 {
+			i1, j1, k1, i2, j2, k2 = 1, 0, 0, 1, 0, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 1, 0, 1
+		}
+	} else {
+		if y0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 0, 1, 0, 1, 1
+		} else if x0 < z0 {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 0, 1, 1
+		} else {
+			i1, j1, k1, i2, j2, k2 = 0, 1, 0, 1, 1, 0
+		}
+	}
+
+	h0 := n.hash(i, j, k)
+	h1 := n.hash(i+i1, j+j1, k+k1)
+	h2 := n.hash(i+i2, j+j2, k+k2)
+	h3 := n.hash(i+1, j+1, k+1)
+	v0, dx0, dy0, dz0 := n.simplex_corner(x0, y0, z0, h0)
+	v1, dx1, dy1, dz1 := n.simplex_corner(x0-float64(i1)+g3, y0-float64(j1)+g3, z0-float64(k1)+g3, h1)
+	v2, dx2, dy2, dz2 := n.simplex_corner(x0-float64(i2)+2*g3, y0-float64(j2)+2*g3, z0-float64(k2)+2*g3, h2)
+	v3, dx3, dy3, dz3 := n.simplex_corner(x0-1+3*g3, y0-1+3*g3, z0-1+3*g3, h3)
+
+	const scale = 76 // maps the output to roughly [-1, 1]
+	v = (v0 + v1 + v2 + v3) * scale
+	dx = (dx0 + dx1 + dx2 + dx3) * scale
+	dy = (dy0 + dy1 + dy2 + dy3) * scale
+	dz = (dz0 + dz1 + dz2 + dz3) * scale
+	return v, dx, dy, dz
+}
+
+// contribution of a single simplex corner, p is the offset from the corner
+func (n *FastNoise) simplex_corner(px, py, pz float64, h uint8) (v, dx, dy, dz float64) {
+	t := 0.5 - px*px - py*py - pz*pz
+	if t <= 0 {
+		return 0, 0, 0, 0
+	}
+	g := &n.grads[h]
+	gdot := g[0]*px + g[1]*py + g[2]*pz
+	t2 := t * t
+	t4 := t2 * t2
+	// d(t^4 * g.p)/dp = -8 t^3 (g.p) p + t^4 g
+	c := -8 * t2 * t * gdot
+	return t4 * gdot, c*px + t4*g[0], c*py + t4*g[1], c*pz + t4*g[2]
+}
+
+// Divergence-free curl noise, the curl of a vector potential made of three decorrelated simplex fields
+func (n *FastNoise) curl3(x, y, z float64) (float64, float64, float64) {
+	// potential psi = (a, b, c), offsets decorrelate its components
+	_, _, ay, az := n.simplex3_deriv(x, y, z)
+	_, bx, _, bz := n.simplex3_deriv(x+31.416, y-47.853, z+12.793)
+	_, cx, cy, _ := n.simplex3_deriv(x-23.17, y+19.341, z-71.05)
+	// curl psi = (dc/dy - db/dz, da/dz - dc/dx, db/dx - da/dy)
+	return cy - bz, az - cx, bx - ay
+}
+
+func (n *FastNoise) curl3_vec(p Vec3) Vec3 {
+	x, y, z := n.curl3(p.X, p.Y, p.Z)
+	return Vec3{x, y, z}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func noise_test_points(count int) [][3]float64 {
+	rng := rand.New(rand.NewSource(7))
+	points := make([][3]float64, count)
+	for i := range points {
+		points[i] = [3]float64{rng.Float64()*40 - 20, rng.Float64()*40 - 20, rng.Float64()*40 - 20}
+	}
+	return points
+}
+
+func TestFastNoiseDerivatives(t *testing.T) {
+	n := NewFastNoise(42)
+	const h = 1e-5
+	for name, f := range map[string]func(x, y, z float64) (v, dx, dy, dz float64){
+		"gradient": n.gradient3_deriv,
+		"value":    n.value3_deriv,
+		"simplex":  n.simplex3_deriv,
+	} {
+		for _, p := range noise_test_points(500) {
+			x, y, z := p[0], p[1], p[2]
+			_, dx, dy, dz := f(x, y, z)
+			value := func(x, y, z float64) float64 {
+				v, _, _, _ := f(x, y, z)
+				return v
+			}
+			fd := [3]float64{
+				(value(x+h, y, z) - value(x-h, y, z)) / (2 * h),
+				(value(x, y+h, z) - value(x, y-h, z)) / (2 * h),
+				(value(x, y, z+h) - value(x, y, z-h)) / (2 * h),
+			}
+			for axis, analytic := range [3]float64{dx, dy, dz} {
+				if math.Abs(analytic-fd[axis]) > 1e-4*max(1, math.Abs(fd[axis])) {
+					t.Fatalf("%s at %v: derivative %d is %v, finite differences give %v", name, p, axis, analytic, fd[axis])
+				}
+			}
+		}
+	}
+	// the plain versions return the same values
+	for _, p := range noise_test_points(100) {
+		v, _, _, _ := n.gradient3_deriv(p[0], p[1], p[2])
+		if g := n.gradient3(p[0], p[1], p[2]); math.Abs(g-v) > 1e-12 {
+			t.Fatalf("gradient3 %v and gradient3_deriv %v differ at %v", g, v, p)
+		}
+		v, _, _, _ = n.value3_deriv(p[0], p[1], p[2])
+		if g := n.value3(p[0], p[1], p[2]); math.Abs(g-v) > 1e-12 {
+			t.Fatalf("value3 %v and value3_deriv %v differ at %v", g, v, p)
+		}
+	}
+}
+
+func TestFastNoiseCurlDivergence(t *testing.T) {
+	n := NewFastNoise(42)
+	const h = 1e-4
+	for _, p := range noise_test_points(500) {
+		x, y, z := p[0], p[1], p[2]
+		xp, _, _ := n.curl3(x+h, y, z)
+		xm, _, _ := n.curl3(x-h, y, z)
+		_, yp, _ := n.curl3(x, y+h, z)
+		_, ym, _ := n.curl3(x, y-h, z)
+		_, _, zp := n.curl3(x, y, z+h)
+		_, _, zm := n.curl3(x, y, z-h)
+		divergence := (xp - xm + yp - ym + zp - zm) / (2 * h)
+		cx, cy, cz := n.curl3(x, y, z)
+		magnitude := math.Sqrt(cx*cx + cy*cy + cz*cz)
+		if math.Abs(divergence) > 1e-3*max(1, magnitude) {
+			t.Fatalf("divergence %v at %v, curl magnitude %v", divergence, p, magnitude)
+		}
+	}
+}
+
+func TestFastNoiseSeeds(t *testing.T) {
+	a, b, other := NewFastNoise(3), NewFastNoise(3), NewFastNoise(4)
+	same, correlation, norm_a, norm_b := 0, 0.0, 0.0, 0.0
+	points := noise_test_points(2000)
+	for _, p := range points {
+		for _, pair := range [][2]float64{
+			{a.gradient3(p[0], p[1], p[2]), b.gradient3(p[0], p[1], p[2])},
+			{a.value3(p[0], p[1], p[2]), b.value3(p[0], p[1], p[2])},
+			{a.simplex3(p[0], p[1], p[2]), b.simplex3(p[0], p[1], p[2])},
+		} {
+			if pair[0] != pair[1] {
+				t.Fatalf("the same seed gave %v and %v at %v", pair[0], pair[1], p)
+			}
+		}
+		va, vo := a.gradient3(p[0], p[1], p[2]), other.gradient3(p[0], p[1], p[2])
+		if va == vo {
+			same++
+		}
+		correlation += va * vo
+		norm_a += va * va
+		norm_b += vo * vo
+	}
+	// integer lattice points are 0 for any seed, random ones almost never agree
+	if same > len(points)/100 {
+		t.Errorf("seeds 3 and 4 agree at %d of %d points", same, len(points))
+	}
+	if r := correlation / math.Sqrt(norm_a*norm_b); math.Abs(r) > 0.1 {
+		t.Errorf("seeds 3 and 4 are correlated, r = %v", r)
+	}
+}
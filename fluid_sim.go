@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Smoke-style stable fluids on a collocated Matrix3D grid in a closed box: semi-Lagrangian advection, buoyancy from
+// temperature, vorticity confinement and a Jacobi pressure projection. Velocities are in cells per second.
+// Every pass reads buffers it doesn't write and computes y slabs independently, so a fixed time step gives the same
+// result for any number of workers.
+// Stam: Stable Fluids; Fedkiw, Stam, Jensen: Visual Simulation of Smoke
+
+type FluidParams struct {
+	dt                  float64 // fixed time step, seconds
+	buoyancy            float64 // upward acceleration per unit temperature, cells/s²
+	weight              float64 // downward acceleration per unit density
+	vorticity           float64 // confinement strength, puts back the small swirls numerical diffusion removes
+	cooling             float64 // fraction of temperature lost per second
+	dissipation         float64 // fraction of density lost per second
+	pressure_iterations int
+	source_radius       float64 // cells, a sphere at the bottom center of the grid
+	source_density      float64 // added per second at the source center
+	source_temperature  float64
+	source_velocity     float64 // upward, cells/s
+}
+
+var default_fluid_params = FluidParams{
+	dt:                  1.0 / 30,
+	buoyancy:            10,
+	weight:              0.5,
+	vorticity:           2,
+	cooling:             0.3,
+	dissipation:         0.05,
+	pressure_iterations: 30,
+	source_radius:       6,
+	source_density:      5,
+	source_temperature:  4,
+	source_velocity:     10,
+}
+
+type FluidSim struct {
+	params               FluidParams
+	density, temperature *Matrix3D[float32]
+	vel_x, vel_y, vel_z  *Matrix3D[float32]
+	pressure             *Matrix3D[float32]    // kept between steps as the starting guess
+	scratch              [4]*Matrix3D[float32] // advection targets, vorticity, divergence
+	noise                *FastNoise            // jitters the source so the plume breaks up
+	center               Vec3                  // world position of the grid's center
+	cell                 float64               // world size of a cell
+	density_scale        float64               // rendering
+	workers              int
+	steps                int
+	pending              float64 // real time not simulated yet, see advance
+}
+
+func NewFluidSim(w, h, d int, center Vec3, cell float64, params FluidParams, seed int64) *FluidSim {
+	s := &FluidSim{
+		params:        params,
+		density:       NewMatrix3D[float32](w, h, d),
+		temperature:   NewMatrix3D[float32](w, h, d),
+		vel_x:         NewMatrix3D[float32](w, h, d),
+		vel_y:         NewMatrix3D[float32](w, h, d),
+		vel_z:         NewMatrix3D[float32](w, h, d),
+		pressure:      NewMatrix3D[float32](w, h, d),
+		noise:         NewFastNoise(seed),
+		center:        center,
+		cell:          cell,
+		density_scale: 1,
+		workers:       runtime.NumCPU(),
+	}
+	for i := range s.scratch {
+		s.scratch[i] = NewMatrix3D[float32](w, h, d)
+	}
+	return s
+}
+
+// simulated seconds
+func (s *FluidSim) time() float64 {
+	return float64(s.steps) * s.params.dt
+}
+
+// Steps the fixed time step as often as fits in the real time passed, at most FLUID_MAX_STEPS_PER_FRAME.
+// A slow machine gets a slower simulation, not a different one.
+func (s *FluidSim) advance(seconds float64) {
+	s.pending += seconds
+	for n := 0; s.pending >= s.params.dt; n++ {
+		if n == FLUID_MAX_STEPS_PER_FRAME {
+			s.pending = 0
+			return
+		}
+		s.step()
+		s.pending -= s.params.dt
+	}
+}
+
+func (s *FluidSim) step() {
+	p := &s.params
+	s.add_sources()
+	s.add_buoyancy()
+	if p.vorticity > 0 {
+		s.confine_vorticity()
+	}
+
+	// the velocity advects itself, every component reads the old field
+	nx, ny, nz := s.scratch[0], s.scratch[1], s.scratch[2]
+	s.advect(s.vel_x, nx, 1)
+	s.advect(s.vel_y, ny, 1)
+	s.advect(s.vel_z, nz, 1)
+	s.vel_x, s.scratch[0] = nx, s.vel_x
+	s.vel_y, s.scratch[1] = ny, s.vel_y
+	s.vel_z, s.scratch[2] = nz, s.vel_z
+	s.project()
+
+	s.advect(s.density, s.scratch[0], math.Exp(-p.dissipation*p.dt))
+	s.density, s.scratch[0] = s.scratch[0], s.density
+	s.advect(s.temperature, s.scratch[0], math.Exp(-p.cooling*p.dt))
+	s.temperature, s.scratch[0] = s.scratch[0], s.temperature
+	s.steps++
+}
+
+// Runs fn for every y slab on the workers
+func (s *FluidSim) each_slab(fn func(y int)) {
+	h := s.density.H
+	workers := max(1, min(s.workers, h))
+	var wg sync.WaitGroup
+	next_y := make(chan int, h)
+	for y := range h {
+		next_y <- y
+	}
+	close(next_y)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			for y := range next_y {
+				fn(y)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// value at a cell, clamped to the walls
+func (s *FluidSim) at(m *Matrix3D[float32], x, y, z int) float64 {
+	x = max(0, min(x, m.W-1))
+	y = max(0, min(y, m.H-1))
+	z = max(0, min(z, m.D-1))
+	return float64(m.values[(y*m.W+x)*m.D+z])
+}
+
+// central difference along axis 0 (x), 1 (y) or 2 (z)
+func (s *FluidSim) diff(m *Matrix3D[float32], x, y, z, axis int) float64 {
+	switch axis {
+	case 0:
+		return 0.5 * (s.at(m, x+1, y, z) - s.at(m, x-1, y, z))
+	case 1:
+		return 0.5 * (s.at(m, x, y+1, z) - s.at(m, x, y-1, z))
+	}
+	return 0.5 * (s.at(m, x, y, z+1) - s.at(m, x, y, z-1))
+}
+
+func (s *FluidSim) add_sources() {
+	p := &s.params
+	m := s.density
+	r := p.source_radius
+	cx, cy, cz := float64(m.W-1)/2, r+1, float64(m.D-1)/2
+	t := s.time()
+	s.each_slab(func(y int) {
+		dy := float64(y) - cy
+		if math.Abs(dy) >= r {
+			return
+		}
+		for x := range m.W {
+			for z := range m.D {
+				dx, dz := float64(x)-cx, float64(z)-cz
+				dist := math.Sqrt(dx*dx + dy*dy + dz*dz)
+				if dist >= r {
+					continue
+				}
+				falloff := 1 - dist/r
+				// puffs instead of a steady stream
+				puff := clamp01(0.5 + s.noise.gradient3(float64(x)*0.35, float64(y)*0.35, float64(z)*0.35+t*1.5))
+				amount := falloff * puff * p.dt
+				i := (y*m.W+x)*m.D + z
+				s.density.values[i] += float32(p.source_density * amount)
+				s.temperature.values[i] += float32(p.source_temperature * amount)
+				s.vel_y.values[i] = max(s.vel_y.values[i], float32(p.source_velocity*falloff))
+			}
+		}
+	})
+}
+
+// hot air rises, smoke weighs it down
+func (s *FluidSim) add_buoyancy() {
+	p := &s.params
+	s.each_slab(func(y int) {
+		n := s.density.W * s.density.D
+		for i := y * n; i < (y+1)*n; i++ {
+			force := p.buoyancy*float64(s.temperature.values[i]) - p.weight*float64(s.density.values[i])
+			s.vel_y.values[i] += float32(p.dt * force)
+		}
+	})
+}
+
+// Pushes the velocity around the vortex centers: f = eps * (N x w), N pointing towards larger |w|
+func (s *FluidSim) confine_vorticity() {
+	p := &s.params
+	wx, wy, wz, mag := s.scratch[0], s.scratch[1], s.scratch[2], s.scratch[3]
+	W, D := s.vel_x.W, s.vel_x.D
+	s.each_slab(func(y int) {
+		for x := range W {
+			for z := range D {
+				i := (y*W+x)*D + z
+				cx := s.diff(s.vel_z, x, y, z, 1) - s.diff(s.vel_y, x, y, z, 2)
+				cy := s.diff(s.vel_x, x, y, z, 2) - s.diff(s.vel_z, x, y, z, 0)
+				cz := s.diff(s.vel_y, x, y, z, 0) - s.diff(s.vel_x, x, y, z, 1)
+				wx.values[i], wy.values[i], wz.values[i] = float32(cx), float32(cy), float32(cz)
+				mag.values[i] = float32(math.Sqrt(cx*cx + cy*cy + cz*cz))
+			}
+		}
+	})
+	s.each_slab(func(y int) {
+		for x := range W {
+			for z := range D {
+				i := (y*W+x)*D + z
+				n := Vec3{s.diff(mag, x, y, z, 0), s.diff(mag, x, y, z, 1), s.diff(mag, x, y, z, 2)}
+				l := n.Len()
+				if l < 1e-6 {
+					continue
+				}
+				n = n.Scale(1 / l)
+				w := Vec3{float64(wx.values[i]), float64(wy.values[i]), float64(wz.values[i])}
+				f := n.Cross(&w).Scale(p.vorticity * p.dt)
+				s.vel_x.values[i] += float32(f.X)
+				s.vel_y.values[i] += float32(f.Y)
+				s.vel_z.values[i] += float32(f.Z)
+			}
+		}
+	})
+}
+
+// Semi-Lagrangian: every cell takes the value found back along the velocity, trilinear between cells
+func (s *FluidSim) advect(src, dst *Matrix3D[float32], decay float64) {
+	dt := s.params.dt
+	W, D := src.W, src.D
+	s.each_slab(func(y int) {
+		for x := range W {
+			for z := range D {
+				i := (y*W+x)*D + z
+				px := float64(x) - dt*float64(s.vel_x.values[i])
+				py := float64(y) - dt*float64(s.vel_y.values[i])
+				pz := float64(z) - dt*float64(s.vel_z.values[i])
+				dst.values[i] = float32(matrix3D_sample_trilinear(src, px, py, pz) * decay)
+			}
+		}
+	})
+}
+
+// Makes the velocity divergence free: solves the pressure Poisson equation with Jacobi iterations and subtracts its
+// gradient, then stops the flow through the walls. The Laplacian is the divergence of the central difference gradient,
+// which skips a cell, the compact 7 point one leaves the checkerboard part of the divergence in.
+func (s *FluidSim) project() {
+	div, next := s.scratch[0], s.scratch[1]
+	W, H, D := div.W, div.H, div.D
+	s.each_slab(func(y int) {
+		for x := range W {
+			for z := range D {
+				div.values[(y*W+x)*D+z] = float32(s.diff(s.vel_x, x, y, z, 0) + s.diff(s.vel_y, x, y, z, 1) + s.diff(s.vel_z, x, y, z, 2))
+			}
+		}
+	})
+
+	pressure := s.pressure
+	for range s.params.pressure_iterations {
+		s.each_slab(func(y int) {
+			for x := range W {
+				for z := range D {
+					sum := s.at(pressure, x-2, y, z) + s.at(pressure, x+2, y, z) +
+						s.at(pressure, x, y-2, z) + s.at(pressure, x, y+2, z) +
+						s.at(pressure, x, y, z-2) + s.at(pressure, x, y, z+2)
+					next.values[(y*W+x)*D+z] = float32((sum - 4*float64(div.values[(y*W+x)*D+z])) / 6)
+				}
+			}
+		})
+		pressure, next = next, pressure
+	}
+	s.pressure, s.scratch[1] = pressure, next
+
+	s.each_slab(func(y int) {
+		for x := range W {
+			for z := range D {
+				i := (y*W+x)*D + z
+				if x == 0 || x == W-1 || y == 0 || y == H-1 || z == 0 || z == D-1 {
+					s.vel_x.values[i], s.vel_y.values[i], s.vel_z.values[i] = 0, 0, 0
+					continue
+				}
+				s.vel_x.values[i] -= float32(s.diff(pressure, x, y, z, 0))
+				s.vel_y.values[i] -= float32(s.diff(pressure, x, y, z, 1))
+				s.vel_z.values[i] -= float32(s.diff(pressure, x, y, z, 2))
+			}
+		}
+	})
+}
+
+// Trilinear value of a field at a world position, 0 outside the grid
+func (s *FluidSim) sample(field *Matrix3D[float32], p Vec3) float64 {
+	g := p.Sub(s.center).Scale(1 / s.cell)
+	x := g.X + float64(field.W)/2 - 0.5
+	y := g.Y + float64(field.H)/2 - 0.5
+	z := g.Z + float64(field.D)/2 - 0.5
+	if x < -0.5 || x > float64(field.W)-0.5 || y < -0.5 || y > float64(field.H)-0.5 || z < -0.5 || z > float64(field.D)-0.5 {
+		return 0
+	}
+	return matrix3D_sample_trilinear(field, x, y, z) * s.density_scale
+}
+
+// world box of the grid
+func (s *FluidSim) bounds() (Vec3, Vec3) {
+	half := Vec3{float64(s.density.W), float64(s.density.H), float64(s.density.D)}.Scale(s.cell / 2)
+	return s.center.Sub(half), s.center.Add(half)
+}
+
+// Scene file representation of a simulation, see build_fluid_sim for defaults
+type FluidSimDef struct {
+	Resolution [3]int     `json:"resolution"` // cells along x, y, z
+	Center     [3]float64 `json:"center"`
+	Height     float64    `json:"height"` // world size of the grid along y, cells are cubes
+	Seed       int64      `json:"seed,omitempty"`
+	Prewarm    int        `json:"prewarm,omitempty"` // steps run at load
+
+	Dt                 float64 `json:"dt,omitempty"`
+	Buoyancy           float64 `json:"buoyancy,omitempty"`
+	Weight             float64 `json:"weight,omitempty"`
+	Vorticity          float64 `json:"vorticity,omitempty"`
+	Cooling            float64 `json:"cooling,omitempty"`
+	Dissipation        float64 `json:"dissipation,omitempty"`
+	PressureIterations int     `json:"pressure_iterations,omitempty"`
+	SourceRadius       float64 `json:"source_radius,omitempty"` // cells
+	SourceDensity      float64 `json:"source_density,omitempty"`
+	SourceTemperature  float64 `json:"source_temperature,omitempty"`
+	SourceVelocity     float64 `json:"source_velocity,omitempty"`
+	DensityScale       float64 `json:"density_scale,omitempty"`
+}
+
+func build_fluid_sim(def *FluidSimDef) (*FluidSim, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	d := default_fluid_params
+	params := FluidParams{
+		dt:                  or_default(def.Dt, d.dt),
+		buoyancy:            or_default(def.Buoyancy, d.buoyancy),
+		weight:              or_default(def.Weight, d.weight),
+		vorticity:           or_default(def.Vorticity, d.vorticity),
+		cooling:             or_default(def.Cooling, d.cooling),
+		dissipation:         or_default(def.Dissipation, d.dissipation),
+		pressure_iterations: or_default_int(def.PressureIterations, d.pressure_iterations),
+		source_radius:       or_default(def.SourceRadius, d.source_radius),
+		source_density:      or_default(def.SourceDensity, d.source_density),
+		source_temperature:  or_default(def.SourceTemperature, d.source_temperature),
+		source_velocity:     or_default(def.SourceVelocity, d.source_velocity),
+	}
+	res := [3]int{or_default_int(def.Resolution[0], 32), or_default_int(def.Resolution[1], 48), or_default_int(def.Resolution[2], 32)}
+	if params.source_radius*2+2 > float64(min(res[0], res[1], res[2])) {
+		return nil, fmt.Errorf("source radius %v doesn't fit a %dx%dx%d grid", params.source_radius, res[0], res[1], res[2])
+	}
+	center := Vec3{def.Center[0], def.Center[1], def.Center[2]}
+	cell := or_default(def.Height, 1.6) / float64(res[1])
+	s := NewFluidSim(res[0], res[1], res[2], center, cell, params, def.Seed)
+	s.density_scale = or_default(def.DensityScale, 1)
+	for range def.Prewarm {
+		s.step()
+	}
+	return s, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFluidSimDeterministic(t *testing.T) {
+	run := func(workers int) *FluidSim {
+		s := NewFluidSim(16, 24, 16, Vec3{}, 0.1, default_fluid_params, 3)
+		s.params.source_radius = 4
+		s.workers = workers
+		for range 20 {
+			s.step()
+		}
+		return s
+	}
+	a, b := run(1), run(4)
+	for i := range a.density.values {
+		if a.density.values[i] != b.density.values[i] || a.temperature.values[i] != b.temperature.values[i] {
+			t.Fatalf("cell %d differs between 1 and 4 workers", i)
+		}
+	}
+}
+
+func TestFluidSimPlumeRises(t *testing.T) {
+	s := NewFluidSim(16, 32, 16, Vec3{}, 0.1, default_fluid_params, 3)
+	s.params.source_radius = 4
+	centroid := func() float64 {
+		m := s.density
+		var sum, weighted float64
+		for y := range m.H {
+			for x := range m.W {
+				for z := range m.D {
+					v := float64(m.values[(y*m.W+x)*m.D+z])
+					sum += v
+					weighted += v * float64(y)
+				}
+			}
+		}
+		return weighted / sum
+	}
+	s.step()
+	start := centroid()
+	for range 40 {
+		s.step()
+	}
+	if end := centroid(); end < start+3 {
+		t.Errorf("density centroid went from row %.1f to %.1f", start, end)
+	}
+
+	// the projection removes most of the divergence the forces add inside the box
+	total_div := func() float64 {
+		m := 0.0
+		for y := 1; y < s.density.H-1; y++ {
+			for x := 1; x < s.density.W-1; x++ {
+				for z := 1; z < s.density.D-1; z++ {
+					div := s.diff(s.vel_x, x, y, z, 0) + s.diff(s.vel_y, x, y, z, 1) + s.diff(s.vel_z, x, y, z, 2)
+					m += math.Abs(div)
+				}
+			}
+		}
+		return m
+	}
+	s.add_sources()
+	s.add_buoyancy()
+	before := total_div()
+	s.project()
+	if after := total_div(); after > before/2 {
+		t.Errorf("divergence %v before the projection, %v after", before, after)
+	}
+}
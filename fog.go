@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Exponential height fog for aerial perspective: haze that thins with altitude, integrated in closed form along each
+// view ray after the clouds and solids are marched. Everything is seen through the fog in front of it and lit fog
+// is scattered in, the sky colour plus the sun's through a forward phase, so far hills and clouds fade to the
+// horizon and glow towards the sun.
+
+type HeightFog struct {
+	density       float64 // extinction per unit length at the base
+	falloff       float64 // density shrinks by e every 1/falloff above the base, 0 for uniform fog
+	base          float64 // altitude of density
+	color         Vec3    // sky light scattered by the fog
+	anisotropy    float64 // Henyey-Greenstein asymmetry of the sun glow
+	sun_intensity float64
+	max_distance  float64 // how far the sky is
+}
+
+// Integral of the density from t0 to t1 along the (normalized) ray
+func (f *HeightFog) optical_depth(ray *Ray, t0, t1 float64) float64 {
+	if t1 <= t0 {
+		return 0
+	}
+	k := f.falloff * ray.dir.Y
+	at_origin := f.density * math.Exp(-f.falloff*(ray.origin.Y-f.base))
+	if math.Abs(k) < 1e-6 {
+		return at_origin * math.Exp(-k*t0) * (t1 - t0)
+	}
+	return at_origin * (math.Exp(-k*t0) - math.Exp(-k*t1)) / k
+}
+
+// Light scattered towards the camera, the same along the whole ray as the fog isn't shadowed
+func (f *HeightFog) inscattered(ray *Ray, render_params *RenderParameters) Vec3 {
+	dir_to_light, _ := direction_to_light(ray.origin, render_params)
+	phase := HenyeyGreenstein(f.anisotropy, ray.dir.Dot(dir_to_light)) * 4 * math.Pi
+	return f.color.Add(render_params.light.color.Scale(f.sun_intensity * phase))
+}
+
+// The fog between t0 and t1 as a layer to composite, its alpha is what it hides. The sky is max_distance away.
+func (f *HeightFog) segment(ray *Ray, t0, t1 float64, color Vec3) Vec4 {
+	t1 = min(t1, f.max_distance)
+	return Vec4{color.X, color.Y, color.Z, 1 - math.Exp(-f.optical_depth(ray, t0, t1))}
+}
+
+// Composites the clouds over the solids through the fog and the god rays medium: what is in front of the clouds
+// covers both, what is behind them only the solids, or the sky where there are none
+func apply_atmosphere(ray *Ray, clouds, solids Vec4, render_params *RenderParameters) Vec4 {
+	f, g := render_params.fog, render_params.god_rays
+	if f == nil && !g.volumetric() {
+		return composite_over(clouds, solids)
+	}
+	far := render_params.solid_depth
+	if far == 0 {
+		far = math.Inf(1)
+	}
+	near := min(cloud_entry(ray, render_params), far)
+	front, behind := Vec4{}, Vec4{}
+	if f != nil {
+		color := f.inscattered(ray, render_params)
+		front = f.segment(ray, 0, near, color)
+		behind = f.segment(ray, near, far, color)
+	}
+	if g.volumetric() {
+		front = composite_over(g.segment(ray, 0, near, render_params), front)
+		behind = composite_over(g.segment(ray, near, far, render_params), behind)
+	}
+	return composite_over(front, composite_over(clouds, composite_over(behind, solids)))
+}
+
+// Where the ray enters the cloud layer or the shape's bounds, the distance the clouds are fogged at. Infinite when
+// it misses them.
+func cloud_entry(ray *Ray, render_params *RenderParameters) float64 {
+	if render_params.layer != nil {
+		intervals, n := render_params.layer.intersect(ray)
+		if n == 0 {
+			return math.Inf(1)
+		}
+		return max(0, intervals[0].t0)
+	}
+	if render_params.shape == nil {
+		return math.Inf(1)
+	}
+	bounds := render_params.shape.bounding_sphere()
+	t0, _, hit := ray_sphere(ray, bounds.C, bounds.R)
+	if !hit {
+		return math.Inf(1)
+	}
+	return max(0, t0)
+}
+
+// Scene file representation of the fog, see build_fog for defaults
+type FogDef struct {
+	Density      float64    `json:"density,omitempty"`
+	Falloff      float64    `json:"falloff,omitempty"` // negative for uniform fog
+	Base         float64    `json:"base,omitempty"`
+	Color        [3]float64 `json:"color,omitempty"`
+	Anisotropy   float64    `json:"anisotropy,omitempty"`
+	SunIntensity float64    `json:"sun_intensity,omitempty"`
+	MaxDistance  float64    `json:"max_distance,omitempty"`
+}
+
+func build_fog(def *FogDef) (*HeightFog, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	f := HeightFog{
+		density:       or_default(def.Density, 0.02),
+		falloff:       max(0, or_default(def.Falloff, 0.3)),
+		base:          def.Base,
+		color:         Vec3{def.Color[0], def.Color[1], def.Color[2]},
+		anisotropy:    or_default(def.Anisotropy, 0.4),
+		sun_intensity: or_default(def.SunIntensity, 0.3),
+		max_distance:  or_default(def.MaxDistance, 200),
+	}
+	if f.color == (Vec3{}) {
+		f.color = Vec3{0.55, 0.65, 0.8}
+	}
+	if f.density < 0 || f.max_distance < 0 {
+		return nil, fmt.Errorf("negative density %v or max_distance %v", f.density, f.max_distance)
+	}
+	if math.Abs(f.anisotropy) >= 1 {
+		return nil, fmt.Errorf("anisotropy %v must be between -1 and 1", f.anisotropy)
+	}
+	return &f, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFogOpticalDepth(t *testing.T) {
+	fog, err := build_fog(&FogDef{Density: 0.1, Falloff: 0.5, Base: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numeric := func(ray *Ray, t0, t1 float64) float64 {
+		const n = 10000
+		sum, dt := 0.0, (t1-t0)/n
+		for i := range n {
+			p := ray.origin.Add(ray.dir.Scale(t0 + dt*(float64(i)+0.5)))
+			sum += fog.density * math.Exp(-fog.falloff*(p.Y-fog.base)) * dt
+		}
+		return sum
+	}
+	for _, dir := range []Vec3{{0, 0, -1}, {0, 1, -1}, {0.3, -0.2, -1}, {0, 1, 0}} {
+		ray := Ray{origin: Vec3{0, 0.5, 0}, dir: dir.Normalized()}
+		got, want := fog.optical_depth(&ray, 2, 30), numeric(&ray, 2, 30)
+		if math.Abs(got-want) > 1e-6*max(1, want) {
+			t.Errorf("optical depth along %v is %v, want %v", dir, got, want)
+		}
+	}
+
+	// thinner above, uniform without falloff
+	up, down := Ray{origin: Vec3{}, dir: Vec3{0, 1, 0}}, Ray{origin: Vec3{}, dir: Vec3{0, -1, 0}}
+	if fog.optical_depth(&up, 0, 1) >= fog.optical_depth(&down, 0, 1) {
+		t.Error("fog is as thick above as below")
+	}
+	uniform, _ := build_fog(&FogDef{Density: 0.1, Falloff: -1})
+	if d := uniform.optical_depth(&up, 0, 10); math.Abs(d-1) > 1e-9 {
+		t.Errorf("uniform fog optical depth %v over 10, want 1", d)
+	}
+}
+
+func TestFogAerialPerspective(t *testing.T) {
+	rp := bench_render_parameters()
+	solid := Vec4{1, 0, 0, 1}
+	ray := Ray{origin: Vec3{}, dir: Vec3{0, 0, -1}}
+	if c := apply_atmosphere(&ray, Vec4{}, solid, rp); c != solid {
+		t.Errorf("without fog the solid is %v", c)
+	}
+
+	fog, _ := build_fog(&FogDef{Density: 0.05, Falloff: -1})
+	fog.sun_intensity = 0
+	rp.fog = fog
+	rp.shape = nil
+	// the further the solid, the closer to the fog color
+	previous := 0.0
+	for _, depth := range []float64{1, 10, 50, 200} {
+		rp.solid_depth = depth
+		c := apply_atmosphere(&ray, Vec4{}, solid, rp)
+		if math.Abs(c.W-1) > 1e-9 {
+			t.Errorf("fogged solid alpha %v", c.W)
+		}
+		haze := c.Z / fog.color.Z
+		want := 1 - math.Exp(-0.05*depth)
+		if math.Abs(haze-want) > 1e-6 || haze <= previous {
+			t.Errorf("haze %v at %v, want %v", haze, depth, want)
+		}
+		previous = haze
+	}
+
+	// the sky fades to the fog color towards the horizon, more in the sun's direction
+	rp.solid_depth = 0
+	sky := apply_atmosphere(&ray, Vec4{}, Vec4{}, rp)
+	if want := 1 - math.Exp(-0.05*fog.max_distance); math.Abs(sky.W-want) > 1e-6 {
+		t.Errorf("sky haze %v, want %v", sky.W, want)
+	}
+	fog.sun_intensity = 0.3
+	towards := Ray{origin: Vec3{}, dir: rp.light.origin.Normalized()}
+	away := Ray{origin: Vec3{}, dir: rp.light.origin.Normalized().Scale(-1)}
+	if a, b := fog.inscattered(&towards, rp), fog.inscattered(&away, rp); a.X <= b.X {
+		t.Errorf("fog towards the sun %v isn't brighter than away %v", a, b)
+	}
+}
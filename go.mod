@@ -4,10 +4,14 @@ go 1.25.6
 
 require github.com/gen2brain/raylib-go/raylib v0.55.1
 
-require github.com/aquilax/go-perlin v1.1.0
+require (
+	github.com/aquilax/go-perlin v1.1.0
+	golang.org/x/image v0.25.0
+)
 
 require (
 	github.com/ebitengine/purego v0.9.1 // indirect
 	golang.org/x/exp v0.0.0-20260112195511-716be5621a96 // indirect
 	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Crepuscular rays: shafts of light where the sun passes between clouds. The volumetric levels march a thin global
+// medium along the view ray and scatter in the light that reaches each sample through the clouds, marched like the
+// light inside the clouds. The screen space level is the cheap one, a radial blur of the visible sky towards the
+// light's position in the image.
+
+type GodRayQuality = int
+
+const (
+	GodRayQuality_Off    = iota
+	GodRayQuality_Screen // radial blur of the finished image
+	GodRayQuality_Low    // GOD_RAYS_STEPS_LOW samples per view ray
+	GodRayQuality_High   // GOD_RAYS_STEPS_HIGH samples per view ray
+)
+
+var god_ray_quality_names = []string{"off", "screen", "low", "high"}
+
+type GodRays struct {
+	quality      GodRayQuality
+	density      float64 // scattering and extinction per unit length of the medium
+	intensity    float64
+	anisotropy   float64 // Henyey-Greenstein asymmetry, the shafts are brightest looking towards the light
+	max_distance float64 // the medium is only marched up to here
+}
+
+func (g *GodRays) volumetric() bool {
+	return g != nil && (g.quality == GodRayQuality_Low || g.quality == GodRayQuality_High)
+}
+
+// The lit medium between t0 and t1 as a layer to composite
+func (g *GodRays) segment(ray *Ray, t0, t1 float64, render_params *RenderParameters) Vec4 {
+	t1 = min(t1, g.max_distance)
+	if !g.volumetric() || t1 <= t0 {
+		return Vec4{}
+	}
+	steps := GOD_RAYS_STEPS_LOW
+	if g.quality == GodRayQuality_High {
+		steps = GOD_RAYS_STEPS_HIGH
+	}
+	ds := (t1 - t0) / float64(steps)
+	// a different offset per ray turns the banding of the few steps into noise
+	_, offset := math.Modf(math.Abs(math.Sin(ray.dir.X*12.9898+ray.dir.Y*78.233+ray.dir.Z*37.719) * 43758.5453))
+	acc_light := 0.0
+	for i := range steps {
+		t := t0 + ds*(float64(i)+offset)
+		p := ray.origin.Add(ray.dir.Scale(t))
+		acc_light += beers_law(t-t0, g.density) * light_transmittance(p, render_params) * g.density * ds
+	}
+	dir_to_light, _ := direction_to_light(ray.origin, render_params)
+	phase := HenyeyGreenstein(g.anisotropy, ray.dir.Dot(dir_to_light)) * 4 * math.Pi
+	scattered := render_params.light.color.Scale(g.intensity * phase * acc_light)
+	return add_emission(Vec4{0, 0, 0, 1 - beers_law(t1-t0, g.density)}, scattered)
+}
+
+// Fraction of the light reaching p through the clouds: the cloud layer's towards the sun, or the shape's marched
+// like the light inside it once the way to the light enters it
+func light_transmittance(p Vec3, render_params *RenderParameters) float64 {
+	if render_params.layer != nil {
+		ray := Ray{origin: p, dir: render_params.layer.sun_dir}
+		return render_params.layer.transmittance(&ray, render_params.noises, render_params.time)
+	}
+	shape := render_params.shape
+	if shape == nil {
+		return 1
+	}
+	dir, distance := direction_to_light(p, render_params)
+	bounds := shape.bounding_sphere()
+	t := 0.0
+	for range MAX_JUMPS {
+		q := p.Add(dir.Scale(t))
+		sdf := shape.sdf(q)
+		if sdf <= 0 {
+			return shape_light_amount(q, render_params)
+		}
+		if to_center := bounds.C.Sub(q); bounds.sdf(q) > 0 && to_center.Dot(dir) < 0 {
+			break // moving away from the shape
+		}
+		t += max(sdf, MIN_JUMP)
+		if t >= distance {
+			break
+		}
+	}
+	return 1
+}
+
+// Blurs the sky the clouds and solids leave visible along lines towards the light and adds it to the image, nothing
+// when the light is behind the camera
+func screen_space_god_rays(render_params *RenderParameters) {
+	g := render_params.god_rays
+	img := render_params.img
+	to_light, _ := direction_to_light(render_params.camera.origin, render_params)
+	lx, ly, ok := render_params.camera.project(render_params.camera.origin.Add(to_light), img.W, img.H)
+	if !ok {
+		return
+	}
+	// the visible sky, brightest around the light
+	sky := make([]float64, len(img.Pixels))
+	for i, p := range img.Pixels {
+		ray := render_params.camera.MakeRay(i%img.W, i/img.W, img.W, img.H)
+		phase := HenyeyGreenstein(g.anisotropy, ray.dir.Dot(to_light)) * 4 * math.Pi
+		sky[i] = (1 - float64(p.A)/255) * phase
+	}
+
+	var wg sync.WaitGroup
+	dH := max(1, img.H/GOD_RAYS_SCREEN_WORKERS)
+	for y_mark := 0; y_mark < img.H; y_mark += dH {
+		wg.Add(1)
+		go func(y_mark int) {
+			defer wg.Done()
+			for y := y_mark; y < min(y_mark+dH, img.H); y++ {
+				for x := range img.W {
+					step_x := (lx - float64(x)) / GOD_RAYS_SCREEN_SAMPLES
+					step_y := (ly - float64(y)) / GOD_RAYS_SCREEN_SAMPLES
+					sx, sy := float64(x), float64(y)
+					acc, weight := 0.0, 1.0
+					for range GOD_RAYS_SCREEN_SAMPLES {
+						sx, sy = sx+step_x, sy+step_y
+						ix, iy := int(sx), int(sy)
+						if ix >= 0 && iy >= 0 && ix < img.W && iy < img.H {
+							acc += sky[iy*img.W+ix] * weight
+						}
+						weight *= GOD_RAYS_SCREEN_DECAY
+					}
+					scattered := render_params.light.color.Scale(g.intensity * acc / GOD_RAYS_SCREEN_SAMPLES)
+					i := y*img.W + x
+					p := img.Pixels[i]
+					c := Vec4{float64(p.R) / 255, float64(p.G) / 255, float64(p.B) / 255, float64(p.A) / 255}
+					img.Pixels[i] = pixel_from_fvec4(add_emission(c, scattered.Scale(GOD_RAYS_SCREEN_EXPOSURE)))
+				}
+			}
+		}(y_mark)
+	}
+	wg.Wait()
+}
+
+// Scene file representation of the god rays, see build_god_rays for defaults
+type GodRaysDef struct {
+	Quality     string  `json:"quality,omitempty"` // off, screen, low or high
+	Density     float64 `json:"density,omitempty"`
+	Intensity   float64 `json:"intensity,omitempty"`
+	Anisotropy  float64 `json:"anisotropy,omitempty"`
+	MaxDistance float64 `json:"max_distance,omitempty"`
+}
+
+func build_god_rays(def *GodRaysDef) (*GodRays, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	g := GodRays{
+		quality:      GodRayQuality_Low,
+		density:      or_default(def.Density, 0.01),
+		intensity:    or_default(def.Intensity, 0.5),
+		anisotropy:   or_default(def.Anisotropy, 0.5),
+		max_distance: or_default(def.MaxDistance, 40),
+	}
+	if def.Quality != "" {
+		g.quality = -1
+		for i, name := range god_ray_quality_names {
+			if name == def.Quality {
+				g.quality = i
+			}
+		}
+		if g.quality < 0 {
+			return nil, fmt.Errorf("unknown quality %q, available: off, screen, low, high", def.Quality)
+		}
+	}
+	if g.density < 0 || math.Abs(g.anisotropy) >= 1 {
+		return nil, fmt.Errorf("density %v must be positive and anisotropy %v between -1 and 1", g.density, g.anisotropy)
+	}
+	return &g, nil
+}
+
+// Next quality level for the G key, god rays with the defaults when there are none yet
+func cycle_god_rays(g *GodRays) *GodRays {
+	if g == nil {
+		g, _ = build_god_rays(&GodRaysDef{Quality: "off"})
+	}
+	g.quality = (g.quality + 1) % len(god_ray_quality_names)
+	return g
+}
+
+func god_rays_label(g *GodRays) string {
+	if g == nil {
+		return "off"
+	}
+	return god_ray_quality_names[g.quality]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCameraProject(t *testing.T) {
+	camera := bench_render_parameters().camera
+	for _, pixel := range [][2]int{{0, 0}, {320, 240}, {17, 401}, {639, 479}} {
+		ray := camera.MakeRay(pixel[0], pixel[1], 640, 480)
+		x, y, ok := camera.project(ray.origin.Add(ray.dir.Scale(7)), 640, 480)
+		if !ok || math.Abs(x-float64(pixel[0])) > 1e-6 || math.Abs(y-float64(pixel[1])) > 1e-6 {
+			t.Errorf("pixel %v projected back to %v, %v (%v)", pixel, x, y, ok)
+		}
+	}
+	if _, _, ok := camera.project(Vec3{0, 0, 2}, 640, 480); ok {
+		t.Error("projected a point behind the camera")
+	}
+}
+
+func TestGodRaysShadow(t *testing.T) {
+	prev := density_type
+	density_type = DensityType_Uniform
+	defer func() { density_type = prev }()
+	rp := bench_render_parameters()
+
+	// behind the sphere from the light, and beside it
+	to_light := rp.light.origin.Sub(rp.shape.bounding_sphere().C).Normalized()
+	shadowed := rp.shape.bounding_sphere().C.Sub(to_light.Scale(1.8))
+	if lit := light_transmittance(shadowed, rp); lit > 0.5 {
+		t.Errorf("%v of the light reaches behind the sphere", lit)
+	}
+	if lit := light_transmittance(Vec3{0, 3, -1}, rp); lit != 1 {
+		t.Errorf("%v of the light reaches above the sphere", lit)
+	}
+
+	// a view ray passing through the shadow scatters less light than one beside it
+	god_rays, err := build_god_rays(&GodRaysDef{Quality: "high", Density: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.god_rays = god_rays
+	through := Ray{origin: Vec3{shadowed.X, shadowed.Y, 1}, dir: Vec3{0, 0, -1}}
+	beside := Ray{origin: Vec3{shadowed.X, 3, 1}, dir: Vec3{0, 0, -1}}
+	dark, bright := god_rays.segment(&through, 2.5, 5, rp), god_rays.segment(&beside, 2.5, 5, rp)
+	if dark.X*dark.W >= bright.X*bright.W {
+		t.Errorf("shadowed shaft %v isn't darker than the lit one %v", dark, bright)
+	}
+
+	// the screen space level leaves the per ray compositing alone
+	god_rays.quality = GodRayQuality_Screen
+	clouds, solids := Vec4{0.5, 0.5, 0.5, 0.5}, Vec4{0, 1, 0, 1}
+	if c := apply_atmosphere(&through, clouds, solids, rp); c != composite_over(clouds, solids) {
+		t.Errorf("screen space god rays changed a ray to %v", c)
+	}
+}
+
+func TestGodRaysQuality(t *testing.T) {
+	if _, err := build_god_rays(&GodRaysDef{Quality: "ultra"}); err == nil {
+		t.Error("built an unknown quality")
+	}
+	var g *GodRays
+	for _, want := range []string{"screen", "low", "high", "off", "screen"} {
+		g = cycle_god_rays(g)
+		if got := god_rays_label(g); got != want {
+			t.Errorf("cycled to %s, want %s", got, want)
+		}
+	}
+}
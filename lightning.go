@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Lightning inside storm clouds: a branching bolt generated by midpoint displacement that lights the volume around
+// it for a moment. The bolt is lit as a chain of point lights along its channel, shadowed with the same light
+// marching as the main light, and flickers with a few return strokes. Strikes come on a timer or on demand (L key).
+
+type BoltSegment struct {
+	a, b       Vec3
+	brightness float64 // 1 on the main channel, dimmer on branches
+}
+
+type LightningBolt struct {
+	segments []BoltSegment
+	lights   []Vec3    // LIGHTNING_LIGHTS points along the channel, denser where it is brighter
+	strokes  []float64 // start times of the return strokes
+}
+
+type Lightning struct {
+	region_min, region_max Vec3    // bolts run from near the top of the box to its bottom
+	interval               float64 // mean seconds between strikes, 0 only strikes on demand
+	intensity              float64
+	color                  Vec3
+	falloff                float64 // distance from the channel where the light is halved, before occlusion
+	generations            int     // midpoint displacement subdivisions
+	displacement           float64 // sideways offset of the first midpoint, relative to the bolt length
+	branching              float64 // chance of a branch at each midpoint
+	rng                    *rand.Rand
+	bolt                   *LightningBolt
+	next_strike            float64
+}
+
+// Subdivides the segment from start to end: every midpoint moves sideways, by half as much each generation, and
+// sometimes sprouts a dimmer branch that keeps roughly the direction it came from
+func generate_bolt(rng *rand.Rand, start, end Vec3, generations int, displacement, branching float64) []BoltSegment {
+	segments := []BoltSegment{{start, end, 1}}
+	offset := displacement * end.Sub(start).Len()
+	for range generations {
+		next := make([]BoltSegment, 0, len(segments)*2)
+		for _, s := range segments {
+			dir := s.b.Sub(s.a)
+			mid := s.a.Add(dir.Scale(0.5)).Add(random_perpendicular(rng, dir).Scale(offset * (rng.Float64()*2 - 1)))
+			next = append(next, BoltSegment{s.a, mid, s.brightness}, BoltSegment{mid, s.b, s.brightness})
+			if rng.Float64() < branching {
+				axis := random_perpendicular(rng, dir)
+				branch := mid.Sub(s.a)
+				branch = VRotate(&branch, &axis, (rng.Float64()*2-1)*0.6).Scale(0.7)
+				next = append(next, BoltSegment{mid, mid.Add(branch), s.brightness * 0.5})
+			}
+		}
+		segments = next
+		offset /= 2
+	}
+	return segments
+}
+
+// unit vector perpendicular to dir, in a random direction around it
+func random_perpendicular(rng *rand.Rand, dir Vec3) Vec3 {
+	for {
+		r := Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+		p := dir.Cross(&r)
+		if l := p.Len(); l > 1e-9 {
+			return p.Scale(1 / l)
+		}
+	}
+}
+
+// Places n lights at even steps of length times brightness along the segments
+func bolt_lights(segments []BoltSegment, n int) []Vec3 {
+	total := 0.0
+	for _, s := range segments {
+		total += s.b.Sub(s.a).Len() * s.brightness
+	}
+	lights := make([]Vec3, 0, n)
+	step := total / float64(n)
+	next := step / 2
+	walked := 0.0
+	for _, s := range segments {
+		w := s.b.Sub(s.a).Len() * s.brightness
+		for next < walked+w && len(lights) < n {
+			lights = append(lights, s.a.Add(s.b.Sub(s.a).Scale((next-walked)/w)))
+			next += step
+		}
+		walked += w
+	}
+	return lights
+}
+
+// Strikes a new bolt now, replacing the last one
+func (l *Lightning) strike(time float64) {
+	size := l.region_max.Sub(l.region_min)
+	random_in := func(y float64) Vec3 {
+		return Vec3{l.region_min.X + size.X*l.rng.Float64(), y, l.region_min.Z + size.Z*l.rng.Float64()}
+	}
+	start := random_in(l.region_max.Y - size.Y*0.1*l.rng.Float64())
+	end := random_in(l.region_min.Y)
+	segments := generate_bolt(l.rng, start, end, l.generations, l.displacement, l.branching)
+
+	strokes := []float64{time}
+	for range l.rng.Intn(4) {
+		strokes = append(strokes, strokes[len(strokes)-1]+0.05+0.1*l.rng.Float64())
+	}
+	l.bolt = &LightningBolt{segments: segments, lights: bolt_lights(segments, LIGHTNING_LIGHTS), strokes: strokes}
+}
+
+// Strikes when the timer runs out, call once per frame
+func (l *Lightning) update(time float64) {
+	if l == nil || l.interval <= 0 {
+		return
+	}
+	if l.next_strike == 0 {
+		l.next_strike = time + l.interval*(0.5+l.rng.Float64())
+	}
+	if time >= l.next_strike {
+		l.strike(time)
+		l.next_strike = time + l.interval*(0.5+l.rng.Float64())
+	}
+}
+
+// Brightness of the flash, every return stroke lights up and fades
+func (b *LightningBolt) flash(time float64) float64 {
+	f := 0.0
+	for _, s := range b.strokes {
+		if time >= s {
+			f += math.Exp(-(time - s) / LIGHTNING_STROKE_DECAY)
+		}
+	}
+	return f
+}
+
+// Light reaching p from the current flash, zero between flashes. occlusion is the transmittance between two points,
+// only marched towards the nearest light of the channel.
+func (l *Lightning) light_at(p Vec3, time float64, occlusion func(from, to Vec3) float64) Vec3 {
+	if l == nil || l.bolt == nil {
+		return Vec3{}
+	}
+	flash := l.bolt.flash(time) * l.intensity
+	if flash < 0.001 {
+		return Vec3{}
+	}
+	amount := 0.0
+	nearest, nearest_sq := Vec3{}, math.MaxFloat64
+	falloff_sq := l.falloff * l.falloff
+	for _, q := range l.bolt.lights {
+		d_sq := q.Sub(p).LenSq()
+		amount += 1 / (1 + d_sq/falloff_sq)
+		if d_sq < nearest_sq {
+			nearest, nearest_sq = q, d_sq
+		}
+	}
+	amount *= flash / float64(len(l.bolt.lights))
+	if amount < 0.001 {
+		return Vec3{}
+	}
+	return l.color.Scale(amount * occlusion(p, nearest))
+}
+
+// Scene file representation of lightning, see build_lightning for defaults
+type LightningDef struct {
+	Center       [3]float64 `json:"center"`
+	Size         [3]float64 `json:"size"`               // box the bolts are generated in
+	Interval     float64    `json:"interval,omitempty"` // mean seconds between strikes, 0 for the L key only
+	Intensity    float64    `json:"intensity,omitempty"`
+	Kelvin       float64    `json:"kelvin,omitempty"` // color
+	Falloff      float64    `json:"falloff,omitempty"`
+	Generations  int        `json:"generations,omitempty"`
+	Displacement float64    `json:"displacement,omitempty"`
+	Branching    float64    `json:"branching,omitempty"`
+	Seed         int64      `json:"seed,omitempty"`
+}
+
+func build_lightning(def *LightningDef) (*Lightning, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	center := Vec3{def.Center[0], def.Center[1], def.Center[2]}
+	half := Vec3{or_default(def.Size[0], 1), or_default(def.Size[1], 1), or_default(def.Size[2], 1)}.Scale(0.5)
+	l := Lightning{
+		region_min:   center.Sub(half),
+		region_max:   center.Add(half),
+		interval:     def.Interval,
+		intensity:    or_default(def.Intensity, 8),
+		color:        kelvin_to_rgb(or_default(def.Kelvin, 9000)),
+		falloff:      or_default(def.Falloff, half.Y*0.4),
+		generations:  or_default_int(def.Generations, 6),
+		displacement: or_default(def.Displacement, 0.15),
+		branching:    or_default(def.Branching, 0.25),
+		rng:          rand.New(rand.NewSource(def.Seed)),
+	}
+	if l.interval < 0 {
+		return nil, fmt.Errorf("negative interval %v", l.interval)
+	}
+	if l.generations > 12 {
+		return nil, fmt.Errorf("%d generations make %d segments per bolt, at most 12", l.generations, 1<<l.generations)
+	}
+	return &l, nil
+}
+
+// Lightning for the L key when the scene file has none: inside the cloud layer in front of the camera, or inside
+// the shape
+func default_lightning(state *State) *Lightning {
+	def := LightningDef{}
+	if state.layer != nil {
+		l := state.layer
+		def.Center = [3]float64{0, (l.bottom + l.top) / 2, 8}
+		def.Size = [3]float64{8, (l.top - l.bottom) * 0.8, 6}
+	} else {
+		b := state.shape.bounding_sphere()
+		def.Center = [3]float64{b.C.X, b.C.Y, b.C.Z}
+		def.Size = [3]float64{b.R, b.R * 1.4, b.R}
+	}
+	lightning, _ := build_lightning(&def)
+	return lightning
+}
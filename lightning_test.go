@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestGenerateBolt(t *testing.T) {
+	start, end := Vec3{0, 4, 0}, Vec3{1, 0, 0}
+	segments := generate_bolt(rand.New(rand.NewSource(1)), start, end, 5, 0.2, 0.3)
+
+	// the main channel is a connected path from start to end, branches leave from its points
+	var main []BoltSegment
+	points := map[Vec3]bool{}
+	for _, s := range segments {
+		if s.brightness == 1 {
+			main = append(main, s)
+		}
+		points[s.a], points[s.b] = true, true
+	}
+	if len(main) != 1<<5 {
+		t.Fatalf("%d main channel segments, want 32", len(main))
+	}
+	at := start
+	for _, s := range main {
+		if s.a != at {
+			t.Fatalf("main channel breaks at %v", at)
+		}
+		at = s.b
+	}
+	if at != end {
+		t.Errorf("main channel ends at %v", at)
+	}
+	branches := 0
+	for _, s := range segments {
+		if s.brightness < 1 {
+			branches++
+			if !points[s.a] {
+				t.Errorf("branch starts at %v, off the bolt", s.a)
+			}
+		}
+	}
+	if branches == 0 {
+		t.Error("no branches")
+	}
+
+	lights := bolt_lights(segments, LIGHTNING_LIGHTS)
+	if len(lights) != LIGHTNING_LIGHTS {
+		t.Errorf("%d lights", len(lights))
+	}
+}
+
+func TestLightningFlash(t *testing.T) {
+	l, err := build_lightning(&LightningDef{Size: [3]float64{2, 2, 2}, Interval: 1, Seed: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(from, to Vec3) float64 { return 1 }
+	if c := l.light_at(Vec3{}, 0, open); c != (Vec3{}) {
+		t.Errorf("lit %v before any strike", c)
+	}
+	l.update(0)
+	if l.bolt != nil {
+		t.Fatal("struck without waiting")
+	}
+	l.update(2)
+	if l.bolt == nil {
+		t.Fatal("no strike after twice the interval")
+	}
+	struck := l.bolt.strokes[0]
+	during := l.light_at(Vec3{}, struck, open)
+	after := l.light_at(Vec3{}, struck+2, open)
+	if during.X <= 0 || after != (Vec3{}) {
+		t.Errorf("light %v during the flash, %v after", during, after)
+	}
+	if shadowed := l.light_at(Vec3{}, struck, func(from, to Vec3) float64 { return 0.5 }); shadowed.Sub(during.Scale(0.5)).LenSq() > 1e-12 {
+		t.Errorf("occluded light %v, want %v", shadowed, during.Scale(0.5))
+	}
+}
@@ -6,22 +6,36 @@ import (
 	"fmt"
 	"image/color"
 	"math"
+	"os"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		run_command(os.Args[1], os.Args[2:])
+		return
+	}
+
 	rl.InitWindow(int32(WINDOW_WIDTH), int32(WINDOW_HEIGHT), "goclouds") // must be at the top
 
 	state := initialize()
 
 	render_parameters := RenderParameters{
-		img:    state.image_target,
-		camera: state.camera,
-		light:  state.light,
-		sphere: state.sphere,
-		noises: state.noises,
-		time:   0.0,
+		img:         state.image_target,
+		camera:      state.camera,
+		light:       state.light,
+		shape:       state.shape,
+		layer:       state.layer,
+		emission:    state.emission,
+		lightning:   state.lightning,
+		solids:      state.solids,
+		fog:         state.fog,
+		god_rays:    state.god_rays,
+		shadow_grid: state.shadow_grid,
+		macro_grid:  state.macro_grid,
+		noises:      state.noises,
+		time:        0.0,
 	}
 
 	// clear_color := rl.Black
@@ -45,6 +59,63 @@ func main() {
 			density_type = DensityType_PerlinPreCalc
 		} else if rl.IsKeyReleased(rl.KeyThree) {
 			density_type = DensityType_Uniform
+		} else if rl.IsKeyReleased(rl.KeyFour) {
+			density_type = DensityType_Graph
+		} else if rl.IsKeyReleased(rl.KeyFive) {
+			density_type = DensityType_Wispy
+		} else if rl.IsKeyReleased(rl.KeySix) {
+			density_type = DensityType_Voxel
+		} else if rl.IsKeyReleased(rl.KeySeven) {
+			density_type = DensityType_Fluid
+		} else if rl.IsKeyReleased(rl.KeyEight) {
+			density_type = DensityType_FluidTemperature
+		}
+
+		if density_type == DensityType_Fluid || density_type == DensityType_FluidTemperature {
+			if state.noises.fluid == nil {
+				// a plume inside the default sphere
+				state.noises.fluid, _ = build_fluid_sim(&FluidSimDef{Center: [3]float64{0, 0, 2}})
+			}
+			state.noises.fluid.advance(float64(rl.GetFrameTime()))
+		}
+
+		if rl.IsKeyReleased(rl.KeyL) {
+			if state.lightning == nil {
+				state.lightning = default_lightning(state)
+				render_parameters.lightning = state.lightning
+			}
+			state.lightning.strike(time)
+		}
+		state.lightning.update(time)
+
+		if rl.IsKeyReleased(rl.KeyG) {
+			state.god_rays = cycle_god_rays(state.god_rays)
+			render_parameters.god_rays = state.god_rays
+		}
+
+		if rl.IsKeyReleased(rl.KeyT) {
+			if state.shadow_grid == nil {
+				state.shadow_grid, _ = build_shadow_grid(&ShadowGridDef{})
+			} else {
+				state.shadow_grid = nil
+			}
+			render_parameters.shadow_grid = state.shadow_grid
+		}
+
+		if rl.IsKeyReleased(rl.KeyE) {
+			if state.macro_grid == nil {
+				state.macro_grid, _ = build_macro_grid(&MacroGridDef{})
+			} else {
+				state.macro_grid = nil
+			}
+			render_parameters.macro_grid = state.macro_grid
+		}
+
+		if rl.IsKeyReleased(rl.KeyP) {
+			if err := cycle_cloud_preset(state); err != nil {
+				fmt.Println("cloud preset:", err)
+			}
+			render_parameters.layer = state.layer
 		}
 
 		if ANIMATE_LIGHT_POSITION {
@@ -71,7 +142,12 @@ func main() {
 			rl.White,
 		)
 		rl.DrawText(fmt.Sprintf("%v fps, dt: %.0fms", rl.GetFPS(), rl.GetFrameTime()*1000), 10, 10, 16, rl.White)
-		rl.DrawText(fmt.Sprintf("noise: 1/2/3 keys, current: %d", density_type), 10, WINDOW_HEIGHT-20, 16, rl.White)
+		rl.DrawText(fmt.Sprintf("noise: 1-8 keys, current: %d", density_type), 10, WINDOW_HEIGHT-20, 16, rl.White)
+		rl.DrawText(fmt.Sprintf("cloud layer: P key, current: %s", layer_label(state.layer)), 10, WINDOW_HEIGHT-40, 16, rl.White)
+		rl.DrawText("lightning: L key", 10, WINDOW_HEIGHT-60, 16, rl.White)
+		rl.DrawText(fmt.Sprintf("god rays: G key, current: %s", god_rays_label(state.god_rays)), 10, WINDOW_HEIGHT-80, 16, rl.White)
+		rl.DrawText(fmt.Sprintf("shadow grid: T key, current: %s", shadow_grid_label(state.shadow_grid)), 10, WINDOW_HEIGHT-100, 16, rl.White)
+		rl.DrawText(fmt.Sprintf("empty space skipping: E key, current: %v", state.macro_grid != nil), 10, WINDOW_HEIGHT-120, 16, rl.White)
 		rl.EndDrawing()
 	}
 
@@ -121,10 +197,14 @@ func initialize() *State {
 		image_target: &image_target,
 		camera:       &camera,
 		light:        &light,
-		sphere:       &sphere,
+		shape:        &sphere,
 		noises:       noises,
 		texture:      &tex,
 	}
+
+	if err := apply_scene_file(SCENE_FILE, &state); err != nil {
+		fmt.Println("scene file:", err)
+	}
 	return &state
 }
 
@@ -0,0 +1,206 @@
+package main
+
+import "slices"
+
+// Marching cubes over a sampled scalar grid.
+// https://paulbourke.net/geometry/polygonise/
+//
+// Instead of the usual hand-written 256 entry triangle table, the iso line loops are built at startup from one rule
+// applied per cube face: the iso line on a face cuts off each run of inside corners separately. Neighbouring cubes share
+// faces and apply the same rule, so the surface is watertight (the classic table has a few ambiguous cases with holes).
+
+// corner offsets, edges as corner pairs, same numbering as Paul Bourke's tables
+var mc_corners = [8][3]int{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}, {0, 0, 1}, {1, 0, 1}, {1, 1, 1}, {0, 1, 1}}
+var mc_edges = [12][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 0}, {4, 5}, {5, 6}, {6, 7}, {7, 4}, {0, 4}, {1, 5}, {2, 6}, {3, 7}}
+
+// Iso line loops per cube configuration, bit i of the configuration set when corner i is inside
+var mc_loops = build_marching_cubes_table()
+
+// Loop of cut edges, counter-clockwise seen from outside (away from the inside corners).
+// A loop that crosses a face twice is fanned around its center, since a fan diagonal between two cuts on the same face
+// could coincide with one from the neighbouring cube.
+type CubeLoop struct {
+	edges  []int
+	center bool
+}
+
+func build_marching_cubes_table() [256][]CubeLoop {
+	edge_of := map[[2]int]int{}
+	for e, c := range mc_edges {
+		edge_of[[2]int{c[0], c[1]}] = e
+		edge_of[[2]int{c[1], c[0]}] = e
+	}
+	corner := func(i int) Vec3 {
+		c := mc_corners[i]
+		return Vec3{float64(c[0]), float64(c[1]), float64(c[2])}
+	}
+
+	// face corner cycles, oriented counter-clockwise seen from outside the cube
+	faces := [6][4]int{{0, 1, 2, 3}, {4, 5, 6, 7}, {0, 1, 5, 4}, {3, 2, 6, 7}, {0, 3, 7, 4}, {1, 2, 6, 5}}
+	for f, c := range faces {
+		a, b, d := corner(c[0]), corner(c[1]), corner(c[2])
+		e1, e2 := b.Sub(a), d.Sub(b)
+		normal := e1.Cross(&e2)
+		center := a.Add(d).Scale(0.5)
+		if normal.Dot(center.Sub(Vec3Fill(0.5))) < 0 {
+			faces[f] = [4]int{c[3], c[2], c[1], c[0]}
+		}
+	}
+
+	var table [256][]CubeLoop
+	for config := range 256 {
+		inside := func(c int) bool { return config&(1<<c) != 0 }
+
+		// on every face, a segment from the edge entering a run of inside corners to the edge leaving it
+		next := map[int]int{}
+		segment_face := map[int]int{}
+		for f, c := range faces {
+			for k := range 4 {
+				if inside(c[k]) || !inside(c[(k+1)%4]) {
+					continue
+				}
+				m := (k + 1) % 4
+				for inside(c[(m+1)%4]) {
+					m = (m + 1) % 4
+				}
+				start := edge_of[[2]int{c[k], c[(k+1)%4]}]
+				next[start] = edge_of[[2]int{c[m], c[(m+1)%4]}]
+				segment_face[start] = f
+			}
+		}
+
+		// segments form closed loops
+		for e := range 12 {
+			if _, ok := next[e]; !ok {
+				continue
+			}
+			loop := CubeLoop{edges: []int{e}}
+			for n := next[e]; n != e; n = next[n] {
+				loop.edges = append(loop.edges, n)
+			}
+			crossed := map[int]bool{}
+			for _, l := range loop.edges {
+				loop.center = loop.center || crossed[segment_face[l]]
+				crossed[segment_face[l]] = true
+				delete(next, l)
+			}
+			table[config] = append(table[config], loop)
+		}
+	}
+
+	// the face orientation decides the winding, checked on corner 0 alone
+	mid := func(e int) Vec3 { return corner(mc_edges[e][0]).Add(corner(mc_edges[e][1])).Scale(0.5) }
+	l := table[1][0].edges
+	e1, e2 := mid(l[1]).Sub(mid(l[0])), mid(l[2]).Sub(mid(l[0]))
+	if normal := e1.Cross(&e2); normal.Dot(Vec3Fill(1)) < 0 {
+		for config := range table {
+			for _, loop := range table[config] {
+				slices.Reverse(loop.edges)
+			}
+		}
+	}
+	return table
+}
+
+// Polygonizes the iso surface where the field crosses iso, field values > iso are inside.
+// The field is point-sampled: grid point (x, y, z) is at origin + (x, y, z) * spacing.
+// Normals point outwards, along the negative field gradient.
+func marching_cubes(field *Matrix3D[float32], iso float64, origin, spacing Vec3) *Mesh {
+	mesh := &Mesh{}
+	w, h, d := field.W, field.H, field.D
+	at := func(x, y, z int) float64 {
+		return float64(field.values[y*w*d+x*d+z])
+	}
+	gradient := func(x, y, z int) Vec3 {
+		x0, x1 := max(x-1, 0), min(x+1, w-1)
+		y0, y1 := max(y-1, 0), min(y+1, h-1)
+		z0, z1 := max(z-1, 0), min(z+1, d-1)
+		return Vec3{
+			X: (at(x1, y, z) - at(x0, y, z)) / (float64(x1-x0) * spacing.X),
+			Y: (at(x, y1, z) - at(x, y0, z)) / (float64(y1-y0) * spacing.Y),
+			Z: (at(x, y, z1) - at(x, y, z0)) / (float64(z1-z0) * spacing.Z),
+		}
+	}
+
+	// vertices are shared between neighbouring cubes, keyed by grid edge
+	edge_vertices := map[int]int32{}
+	vertex := func(x, y, z, edge int) int32 {
+		a, b := mc_edges[edge][0], mc_edges[edge][1]
+		ca, cb := mc_corners[a], mc_corners[b]
+		ax, ay, az := x+ca[0], y+ca[1], z+ca[2]
+		bx, by, bz := x+cb[0], y+cb[1], z+cb[2]
+		lx, ly, lz := min(ax, bx), min(ay, by), min(az, bz)
+		axis := 0
+		if ay != by {
+			axis = 1
+		} else if az != bz {
+			axis = 2
+		}
+		key := ((ly*w+lx)*d+lz)*3 + axis
+		if i, ok := edge_vertices[key]; ok {
+			return i
+		}
+
+		va, vb := at(ax, ay, az), at(bx, by, bz)
+		t := 0.5
+		if va != vb {
+			t = clamp01((iso - va) / (vb - va))
+		}
+		pa := Vec3{float64(ax), float64(ay), float64(az)}
+		pb := Vec3{float64(bx), float64(by), float64(bz)}
+		p := pa.Add(pb.Sub(pa).Scale(t)).Mul(spacing).Add(origin)
+		ga, gb := gradient(ax, ay, az), gradient(bx, by, bz)
+		g := ga.Add(gb.Sub(ga).Scale(t))
+		normal := Vec3{}
+		if g.LenSq() > 0 {
+			normal = g.Scale(-1).Normalized()
+		}
+
+		i := int32(len(mesh.positions))
+		mesh.positions = append(mesh.positions, p)
+		mesh.normals = append(mesh.normals, normal)
+		edge_vertices[key] = i
+		return i
+	}
+
+	indices := []int32{}
+	for y := range h - 1 {
+		for x := range w - 1 {
+			for z := range d - 1 {
+				config := 0
+				for c, o := range mc_corners {
+					if at(x+o[0], y+o[1], z+o[2]) > iso {
+						config |= 1 << c
+					}
+				}
+				for _, loop := range mc_loops[config] {
+					indices = indices[:0]
+					for _, e := range loop.edges {
+						indices = append(indices, vertex(x, y, z, e))
+					}
+					if !loop.center {
+						for i := 1; i+1 < len(indices); i++ {
+							mesh.triangles = append(mesh.triangles, [3]int32{indices[0], indices[i], indices[i+1]})
+						}
+						continue
+					}
+					center := int32(len(mesh.positions))
+					p, n := Vec3{}, Vec3{}
+					for _, i := range indices {
+						p = p.Add(mesh.positions[i])
+						n = n.Add(mesh.normals[i])
+					}
+					if n.LenSq() > 0 {
+						n = n.Normalized()
+					}
+					mesh.positions = append(mesh.positions, p.Scale(1/float64(len(indices))))
+					mesh.normals = append(mesh.normals, n)
+					for i := range indices {
+						mesh.triangles = append(mesh.triangles, [3]int32{center, indices[i], indices[(i+1)%len(indices)]})
+					}
+				}
+			}
+		}
+	}
+	return mesh
+}
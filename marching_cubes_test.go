@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Every directed triangle edge must have exactly one reverse twin: closed, consistently wound, no holes
+func check_mesh_closed(t *testing.T, mesh *Mesh) {
+	t.Helper()
+	edges := map[[2]int32]int{}
+	for _, tri := range mesh.triangles {
+		for i := range 3 {
+			edges[[2]int32{tri[i], tri[(i+1)%3]}]++
+		}
+	}
+	for e, n := range edges {
+		if n != 1 || edges[[2]int32{e[1], e[0]}] != 1 {
+			t.Fatalf("edge %v used %d times, reverse %d times", e, n, edges[[2]int32{e[1], e[0]}])
+		}
+	}
+}
+
+func TestMarchingCubesSphere(t *testing.T) {
+	n := 20
+	center := Vec3Fill(9.5)
+	field := NewMatrix3D[float32](n, n, n)
+	for y := range n {
+		for x := range n {
+			for z := range n {
+				p := Vec3{float64(x), float64(y), float64(z)}
+				field.set(float32(7-p.Sub(center).Len()), x, y, z)
+			}
+		}
+	}
+	mesh := marching_cubes(field, 0, Vec3{}, Vec3Fill(1))
+	check_mesh_closed(t, mesh)
+
+	edges := len(mesh.triangles) * 3 / 2
+	if euler := len(mesh.positions) - edges + len(mesh.triangles); euler != 2 {
+		t.Errorf("euler characteristic %d, expected 2 for a sphere", euler)
+	}
+	for _, tri := range mesh.triangles {
+		a, b, c := mesh.positions[tri[0]], mesh.positions[tri[1]], mesh.positions[tri[2]]
+		e1, e2 := b.Sub(a), c.Sub(a)
+		normal := e1.Cross(&e2)
+		if normal.Dot(a.Sub(center)) <= 0 || mesh.normals[tri[0]].Dot(a.Sub(center)) <= 0 {
+			t.Fatalf("triangle %v faces inwards", tri)
+		}
+	}
+}
+
+// Random fields hit every configuration, including the ambiguous faces
+func TestMarchingCubesRandomClosed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 20 {
+		field := NewMatrix3D[float32](8, 8, 8)
+		for y := 1; y < 7; y++ {
+			for x := 1; x < 7; x++ {
+				for z := 1; z < 7; z++ {
+					field.set(rng.Float32(), x, y, z)
+				}
+			}
+		}
+		check_mesh_closed(t, marching_cubes(field, 0.5, Vec3{}, Vec3Fill(1)))
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "math"
+
 type Matrix2D[T any] struct {
 	values []T
 	W, H   int
@@ -34,3 +36,45 @@ func (dm *Matrix2D[T]) getWrap(x, y int) T {
 	}
 	return dm.values[iy*dm.W+ix]
 }
+
+func (dm *Matrix2D[T]) get(x, y int) T {
+	return dm.values[y*dm.W+x]
+}
+
+func (dm *Matrix2D[T]) set(value T, x, y int) {
+	dm.values[y*dm.W+x] = value
+}
+
+// x, y in cell units, clamped to the edges
+func matrix2D_sample_bilinear[T float32 | float64](m *Matrix2D[T], x, y float64) float64 {
+	x = clamp(x, 0, float64(m.W-1))
+	y = clamp(y, 0, float64(m.H-1))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, m.W-1), min(y0+1, m.H-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	at := func(x, y int) float64 {
+		return float64(m.values[y*m.W+x])
+	}
+	return mix(mix(at(x0, y0), at(x1, y0), fx), mix(at(x0, y1), at(x1, y1), fx), fy)
+}
+
+// x, y in cell units, wrapping around the edges so the matrix tiles
+func matrix2D_sample_bilinear_wrap[T float32 | float64](m *Matrix2D[T], x, y float64) float64 {
+	fx0, fy0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-fx0, y-fy0
+	wrap := func(i, n int) int {
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		return i
+	}
+	x0, y0 := wrap(int(fx0), m.W), wrap(int(fy0), m.H)
+	x1, y1 := wrap(x0+1, m.W), wrap(y0+1, m.H)
+
+	at := func(x, y int) float64 {
+		return float64(m.values[y*m.W+x])
+	}
+	return mix(mix(at(x0, y0), at(x1, y0), fx), mix(at(x0, y1), at(x1, y1), fx), fy)
+}
@@ -1,6 +1,9 @@
 package main
 
-import "math"
+import (
+	"math"
+	"sync"
+)
 
 // z-x-y memory layout
 type Matrix3D[T any] struct {
@@ -17,6 +20,43 @@ func NewMatrix3D[T any](w, h, d int) *Matrix3D[T] {
 	}
 }
 
+// Fills every cell with gen(x, y, z), split into y slabs across workers.
+// gen must only depend on its coordinates, so the result is the same for any worker count.
+// progress, if not nil, is called with the number of finished slabs, one call at a time.
+func fill_matrix3D_parallel[T any](m *Matrix3D[T], workers int, progress func(done, total int), gen func(x, y, z int) T) {
+	workers = max(1, min(workers, m.H))
+	var wg sync.WaitGroup
+	var progress_mutex sync.Mutex
+	done := 0
+	next_y := make(chan int, m.H)
+	for y := range m.H {
+		next_y <- y
+	}
+	close(next_y)
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			for y := range next_y {
+				slab := m.values[y*m.W*m.D : (y+1)*m.W*m.D]
+				for x := range m.W {
+					for z := range m.D {
+						slab[x*m.D+z] = gen(x, y, z)
+					}
+				}
+				if progress != nil {
+					progress_mutex.Lock()
+					done++
+					progress(done, m.H)
+					progress_mutex.Unlock()
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
 func (dm *Matrix3D[T]) set(value T, x, y, z int) {
 	ix := x % dm.W
 	iy := y % dm.H
@@ -90,3 +130,22 @@ func (dm *Matrix3D[T]) getFromFloatsWrap2(x, y, z float64) T {
 	i := iy*dm.W*dm.D + ix*dm.D + iz
 	return dm.values[i]
 }
+
+// Trilinear interpolation, x, y, z in cell units (cell centers at integers), clamped to the edges
+func matrix3D_sample_trilinear[T float32 | float64](m *Matrix3D[T], x, y, z float64) float64 {
+	x = clamp(x, 0, float64(m.W-1))
+	y = clamp(y, 0, float64(m.H-1))
+	z = clamp(z, 0, float64(m.D-1))
+	x0, y0, z0 := int(x), int(y), int(z)
+	x1, y1, z1 := min(x0+1, m.W-1), min(y0+1, m.H-1), min(z0+1, m.D-1)
+	fx, fy, fz := x-float64(x0), y-float64(y0), z-float64(z0)
+
+	at := func(x, y, z int) float64 {
+		return float64(m.values[y*m.W*m.D+x*m.D+z])
+	}
+	c00 := mix(at(x0, y0, z0), at(x1, y0, z0), fx)
+	c10 := mix(at(x0, y1, z0), at(x1, y1, z0), fx)
+	c01 := mix(at(x0, y0, z1), at(x1, y0, z1), fx)
+	c11 := mix(at(x0, y1, z1), at(x1, y1, z1), fx)
+	return mix(mix(c00, c10, fy), mix(c01, c11, fy), fz)
+}
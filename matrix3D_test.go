@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Baked caches must not depend on how many goroutines generated them
+func TestNoiseBakeDeterministic(t *testing.T) {
+	prev_workers := bake_workers
+	defer func() { bake_workers = prev_workers }()
+
+	bakes := []struct {
+		params   NoiseGridParams
+		generate NoiseGridGenerator
+	}{
+		{perlin_values_params, generate_perlin_faded},
+		{perlin_values_tiled_params, generate_perlin_tiled},
+	}
+	for _, b := range bakes {
+		params := b.params
+		params.Dim = 32
+
+		var reference []byte
+		for _, workers := range []int{1, 3, 8, 64} {
+			bake_workers = workers
+			var buf bytes.Buffer
+			if err := encode_volume(&buf, b.generate(params, nil), params); err != nil {
+				t.Fatal(err)
+			}
+			if reference == nil {
+				reference = buf.Bytes()
+			} else if !bytes.Equal(reference, buf.Bytes()) {
+				t.Errorf("%s: %d workers baked different bytes than 1 worker", params.Generator, workers)
+			}
+		}
+	}
+}
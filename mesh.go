@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Indexed triangle meshes, written as Wavefront OBJ or binary PLY
+
+type Mesh struct {
+	positions []Vec3
+	normals   []Vec3
+	triangles [][3]int32 // counter-clockwise seen from outside
+}
+
+// Samples density masked by a shape on a grid of res points per axis over the shape's bounding sphere, plus one border
+// layer of zeros so the iso surface is closed, and polygonizes it at iso.
+// The mask fades the density to zero over edge world units inside the shape surface.
+func density_mesh(
+	density DensityFunc,
+	noises *Noises,
+	time float64,
+	shape Shape,
+	edge float64,
+	iso float64,
+	res int,
+	progress func(done, total int),
+) *Mesh {
+	sphere := shape.bounding_sphere()
+	spacing := Vec3Fill(2 * sphere.R / float64(res-1))
+	origin := sphere.C.Sub(Vec3Fill(sphere.R)).Sub(spacing)
+	n := res + 2
+	field := NewMatrix3D[float32](n, n, n)
+	fill_matrix3D_parallel(field, bake_workers, progress, func(x, y, z int) float32 {
+		if x == 0 || y == 0 || z == 0 || x == n-1 || y == n-1 || z == n-1 {
+			return 0
+		}
+		p := origin.Add(Vec3{float64(x), float64(y), float64(z)}.Mul(spacing))
+		mask := linear_step(0, edge, -shape.sdf(p))
+		if mask == 0 {
+			return 0
+		}
+		return float32(mask * density(p, noises, time))
+	})
+	return marching_cubes(field, iso, origin, spacing)
+}
+
+// Vertex clustering: merges all vertices inside each cell of a cell_size grid into their average,
+// dropping triangles that collapse. Cheap and robust, but doesn't preserve sharp features.
+func decimate_mesh(mesh *Mesh, cell_size float64) *Mesh {
+	type cluster struct {
+		position, normal Vec3
+		count            int
+	}
+	cell_index := map[[3]int64]int32{}
+	clusters := []cluster{}
+	remap := make([]int32, len(mesh.positions))
+	for i, p := range mesh.positions {
+		key := [3]int64{
+			int64(math.Floor(p.X / cell_size)),
+			int64(math.Floor(p.Y / cell_size)),
+			int64(math.Floor(p.Z / cell_size)),
+		}
+		c, ok := cell_index[key]
+		if !ok {
+			c = int32(len(clusters))
+			cell_index[key] = c
+			clusters = append(clusters, cluster{})
+		}
+		clusters[c].position = clusters[c].position.Add(p)
+		clusters[c].normal = clusters[c].normal.Add(mesh.normals[i])
+		clusters[c].count++
+		remap[i] = c
+	}
+
+	out := &Mesh{
+		positions: make([]Vec3, len(clusters)),
+		normals:   make([]Vec3, len(clusters)),
+	}
+	for i, c := range clusters {
+		out.positions[i] = c.position.Scale(1 / float64(c.count))
+		if c.normal.LenSq() > 0 {
+			out.normals[i] = c.normal.Normalized()
+		}
+	}
+	// collapsed clusters produce duplicates and opposite wound pairs of the same triangle, keep the net winding per
+	// vertex triple, in first seen order
+	winding := map[[3]int32]int{}
+	order := [][3]int32{}
+	for _, t := range mesh.triangles {
+		a, b, c := remap[t[0]], remap[t[1]], remap[t[2]]
+		if a == b || b == c || c == a {
+			continue
+		}
+		key, sign := sorted_triangle(a, b, c)
+		if _, ok := winding[key]; !ok {
+			order = append(order, key)
+		}
+		winding[key] += sign
+	}
+	for _, key := range order {
+		switch {
+		case winding[key] > 0:
+			out.triangles = append(out.triangles, key)
+		case winding[key] < 0:
+			out.triangles = append(out.triangles, [3]int32{key[0], key[2], key[1]})
+		}
+	}
+	return out
+}
+
+// Indices in ascending order, and +1 when that is a rotation of a, b, c (same winding), -1 otherwise
+func sorted_triangle(a, b, c int32) ([3]int32, int) {
+	t := [3]int32{a, b, c}
+	sign := 1
+	for i := range 2 {
+		for j := range 2 - i {
+			if t[j] > t[j+1] {
+				t[j], t[j+1] = t[j+1], t[j]
+				sign = -sign
+			}
+		}
+	}
+	return t, sign
+}
+
+func write_obj(path string, mesh *Mesh) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr // a full disk may only show when the file is closed
+		}
+	}()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# goclouds iso surface, %d vertices, %d triangles\n", len(mesh.positions), len(mesh.triangles))
+	for _, p := range mesh.positions {
+		fmt.Fprintf(w, "v %g %g %g\n", p.X, p.Y, p.Z)
+	}
+	for _, n := range mesh.normals {
+		fmt.Fprintf(w, "vn %g %g %g\n", n.X, n.Y, n.Z)
+	}
+	// OBJ indices start at 1
+	for _, t := range mesh.triangles {
+		fmt.Fprintf(w, "f %d//%d %d//%d %d//%d\n", t[0]+1, t[0]+1, t[1]+1, t[1]+1, t[2]+1, t[2]+1)
+	}
+	return w.Flush()
+}
+
+func write_ply(path string, mesh *Mesh) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr // a full disk may only show when the file is closed
+		}
+	}()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "ply\n"+
+		"format binary_little_endian 1.0\n"+
+		"comment goclouds iso surface\n"+
+		"element vertex %d\n"+
+		"property float x\nproperty float y\nproperty float z\n"+
+		"property float nx\nproperty float ny\nproperty float nz\n"+
+		"element face %d\n"+
+		"property list uchar int vertex_indices\n"+
+		"end_header\n",
+		len(mesh.positions), len(mesh.triangles),
+	)
+	for i, p := range mesh.positions {
+		n := mesh.normals[i]
+		vertex := [6]float32{float32(p.X), float32(p.Y), float32(p.Z), float32(n.X), float32(n.Y), float32(n.Z)}
+		if err := binary.Write(w, binary.LittleEndian, &vertex); err != nil {
+			return err
+		}
+	}
+	for _, t := range mesh.triangles {
+		if err := w.WriteByte(3); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, &t); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Picks the writer from the extension, .obj or .ply
+func write_mesh(path string, mesh *Mesh) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".obj":
+		return write_obj(path, mesh)
+	case ".ply":
+		return write_ply(path, mesh)
+	}
+	return fmt.Errorf("%s: unknown mesh format, expected .obj or .ply", path)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Triangle meshes voxelized into a signed distance grid, used as a shape in place of the sphere.
+// Distances come from closest-triangle queries on a BVH, the sign from ray crossing parity.
+
+// Positions and triangles of an OBJ file, polygons are fanned into triangles. Normals, texture coordinates,
+// groups and materials are ignored.
+func load_obj(path string) (*Mesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mesh := &Mesh{}
+	scanner := bufio.NewScanner(f)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: vertex needs 3 coordinates", path, line_number)
+			}
+			var xyz [3]float64
+			for i := range 3 {
+				xyz[i], err = strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, line_number, err)
+				}
+			}
+			mesh.positions = append(mesh.positions, Vec3{xyz[0], xyz[1], xyz[2]})
+		case "f":
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: face needs 3 vertices", path, line_number)
+			}
+			indices := make([]int32, len(fields)-1)
+			for i, field := range fields[1:] {
+				// v, v/vt, v//vn or v/vt/vn, negative indices count back from the last vertex
+				index, err := strconv.Atoi(strings.Split(field, "/")[0])
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, line_number, err)
+				}
+				if index < 0 {
+					index += len(mesh.positions) + 1
+				}
+				if index < 1 || index > len(mesh.positions) {
+					return nil, fmt.Errorf("%s:%d: vertex index %s out of range", path, line_number, field)
+				}
+				indices[i] = int32(index - 1)
+			}
+			for i := 1; i+1 < len(indices); i++ {
+				mesh.triangles = append(mesh.triangles, [3]int32{indices[0], indices[i], indices[i+1]})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mesh, nil
+}
+
+func mesh_bounds(mesh *Mesh) (Vec3, Vec3) {
+	lo, hi := Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+	for _, p := range mesh.positions {
+		lo, hi = Vec3Min(lo, p), Vec3Max(hi, p)
+	}
+	return lo, hi
+}
+
+// Moves and uniformly scales the mesh so its bounding box is centered on center with the largest extent size.
+// A mesh without vertices or with all of them in one point can't be scaled.
+func fit_mesh(mesh *Mesh, center Vec3, size float64) error {
+	lo, hi := mesh_bounds(mesh)
+	extent := hi.Sub(lo)
+	largest := max(extent.X, extent.Y, extent.Z)
+	if !(largest > 0) {
+		return fmt.Errorf("mesh has no extent")
+	}
+	scale := size / largest
+	mid := lo.Add(hi).Scale(0.5)
+	for i, p := range mesh.positions {
+		mesh.positions[i] = p.Sub(mid).Scale(scale).Add(center)
+	}
+	return nil
+}
+
+type TriangleBVHNode struct {
+	min, max     Vec3
+	left, right  int32 // child node indices, for inner nodes
+	first, count int32 // triangle range, leaf when count > 0
+}
+
+type TriangleBVH struct {
+	nodes     []TriangleBVHNode
+	triangles [][3]Vec3 // reordered so every leaf is a contiguous range
+}
+
+const TRIANGLE_BVH_LEAF_SIZE = 4
+
+// Splits at the median centroid along the longest axis of the centroid bounds
+func NewTriangleBVH(mesh *Mesh) *TriangleBVH {
+	bvh := &TriangleBVH{triangles: make([][3]Vec3, len(mesh.triangles))}
+	centroids := make([]Vec3, len(mesh.triangles))
+	for i, t := range mesh.triangles {
+		bvh.triangles[i] = [3]Vec3{mesh.positions[t[0]], mesh.positions[t[1]], mesh.positions[t[2]]}
+		centroids[i] = bvh.triangles[i][0].Add(bvh.triangles[i][1]).Add(bvh.triangles[i][2]).Scale(1.0 / 3)
+	}
+	order := make([]int, len(mesh.triangles))
+	for i := range order {
+		order[i] = i
+	}
+
+	var build func(first, count int) int32
+	build = func(first, count int) int32 {
+		index := int32(len(bvh.nodes))
+		bvh.nodes = append(bvh.nodes, TriangleBVHNode{})
+		node := TriangleBVHNode{min: Vec3Fill(math.Inf(1)), max: Vec3Fill(math.Inf(-1))}
+		c_min, c_max := node.min, node.max
+		for _, t := range order[first : first+count] {
+			for _, v := range bvh.triangles[t] {
+				node.min, node.max = Vec3Min(node.min, v), Vec3Max(node.max, v)
+			}
+			c_min, c_max = Vec3Min(c_min, centroids[t]), Vec3Max(c_max, centroids[t])
+		}
+		if count <= TRIANGLE_BVH_LEAF_SIZE {
+			node.first, node.count = int32(first), int32(count)
+			bvh.nodes[index] = node
+			return index
+		}
+
+		extent := c_max.Sub(c_min)
+		axis := 0
+		if extent.Y > extent.Axis(axis) {
+			axis = 1
+		}
+		if extent.Z > extent.Axis(axis) {
+			axis = 2
+		}
+		slices.SortFunc(order[first:first+count], func(a, b int) int {
+			return cmp_float(centroids[a].Axis(axis), centroids[b].Axis(axis))
+		})
+		half := count / 2
+		node.left = build(first, half)
+		node.right = build(first+half, count-half)
+		bvh.nodes[index] = node
+		return index
+	}
+	if len(order) > 0 {
+		build(0, len(order))
+	}
+
+	reordered := make([][3]Vec3, len(order))
+	for i, t := range order {
+		reordered[i] = bvh.triangles[t]
+	}
+	bvh.triangles = reordered
+	return bvh
+}
+
+func cmp_float(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// squared distance from p to an axis-aligned box, 0 inside
+func box_distance_sq(p, lo, hi Vec3) float64 {
+	d := Vec3Max(Vec3Max(lo.Sub(p), p.Sub(hi)), Vec3{})
+	return d.LenSq()
+}
+
+// Distance from p to the closest triangle, visiting the nearer child first and skipping boxes farther than the best hit
+func (bvh *TriangleBVH) closest_distance(p Vec3) float64 {
+	best := math.Inf(1)
+	stack := make([]int32, 0, 64)
+	stack = append(stack, 0)
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if box_distance_sq(p, node.min, node.max) >= best {
+			continue
+		}
+		if node.count > 0 {
+			for _, t := range bvh.triangles[node.first : node.first+node.count] {
+				q := closest_point_triangle(p, t[0], t[1], t[2])
+				best = min(best, p.Sub(q).LenSq())
+			}
+			continue
+		}
+		l, r := &bvh.nodes[node.left], &bvh.nodes[node.right]
+		if box_distance_sq(p, l.min, l.max) < box_distance_sq(p, r.min, r.max) {
+			stack = append(stack, node.right, node.left)
+		} else {
+			stack = append(stack, node.left, node.right)
+		}
+	}
+	return math.Sqrt(best)
+}
+
+// Number of triangles crossed by the ray from origin along dir
+func (bvh *TriangleBVH) count_crossings(origin, dir Vec3) int {
+	inv_dir := Vec3{1 / dir.X, 1 / dir.Y, 1 / dir.Z}
+	crossings := 0
+	stack := make([]int32, 0, 64)
+	stack = append(stack, 0)
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if !ray_hits_box(origin, inv_dir, node.min, node.max) {
+			continue
+		}
+		if node.count > 0 {
+			for _, t := range bvh.triangles[node.first : node.first+node.count] {
+				if ray_hits_triangle(origin, dir, t[0], t[1], t[2]) {
+					crossings++
+				}
+			}
+			continue
+		}
+		stack = append(stack, node.left, node.right)
+	}
+	return crossings
+}
+
+// Slab test
+func ray_hits_box(origin, inv_dir, lo, hi Vec3) bool {
+	t_near, t_far := 0.0, math.Inf(1)
+	for axis := range 3 {
+		t0 := (lo.Axis(axis) - origin.Axis(axis)) * inv_dir.Axis(axis)
+		t1 := (hi.Axis(axis) - origin.Axis(axis)) * inv_dir.Axis(axis)
+		t_near = max(t_near, min(t0, t1))
+		t_far = min(t_far, max(t0, t1))
+	}
+	return t_near <= t_far
+}
+
+// https://en.wikipedia.org/wiki/M%C3%B6ller%E2%80%93Trumbore_intersection_algorithm
+func ray_hits_triangle(origin, dir, a, b, c Vec3) bool {
+	const eps = 1e-12
+	e1, e2 := b.Sub(a), c.Sub(a)
+	h := dir.Cross(&e2)
+	det := e1.Dot(h)
+	if math.Abs(det) < eps {
+		return false
+	}
+	s := origin.Sub(a)
+	u := s.Dot(h) / det
+	if u < 0 || u > 1 {
+		return false
+	}
+	q := s.Cross(&e1)
+	v := dir.Dot(q) / det
+	if v < 0 || u+v > 1 {
+		return false
+	}
+	return e2.Dot(q)/det > 0
+}
+
+// Real-Time Collision Detection (Ericson), 5.1.5
+func closest_point_triangle(p, a, b, c Vec3) Vec3 {
+	ab, ac, ap := b.Sub(a), c.Sub(a), p.Sub(a)
+	d1, d2 := ab.Dot(ap), ac.Dot(ap)
+	if d1 <= 0 && d2 <= 0 {
+		return a
+	}
+	bp := p.Sub(b)
+	d3, d4 := ab.Dot(bp), ac.Dot(bp)
+	if d3 >= 0 && d4 <= d3 {
+		return b
+	}
+	vc := d1*d4 - d3*d2
+	if vc <= 0 && d1 >= 0 && d3 <= 0 {
+		return a.Add(ab.Scale(d1 / (d1 - d3)))
+	}
+	cp := p.Sub(c)
+	d5, d6 := ab.Dot(cp), ac.Dot(cp)
+	if d6 >= 0 && d5 <= d6 {
+		return c
+	}
+	vb := d5*d2 - d1*d6
+	if vb <= 0 && d2 >= 0 && d6 <= 0 {
+		return a.Add(ac.Scale(d2 / (d2 - d6)))
+	}
+	va := d3*d6 - d5*d4
+	if va <= 0 && d4-d3 >= 0 && d5-d6 >= 0 {
+		return b.Add(c.Sub(b).Scale((d4 - d3) / ((d4 - d3) + (d5 - d6))))
+	}
+	denom := 1 / (va + vb + vc)
+	return a.Add(ab.Scale(vb * denom)).Add(ac.Scale(vc * denom))
+}
+
+// skewed so rays rarely graze edges or vertices of axis-aligned geometry
+var inside_test_dirs = [3]Vec3{
+	{0.5773, 0.5774, 0.5775},
+	{-0.7071, 0.0013, 0.7071},
+	{0.0021, -0.9999, 0.0104},
+}
+
+// Majority vote of crossing parity along three rays, tolerates small holes and grazing hits
+func (bvh *TriangleBVH) inside(p Vec3) bool {
+	votes := 0
+	for _, dir := range inside_test_dirs {
+		if bvh.count_crossings(p, dir)%2 == 1 {
+			votes++
+		}
+	}
+	return votes >= 2
+}
+
+// Signed distances sampled on a grid around a mesh, negative inside
+type MeshSdf struct {
+	grid    *Matrix3D[float32]
+	voxel   float64
+	lo, hi  Vec3 // positions of the first and last grid points
+	bounds  Sphere
+	deepest float64
+}
+
+// resolution is the number of grid points along the mesh's largest extent
+func NewMeshSdf(mesh *Mesh, resolution int) *MeshSdf {
+	bvh := NewTriangleBVH(mesh)
+	lo, hi := mesh_bounds(mesh)
+	extent := hi.Sub(lo)
+	voxel := max(extent.X, extent.Y, extent.Z) / float64(max(resolution-1, 1))
+	// a few voxels of padding, so the zero crossing and the marcher's entry are inside the grid
+	padding := Vec3Fill(3 * voxel)
+	lo, hi = lo.Sub(padding), hi.Add(padding)
+	dims := hi.Sub(lo).Scale(1 / voxel)
+	grid := NewMatrix3D[float32](int(math.Ceil(dims.X))+1, int(math.Ceil(dims.Y))+1, int(math.Ceil(dims.Z))+1)
+	fill_matrix3D_parallel(grid, bake_workers, nil, func(x, y, z int) float32 {
+		p := lo.Add(Vec3{float64(x), float64(y), float64(z)}.Scale(voxel))
+		d := bvh.closest_distance(p)
+		if bvh.inside(p) {
+			d = -d
+		}
+		return float32(d)
+	})
+	hi = lo.Add(Vec3{float64(grid.W - 1), float64(grid.H - 1), float64(grid.D - 1)}.Scale(voxel))
+
+	center := lo.Add(hi).Scale(0.5)
+	radius := 0.0
+	for _, p := range mesh.positions {
+		radius = max(radius, p.Sub(center).Len())
+	}
+	deepest := float32(0)
+	for _, d := range grid.values {
+		deepest = min(deepest, d)
+	}
+	return &MeshSdf{
+		deepest: max(-float64(deepest), voxel),
+		grid:    grid,
+		voxel:   voxel,
+		lo:      lo,
+		hi:      hi,
+		bounds:  Sphere{C: center, R: radius},
+	}
+}
+
+func (m *MeshSdf) sdf(p Vec3) float64 {
+	q := Vec3Min(Vec3Max(p, m.lo), m.hi)
+	g := q.Sub(m.lo).Scale(1 / m.voxel)
+	d := matrix3D_sample_trilinear(m.grid, g.X, g.Y, g.Z)
+	if q == p {
+		return d
+	}
+	// outside the grid: the surface is inside the box, so the distance to the box is a lower bound,
+	// and by the triangle inequality so is the clamped point's distance minus the way there
+	to_box := p.Sub(q).Len()
+	return max(to_box, d-to_box)
+}
+
+func (m *MeshSdf) bounding_sphere() Sphere {
+	return m.bounds
+}
+
+func (m *MeshSdf) depth() float64 {
+	return m.deepest
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unit cube centered at the origin, quads with outward winding, some faces written with negative indices
+const cube_obj = `# cube
+v -0.5 -0.5 -0.5
+v 0.5 -0.5 -0.5
+v 0.5 0.5 -0.5
+v -0.5 0.5 -0.5
+v -0.5 -0.5 0.5
+v 0.5 -0.5 0.5
+v 0.5 0.5 0.5
+v -0.5 0.5 0.5
+vn 0 0 1
+f 1//1 4//1 3//1 2//1
+f 5 6 7 8
+f 1 2 6 5
+f 4/1 8/1 7/1 3/1
+f -8 -4 -1 -5
+f 2 3 7 6
+`
+
+func sdf_box(p Vec3, half float64) float64 {
+	q := Vec3{math.Abs(p.X) - half, math.Abs(p.Y) - half, math.Abs(p.Z) - half}
+	outside := Vec3Max(q, Vec3{}).Len()
+	inside := min(max(q.X, q.Y, q.Z), 0)
+	return outside + inside
+}
+
+func TestMeshSdfCube(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cube.obj")
+	if err := os.WriteFile(path, []byte(cube_obj), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shape, err := build_shape(&ShapeDef{Type: "mesh", Path: path, Center: [3]float64{0, 0, 2}, Size: 2, Resolution: 33})
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := Vec3{0, 0, 2}
+
+	rng := rand.New(rand.NewSource(1))
+	voxel := 2.0 / 32
+	for range 1000 {
+		p := Vec3{rng.Float64()*4 - 2, rng.Float64()*4 - 2, rng.Float64()*4 - 2}
+		got := shape.sdf(center.Add(p))
+		want := sdf_box(p, 1)
+		if math.Abs(want) < 2*voxel {
+			// trilinear interpolation across the surface must still get the sign right
+			if math.Abs(got-want) > voxel {
+				t.Fatalf("sdf at %v: got %g, want %g", p, got, want)
+			}
+			continue
+		}
+		if want < 0 && got >= 0 || want > 0 && got <= 0 {
+			t.Fatalf("sdf at %v: got %g, want %g", p, got, want)
+		}
+		// inside the grid within interpolation error, outside it a lower bound
+		if math.Abs(p.X) < 1.1 && math.Abs(p.Y) < 1.1 && math.Abs(p.Z) < 1.1 && math.Abs(got-want) > voxel {
+			t.Fatalf("sdf at %v: got %g, want %g", p, got, want)
+		}
+		if max(math.Abs(p.X), math.Abs(p.Y), math.Abs(p.Z)) > 1.2 && got > want+1e-9 {
+			t.Fatalf("sdf at %v: got %g, more than the true distance %g", p, got, want)
+		}
+	}
+}
+
+func TestMeshShapeDegenerate(t *testing.T) {
+	for name, obj := range map[string]string{
+		"point.obj": "v 1 2 3\nv 1 2 3\nv 1 2 3\nf 1 2 3\n",
+		"empty.obj": "# nothing\n",
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(obj), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := build_shape(&ShapeDef{Type: "mesh", Path: path}); err == nil {
+			t.Errorf("%s: built a shape", name)
+		}
+	}
+	if err := fit_mesh(&Mesh{}, Vec3{}, 2); err == nil {
+		t.Error("fitted a mesh without vertices")
+	}
+}
+
+func TestTriangleBVHClosest(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	mesh := &Mesh{}
+	for i := range 300 {
+		for range 3 {
+			mesh.positions = append(mesh.positions, Vec3{rng.Float64(), rng.Float64(), rng.Float64()})
+		}
+		mesh.triangles = append(mesh.triangles, [3]int32{int32(3 * i), int32(3*i + 1), int32(3*i + 2)})
+	}
+	bvh := NewTriangleBVH(mesh)
+	for range 200 {
+		p := Vec3{rng.Float64()*2 - 0.5, rng.Float64()*2 - 0.5, rng.Float64()*2 - 0.5}
+		want := math.Inf(1)
+		for _, tri := range mesh.triangles {
+			q := closest_point_triangle(p, mesh.positions[tri[0]], mesh.positions[tri[1]], mesh.positions[tri[2]])
+			want = min(want, p.Sub(q).Len())
+		}
+		if got := bvh.closest_distance(p); math.Abs(got-want) > 1e-12 {
+			t.Fatalf("closest distance at %v: got %g, want %g", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func test_sphere_mesh(n int, radius float64) *Mesh {
+	center := Vec3Fill(float64(n-1) / 2)
+	field := NewMatrix3D[float32](n, n, n)
+	for y := range n {
+		for x := range n {
+			for z := range n {
+				p := Vec3{float64(x), float64(y), float64(z)}
+				field.set(float32(radius-p.Sub(center).Len()), x, y, z)
+			}
+		}
+	}
+	return marching_cubes(field, 0, Vec3{}, Vec3Fill(1))
+}
+
+func TestDecimateMeshClosed(t *testing.T) {
+	mesh := test_sphere_mesh(24, 9)
+	for _, cell := range []float64{1.5, 2, 3} {
+		decimated := decimate_mesh(mesh, cell)
+		if len(decimated.triangles) == 0 || len(decimated.triangles) >= len(mesh.triangles)/2 {
+			t.Errorf("cell %v: %d of %d triangles left", cell, len(decimated.triangles), len(mesh.triangles))
+		}
+		check_mesh_closed(t, decimated)
+		for i, n := range decimated.normals {
+			if math.Abs(n.Len()-1) > 1e-9 {
+				t.Fatalf("cell %v: normal %d has length %v", cell, i, n.Len())
+			}
+		}
+	}
+}
+
+func TestWriteObj(t *testing.T) {
+	mesh := test_sphere_mesh(8, 2.5)
+	path := filepath.Join(t.TempDir(), "sphere.obj")
+	if err := write_mesh(path, mesh); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var positions, normals []Vec3
+	var triangles [][3]int32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v", "vn":
+			var v Vec3
+			if _, err := fmt.Sscan(strings.Join(fields[1:], " "), &v.X, &v.Y, &v.Z); err != nil {
+				t.Fatal(err)
+			}
+			if fields[0] == "v" {
+				positions = append(positions, v)
+			} else {
+				normals = append(normals, v)
+			}
+		case "f":
+			var tri [3]int32
+			for i, corner := range fields[1:] {
+				var v, n int32
+				if _, err := fmt.Sscanf(corner, "%d//%d", &v, &n); err != nil || v != n {
+					t.Fatalf("face corner %q", corner)
+				}
+				tri[i] = v - 1
+			}
+			triangles = append(triangles, tri)
+		}
+	}
+	if len(positions) != len(mesh.positions) || len(normals) != len(mesh.normals) || len(triangles) != len(mesh.triangles) {
+		t.Fatalf("read %d vertices, %d normals, %d triangles", len(positions), len(normals), len(triangles))
+	}
+	for i := range positions {
+		if positions[i].Sub(mesh.positions[i]).Len() > 1e-5 || normals[i].Sub(mesh.normals[i]).Len() > 1e-5 {
+			t.Fatalf("vertex %d reads back as %v %v", i, positions[i], normals[i])
+		}
+	}
+	for i := range triangles {
+		if triangles[i] != mesh.triangles[i] {
+			t.Fatalf("triangle %d reads back as %v", i, triangles[i])
+		}
+	}
+}
+
+func TestWritePly(t *testing.T) {
+	mesh := test_sphere_mesh(8, 2.5)
+	path := filepath.Join(t.TempDir(), "sphere.ply")
+	if err := write_mesh(path, mesh); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body, ok := bytes.Cut(data, []byte("end_header\n"))
+	if !ok {
+		t.Fatal("no end_header")
+	}
+	var vertices, faces int
+	for _, line := range strings.Split(string(header), "\n") {
+		fmt.Sscanf(line, "element vertex %d", &vertices)
+		fmt.Sscanf(line, "element face %d", &faces)
+	}
+	if !strings.HasPrefix(string(header), "ply\nformat binary_little_endian 1.0\n") || vertices != len(mesh.positions) || faces != len(mesh.triangles) {
+		t.Fatalf("header %q", header)
+	}
+	// 6 floats per vertex, a count byte and 3 ints per face
+	if want := vertices*6*4 + faces*(1+3*4); len(body) != want {
+		t.Fatalf("body of %d bytes, want %d", len(body), want)
+	}
+	r := bytes.NewReader(body)
+	for i := range vertices {
+		var v [6]float32
+		binary.Read(r, binary.LittleEndian, &v)
+		p, n := Vec3{float64(v[0]), float64(v[1]), float64(v[2])}, Vec3{float64(v[3]), float64(v[4]), float64(v[5])}
+		if p.Sub(mesh.positions[i]).Len() > 1e-5 || n.Sub(mesh.normals[i]).Len() > 1e-5 {
+			t.Fatalf("vertex %d reads back as %v %v", i, p, n)
+		}
+	}
+	for i := range faces {
+		count, _ := r.ReadByte()
+		var tri [3]int32
+		binary.Read(r, binary.LittleEndian, &tri)
+		if count != 3 || tri != mesh.triangles[i] {
+			t.Fatalf("face %d reads back as %d %v", i, count, tri)
+		}
+	}
+}
+
+func TestMeshCommandEdge(t *testing.T) {
+	for _, edge := range []string{"0", "-0.1"} {
+		if err := mesh_command([]string{"-edge", edge, "-scene", "none.json"}); err == nil || !strings.Contains(err.Error(), "-edge") {
+			t.Errorf("-edge %s: %v", edge, err)
+		}
+	}
+}
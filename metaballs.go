@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Clouds sculpted from clusters of spheres, blended with an exponential smooth minimum:
+// sdf = -blend * ln(sum(weight * exp(-d / blend))), d the distance to each sphere.
+// https://iquilezles.org/articles/smin/
+// Unlike the polynomial smooth min it doesn't depend on the order the spheres are blended in. Spheres farther than
+// METABALL_CUTOFF blend radii don't contribute, so each cell of a uniform grid only lists the spheres near it.
+
+const METABALL_CUTOFF = 6 // exp(-6) = 0.25%
+const METABALL_MAX_CELLS = 48
+
+type Metaball struct {
+	C      Vec3
+	R      float64
+	weight float64 // > 1 swells the sphere by blend * ln(weight), < 1 shrinks it
+}
+
+type MetaballShape struct {
+	balls  []Metaball
+	blend  float64
+	cutoff float64 // world units
+
+	grid_min Vec3
+	cell     float64
+	dims     [3]int
+	cells    [][]int32 // balls within the cutoff of each cell, x-fastest
+
+	bounds     Sphere
+	max_radius float64
+}
+
+func NewMetaballShape(balls []Metaball, blend float64) *MetaballShape {
+	s := &MetaballShape{balls: balls, blend: blend, cutoff: METABALL_CUTOFF * blend}
+
+	lo, hi := Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+	for _, b := range balls {
+		reach := Vec3Fill(b.R + s.cutoff)
+		lo, hi = Vec3Min(lo, b.C.Sub(reach)), Vec3Max(hi, b.C.Add(reach))
+		s.max_radius = max(s.max_radius, b.R)
+	}
+	center := lo.Add(hi).Scale(0.5)
+	for _, b := range balls {
+		s.bounds.R = max(s.bounds.R, b.C.Sub(center).Len()+b.R)
+	}
+	s.bounds.C = center
+
+	// cells about the size of the biggest sphere's reach, capped per axis
+	extent := hi.Sub(lo)
+	s.cell = max(s.max_radius+s.cutoff, max(extent.X, extent.Y, extent.Z)/METABALL_MAX_CELLS)
+	s.grid_min = lo
+	for axis := range 3 {
+		s.dims[axis] = max(1, int(math.Ceil(extent.Axis(axis)/s.cell)))
+	}
+	s.cells = make([][]int32, s.dims[0]*s.dims[1]*s.dims[2])
+	for i, b := range balls {
+		reach := Vec3Fill(b.R + s.cutoff)
+		c0, c1 := s.cell_coords(b.C.Sub(reach)), s.cell_coords(b.C.Add(reach))
+		for z := c0[2]; z <= c1[2]; z++ {
+			for y := c0[1]; y <= c1[1]; y++ {
+				for x := c0[0]; x <= c1[0]; x++ {
+					cell := (z*s.dims[1]+y)*s.dims[0] + x
+					s.cells[cell] = append(s.cells[cell], int32(i))
+				}
+			}
+		}
+	}
+	return s
+}
+
+// clamped to the grid
+func (s *MetaballShape) cell_coords(p Vec3) [3]int {
+	g := p.Sub(s.grid_min).Scale(1 / s.cell)
+	var c [3]int
+	for axis := range 3 {
+		c[axis] = max(0, min(int(math.Floor(g.Axis(axis))), s.dims[axis]-1))
+	}
+	return c
+}
+
+func (s *MetaballShape) sdf(p Vec3) float64 {
+	grid_max := s.grid_min.Add(Vec3{float64(s.dims[0]), float64(s.dims[1]), float64(s.dims[2])}.Scale(s.cell))
+	if to_grid := box_distance_sq(p, s.grid_min, grid_max); to_grid > 0 {
+		// every sphere is at least the cutoff inside the grid
+		return math.Sqrt(to_grid) + s.cutoff*0.5
+	}
+	c := s.cell_coords(p)
+	return s.blend_balls(p, s.cells[(c[2]*s.dims[1]+c[1])*s.dims[0]+c[0]])
+}
+
+func (s *MetaballShape) blend_balls(p Vec3, indices []int32) float64 {
+	sum := 0.0
+	for _, i := range indices {
+		b := &s.balls[i]
+		d := p.Sub(b.C).Len() - b.R
+		if d < s.cutoff {
+			sum += b.weight * math.Exp(-d/s.blend)
+		}
+	}
+	if sum == 0 {
+		// no sphere within the cutoff; half of it stays below the blended distance
+		return s.cutoff * 0.5
+	}
+	return -s.blend * math.Log(sum)
+}
+
+func (s *MetaballShape) bounding_sphere() Sphere {
+	return s.bounds
+}
+
+func (s *MetaballShape) depth() float64 {
+	return s.max_radius
+}
+
+// Cauliflower cumulus: a row of big spheres at the base, each sprouting smaller ones on its upper side,
+// recursively, above a flat bottom
+func generate_cumulus(rng *rand.Rand, center Vec3, size float64, count int) []Metaball {
+	base_y := center.Y - size*0.2
+	r0 := size * 0.18
+	balls := []Metaball{}
+	for i := range 3 {
+		x := (float64(i) - 1) * r0 * 1.3
+		balls = append(balls, Metaball{C: Vec3{center.X + x, base_y + r0*0.6, center.Z}, R: r0 * (1 - 0.15*math.Abs(float64(i)-1)), weight: 1})
+	}
+	for parent := 0; parent < len(balls) && len(balls) < count; parent++ {
+		p := balls[parent]
+		if p.R < r0*0.15 {
+			continue
+		}
+		children := 2 + rng.Intn(3)
+		for range children {
+			// random direction on the upper hemisphere, leaning outwards
+			dir := Vec3{rng.NormFloat64(), math.Abs(rng.NormFloat64()) + 0.3, rng.NormFloat64()}.Normalized()
+			r := p.R * (0.45 + 0.2*rng.Float64())
+			c := p.C.Add(dir.Scale(p.R * 0.85))
+			c.Y = max(c.Y, base_y+r*0.6) // flat base
+			balls = append(balls, Metaball{C: c, R: r, weight: 1})
+			if len(balls) == count {
+				break
+			}
+		}
+	}
+	return balls
+}
+
+// Flat sheet of overlapping spheres over a size x size*0.6 area
+func generate_stratus(rng *rand.Rand, center Vec3, size float64, count int) []Metaball {
+	balls := make([]Metaball, count)
+	for i := range balls {
+		offset := Vec3{(rng.Float64() - 0.5) * size, (rng.Float64() - 0.5) * size * 0.03, (rng.Float64() - 0.5) * size * 0.6}
+		balls[i] = Metaball{C: center.Add(offset), R: size * (0.06 + 0.04*rng.Float64()), weight: 1}
+	}
+	return balls
+}
+
+// Points with optional radius and weight columns, radius <= 0 where missing
+func load_points(path string) ([]Metaball, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return load_points_csv(path)
+	case ".ply":
+		return load_points_ply(path)
+	}
+	return nil, fmt.Errorf("%s: unknown point format, expected .csv or .ply", path)
+}
+
+// x,y,z[,radius[,weight]] rows, an optional header row is skipped
+func load_points_csv(path string) ([]Metaball, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	balls := []Metaball{}
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected x,y,z[,radius[,weight]]", path, row)
+		}
+		values := [5]float64{0, 0, 0, 0, 1}
+		for i := range min(len(record), 5) {
+			if values[i], err = strconv.ParseFloat(record[i], 64); err != nil {
+				break
+			}
+		}
+		if err != nil && row == 1 {
+			continue // header
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, row, err)
+		}
+		if !(values[4] > 0) {
+			return nil, fmt.Errorf("%s:%d: weight %g must be above 0", path, row, values[4])
+		}
+		balls = append(balls, Metaball{C: Vec3{values[0], values[1], values[2]}, R: values[3], weight: values[4]})
+	}
+	return balls, nil
+}
+
+// Vertex element of an ASCII or binary little-endian PLY, properties x, y, z and the optional radius and weight
+func load_points_ply(path string) ([]Metaball, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	type property struct {
+		name, kind string
+	}
+	format := ""
+	vertex_count := -1
+	properties := []property{}
+	in_vertex := false
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%s: header: %w", path, err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "end_header" {
+			break
+		}
+		switch {
+		case fields[0] == "format" && len(fields) > 1:
+			format = fields[1]
+		case fields[0] == "element" && len(fields) == 3:
+			if vertex_count >= 0 && !in_vertex {
+				continue // elements after the vertices aren't read
+			}
+			if vertex_count < 0 && fields[1] != "vertex" {
+				return nil, fmt.Errorf("%s: element %s before the vertices", path, fields[1])
+			}
+			in_vertex = fields[1] == "vertex"
+			if in_vertex {
+				if vertex_count, err = strconv.Atoi(fields[2]); err != nil || vertex_count < 0 {
+					return nil, fmt.Errorf("%s: invalid vertex count %q", path, fields[2])
+				}
+			}
+		case fields[0] == "property" && in_vertex:
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s: unsupported vertex property %q", path, strings.TrimSpace(line))
+			}
+			properties = append(properties, property{name: fields[2], kind: fields[1]})
+		}
+	}
+	if vertex_count < 0 {
+		return nil, fmt.Errorf("%s: no vertex element", path)
+	}
+	column := map[string]int{}
+	for i, p := range properties {
+		column[p.name] = i
+	}
+	for _, name := range []string{"x", "y", "z"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("%s: vertices without %s", path, name)
+		}
+	}
+
+	read_vertex := func(values []float64) error {
+		return errors.New("unsupported format " + format)
+	}
+	switch format {
+	case "ascii":
+		read_vertex = func(values []float64) error {
+			line, err := br.ReadString('\n')
+			if err != nil && line == "" {
+				return err
+			}
+			fields := strings.Fields(line)
+			if len(fields) < len(values) {
+				return fmt.Errorf("vertex %q has %d values, expected %d", strings.TrimSpace(line), len(fields), len(values))
+			}
+			for i := range values {
+				if values[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case "binary_little_endian":
+		read_vertex = func(values []float64) error {
+			for i, p := range properties {
+				v, err := read_ply_scalar(br, p.kind)
+				if err != nil {
+					return err
+				}
+				values[i] = v
+			}
+			return nil
+		}
+	}
+
+	// the count is only what the header claims, the balls grow with what the file holds
+	var balls []Metaball
+	values := make([]float64, len(properties))
+	optional := func(name string, d float64) float64 {
+		if i, ok := column[name]; ok {
+			return values[i]
+		}
+		return d
+	}
+	for i := range vertex_count {
+		if err := read_vertex(values); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%s: the file ends after %d of %d vertices", path, i, vertex_count)
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: vertex %d: %w", path, i, err)
+		}
+		ball := Metaball{
+			C:      Vec3{values[column["x"]], values[column["y"]], values[column["z"]]},
+			R:      optional("radius", 0),
+			weight: optional("weight", 1),
+		}
+		if !(ball.weight > 0) {
+			return nil, fmt.Errorf("%s: vertex %d: weight %g must be above 0", path, i, ball.weight)
+		}
+		balls = append(balls, ball)
+	}
+	return balls, nil
+}
+
+func read_ply_scalar(r io.Reader, kind string) (float64, error) {
+	var err error
+	read := func(v any) {
+		err = binary.Read(r, binary.LittleEndian, v)
+	}
+	switch kind {
+	case "char", "int8":
+		var v int8
+		read(&v)
+		return float64(v), err
+	case "uchar", "uint8":
+		var v uint8
+		read(&v)
+		return float64(v), err
+	case "short", "int16":
+		var v int16
+		read(&v)
+		return float64(v), err
+	case "ushort", "uint16":
+		var v uint16
+		read(&v)
+		return float64(v), err
+	case "int", "int32":
+		var v int32
+		read(&v)
+		return float64(v), err
+	case "uint", "uint32":
+		var v uint32
+		read(&v)
+		return float64(v), err
+	case "float", "float32":
+		var v float32
+		read(&v)
+		return float64(v), err
+	case "double", "float64":
+		var v float64
+		read(&v)
+		return v, err
+	}
+	return 0, fmt.Errorf("unsupported property type %q", kind)
+}
+
+// Moves and uniformly scales the points so their bounding box is centered on center with the largest extent size,
+// radii scale along and missing ones default to radius
+func fit_points(balls []Metaball, center Vec3, size, radius float64) {
+	lo, hi := Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+	for _, b := range balls {
+		lo, hi = Vec3Min(lo, b.C), Vec3Max(hi, b.C)
+	}
+	extent := hi.Sub(lo)
+	scale := 1.0
+	if largest := max(extent.X, extent.Y, extent.Z); largest > 0 {
+		scale = size / largest
+	}
+	mid := lo.Add(hi).Scale(0.5)
+	for i, b := range balls {
+		balls[i].C = b.C.Sub(mid).Scale(scale).Add(center)
+		if b.R > 0 {
+			balls[i].R = b.R * scale
+		} else {
+			balls[i].R = radius
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetaballGrid(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	shape := NewMetaballShape(generate_cumulus(rng, Vec3{0, 0, 2}, 2, 80), 0.05)
+	all := make([]int32, len(shape.balls))
+	for i := range all {
+		all[i] = int32(i)
+	}
+	for range 2000 {
+		p := Vec3{rng.Float64()*3 - 1.5, rng.Float64()*3 - 1.5, rng.Float64()*3 + 0.5}
+		got, want := shape.sdf(p), shape.blend_balls(p, all)
+		// where no sphere is within the cutoff both are just a safe step
+		if want < shape.cutoff*0.5 && math.Abs(got-want) > 1e-12 {
+			t.Fatalf("sdf at %v: got %g, brute force %g", p, got, want)
+		}
+		if want >= shape.cutoff*0.5 && got < shape.cutoff*0.5 {
+			t.Fatalf("sdf at %v: got %g away from every sphere", p, got)
+		}
+	}
+}
+
+func TestLoadPoints(t *testing.T) {
+	dir := t.TempDir()
+	csv_path := filepath.Join(dir, "points.csv")
+	csv := "x,y,z,radius,weight\n0,0,0,0.5,2\n1,2,3\n# comment\n-1,0.5,0,0.25\n"
+	if err := os.WriteFile(csv_path, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	balls, err := load_points(csv_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Metaball{{Vec3{0, 0, 0}, 0.5, 2}, {Vec3{1, 2, 3}, 0, 1}, {Vec3{-1, 0.5, 0}, 0.25, 1}}
+	if len(balls) != len(want) {
+		t.Fatalf("csv: %d points, want %d", len(balls), len(want))
+	}
+	for i := range want {
+		if balls[i] != want[i] {
+			t.Errorf("csv point %d: got %v, want %v", i, balls[i], want[i])
+		}
+	}
+
+	ascii_path := filepath.Join(dir, "ascii.ply")
+	ascii := "ply\nformat ascii 1.0\nelement vertex 2\nproperty float x\nproperty float y\nproperty float z\n" +
+		"property float radius\nelement face 0\nproperty list uchar int vertex_indices\nend_header\n1 2 3 0.5\n4 5 6 0.25\n"
+	if err := os.WriteFile(ascii_path, []byte(ascii), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	balls, err = load_points(ascii_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balls) != 2 || balls[1] != (Metaball{Vec3{4, 5, 6}, 0.25, 1}) {
+		t.Errorf("ascii ply: got %v", balls)
+	}
+
+	// binary vertices with normals and faces after them, as written by the mesh export
+	mesh := &Mesh{
+		positions: []Vec3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		normals:   []Vec3{{0, 0, 1}, {0, 0, 1}, {0, 0, 1}},
+		triangles: [][3]int32{{0, 1, 2}},
+	}
+	binary_path := filepath.Join(dir, "binary.ply")
+	if err := write_ply(binary_path, mesh); err != nil {
+		t.Fatal(err)
+	}
+	balls, err = load_points(binary_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balls) != 3 || balls[2].C != mesh.positions[2] || balls[2].R != 0 {
+		t.Errorf("binary ply: got %v", balls)
+	}
+}
+
+func TestLoadPointsWeight(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"zero.csv":     "0,0,0,0.5,1\n1,2,3,0.5,0\n",
+		"negative.csv": "x,y,z,radius,weight\n1,2,3,0.5,-2\n",
+		"zero.ply": "ply\nformat ascii 1.0\nelement vertex 2\nproperty float x\nproperty float y\nproperty float z\n" +
+			"property float weight\nend_header\n1 2 3 1\n4 5 6 0\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// the error names the row, the second one in every file
+		_, err := load_points(path)
+		if err == nil || !strings.Contains(err.Error(), "weight") || !strings.Contains(err.Error(), map[string]string{".csv": ":2:", ".ply": "vertex 1"}[filepath.Ext(name)]) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// a header claiming far more vertices than the file holds fails when the file ends, without allocating for the claim
+func TestLoadPointsShort(t *testing.T) {
+	dir := t.TempDir()
+	header := "element vertex 2000000000\nproperty float x\nproperty float y\nproperty float z\nend_header\n"
+	var vertex bytes.Buffer
+	binary.Write(&vertex, binary.LittleEndian, [3]float32{1, 2, 3})
+	for name, data := range map[string]string{
+		"ascii.ply":  "ply\nformat ascii 1.0\n" + header + "1 2 3\n",
+		"binary.ply": "ply\nformat binary_little_endian 1.0\n" + header + vertex.String() + "\x00\x00",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := load_points(path); err == nil || !strings.Contains(err.Error(), "after 1 of 2000000000 vertices") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	path := filepath.Join(dir, "count.ply")
+	os.WriteFile(path, []byte("ply\nformat ascii 1.0\nelement vertex -3\nproperty float x\nend_header\n"), 0o644)
+	if _, err := load_points(path); err == nil || !strings.Contains(err.Error(), "vertex count") {
+		t.Errorf("negative count: %v", err)
+	}
+}
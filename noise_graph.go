@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Density fields composed from a small graph of nodes: noise sources, fbm, domain warp, math and masks.
+// Graphs are built in code (see density.go) or from the scene file (NoiseNodeDef).
+
+type NoiseNode interface {
+	eval(p Vec3, noises *Noises, time float64) float64
+}
+
+type NoiseKind = int
+
+const (
+	NoiseKind_Gradient   NoiseKind = 0
+	NoiseKind_Value      NoiseKind = 1
+	NoiseKind_Simplex    NoiseKind = 2
+	NoiseKind_PerlinGrid NoiseKind = 3 // pre-calculated grid, coordinates in grid units [0, 1)
+	NoiseKind_TiledGrid  NoiseKind = 4 // pre-calculated tileable grid
+	NoiseKind_Texture    NoiseKind = 5 // 2D texture, coordinates in pixels
+)
+
+var noise_kind_names = map[string]NoiseKind{
+	"gradient":    NoiseKind_Gradient,
+	"value":       NoiseKind_Value,
+	"simplex":     NoiseKind_Simplex,
+	"perlin_grid": NoiseKind_PerlinGrid,
+	"tiled_grid":  NoiseKind_TiledGrid,
+	"texture":     NoiseKind_Texture,
+}
+
+// Samples a noise at p * scale + velocity * time + offset
+type NoiseSourceNode struct {
+	kind     NoiseKind
+	scale    float64
+	offset   Vec3
+	velocity Vec3
+}
+
+func (n *NoiseSourceNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	c := p.Scale(n.scale).Add(n.velocity.Scale(time)).Add(n.offset)
+	switch n.kind {
+	case NoiseKind_Gradient:
+		return noises.fast_noise.gradient3(c.X, c.Y, c.Z)
+	case NoiseKind_Value:
+		return noises.fast_noise.value3(c.X, c.Y, c.Z)
+	case NoiseKind_Simplex:
+		return noises.fast_noise.simplex3(c.X, c.Y, c.Z)
+	case NoiseKind_PerlinGrid:
+		return noises.perlin_values.getFromVectorWrap(c)
+	case NoiseKind_TiledGrid:
+		return noises.perlin_values_tiled.getFromVectorWrap(c)
+	case NoiseKind_Texture:
+		return noises.tex_values.getWrap(int(math.Abs(c.X)), int(math.Abs(c.Y)))
+	}
+	return 0
+}
+
+// Fractal sum of the input evaluated at increasing frequencies, normalized back to the input's range
+type FbmNode struct {
+	input      NoiseNode
+	octaves    int
+	lacunarity float64 // frequency multiplier per octave
+	gain       float64 // amplitude multiplier per octave
+}
+
+func (n *FbmNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	sum := 0.0
+	amplitude := 1.0
+	amplitude_sum := 0.0
+	frequency := 1.0
+	for range n.octaves {
+		sum += amplitude * n.input.eval(p.Scale(frequency), noises, time)
+		amplitude_sum += amplitude
+		amplitude *= n.gain
+		frequency *= n.lacunarity
+	}
+	return sum / amplitude_sum
+}
+
+// Offsets the sample point by a vector noise field before evaluating the input
+type DomainWarpNode struct {
+	input     NoiseNode
+	scale     float64 // frequency of the warp field
+	amplitude float64 // max offset in world units
+	wind      Vec3    // warp field velocity
+}
+
+func (n *DomainWarpNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	q := domain_warp(p, n.scale, n.amplitude, n.wind, noises, time)
+	return n.input.eval(q, noises, time)
+}
+
+// Swirls the sample point through a curl-noise field before evaluating the input
+type CurlWarpNode struct {
+	input     NoiseNode
+	scale     float64 // frequency of the curl field
+	amplitude float64 // total advection distance
+	steps     int
+	wind      Vec3 // curl field velocity
+}
+
+func (n *CurlWarpNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	q := curl_advect(p, n.scale, n.amplitude, n.steps, n.wind, noises, time)
+	return n.input.eval(q, noises, time)
+}
+
+type RemapNode struct {
+	input                            NoiseNode
+	in_min, in_max, out_min, out_max float64
+}
+
+func (n *RemapNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	return remap(n.input.eval(p, noises, time), n.in_min, n.in_max, n.out_min, n.out_max)
+}
+
+type MultiplyNode struct {
+	inputs []NoiseNode
+}
+
+func (n *MultiplyNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	v := 1.0
+	for _, input := range n.inputs {
+		v *= input.eval(p, noises, time)
+		if v == 0 {
+			break // masks are often zero, skip the rest
+		}
+	}
+	return v
+}
+
+// Weighted sum, weights default to 1
+type AddNode struct {
+	inputs  []NoiseNode
+	weights []float64
+}
+
+func (n *AddNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	v := 0.0
+	for i, input := range n.inputs {
+		w := 1.0
+		if i < len(n.weights) {
+			w = n.weights[i]
+		}
+		v += w * input.eval(p, noises, time)
+	}
+	return v
+}
+
+type ClampNode struct {
+	input    NoiseNode
+	min, max float64
+}
+
+func (n *ClampNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	return clamp(n.input.eval(p, noises, time), n.min, n.max)
+}
+
+type ConstantNode struct {
+	value float64
+}
+
+func (n *ConstantNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	return n.value
+}
+
+// 0 below bottom and above top, ramping to 1 over fade distance inside the band
+type HeightGradientNode struct {
+	bottom, top, fade float64
+}
+
+func (n *HeightGradientNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	return linear_step(n.bottom, n.bottom+n.fade, p.Y) * (1 - linear_step(n.top-n.fade, n.top, p.Y))
+}
+
+// 1 deep inside a sphere, fading to 0 over width towards its surface
+type SdfFalloffNode struct {
+	center Vec3
+	radius float64
+	width  float64
+}
+
+func (n *SdfFalloffNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	sdf := sdfSphere(p.Sub(n.center), n.radius)
+	return linear_step(0, n.width, -sdf)
+}
+
+// Evaluates the input where the air at p was, moving through the scene's wind at speed times the wind velocity
+type WindAdvectNode struct {
+	input    NoiseNode
+	speed    float64
+	altitude float64 // the clouds travel with the wind at this height and lean with the shear around it
+}
+
+func (n *WindAdvectNode) eval(p Vec3, noises *Noises, time float64) float64 {
+	return n.input.eval(noises.wind.advect(p, noises, time, n.speed, n.altitude), noises, time)
+}
+
+// Scene file representation of a node, see build_noise_node for defaults
+type NoiseNodeDef struct {
+	Type string `json:"type"`
+
+	// source
+	Noise    string     `json:"noise,omitempty"`
+	Scale    float64    `json:"scale,omitempty"`
+	Offset   [3]float64 `json:"offset,omitempty"`
+	Velocity [3]float64 `json:"velocity,omitempty"`
+
+	// fbm
+	Octaves    int     `json:"octaves,omitempty"`
+	Lacunarity float64 `json:"lacunarity,omitempty"`
+	Gain       float64 `json:"gain,omitempty"`
+
+	// domain warp, curl warp
+	Amplitude float64    `json:"amplitude,omitempty"`
+	Steps     int        `json:"steps,omitempty"`
+	Wind      [3]float64 `json:"wind,omitempty"`
+
+	// wind
+	Speed    float64 `json:"speed,omitempty"`
+	Altitude float64 `json:"altitude,omitempty"`
+
+	// remap
+	InMin  float64 `json:"in_min,omitempty"`
+	InMax  float64 `json:"in_max,omitempty"`
+	OutMin float64 `json:"out_min,omitempty"`
+	OutMax float64 `json:"out_max,omitempty"`
+
+	// clamp
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// add
+	Weights []float64 `json:"weights,omitempty"`
+
+	// constant
+	Value float64 `json:"value,omitempty"`
+
+	// height gradient
+	Bottom float64 `json:"bottom,omitempty"`
+	Top    float64 `json:"top,omitempty"`
+	Fade   float64 `json:"fade,omitempty"`
+
+	// sdf falloff
+	Center [3]float64 `json:"center,omitempty"`
+	Radius float64    `json:"radius,omitempty"`
+	Width  float64    `json:"width,omitempty"`
+
+	Input  *NoiseNodeDef  `json:"input,omitempty"`
+	Inputs []NoiseNodeDef `json:"inputs,omitempty"`
+}
+
+func build_noise_node(def *NoiseNodeDef) (NoiseNode, error) {
+	input := func() (NoiseNode, error) {
+		if def.Input == nil {
+			return nil, fmt.Errorf("%s node needs an input", def.Type)
+		}
+		return build_noise_node(def.Input)
+	}
+	inputs := func() ([]NoiseNode, error) {
+		if len(def.Inputs) == 0 {
+			return nil, fmt.Errorf("%s node needs inputs", def.Type)
+		}
+		nodes := make([]NoiseNode, len(def.Inputs))
+		for i := range def.Inputs {
+			node, err := build_noise_node(&def.Inputs[i])
+			if err != nil {
+				return nil, err
+			}
+			nodes[i] = node
+		}
+		return nodes, nil
+	}
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	vec := func(v [3]float64) Vec3 {
+		return Vec3{v[0], v[1], v[2]}
+	}
+
+	switch def.Type {
+	case "source":
+		kind, ok := noise_kind_names[def.Noise]
+		if !ok {
+			return nil, fmt.Errorf("unknown noise %q", def.Noise)
+		}
+		return &NoiseSourceNode{
+			kind:     kind,
+			scale:    or_default(def.Scale, 1),
+			offset:   vec(def.Offset),
+			velocity: vec(def.Velocity),
+		}, nil
+	case "fbm":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		octaves := def.Octaves
+		if octaves <= 0 {
+			octaves = 4
+		}
+		return &FbmNode{
+			input:      in,
+			octaves:    octaves,
+			lacunarity: or_default(def.Lacunarity, 2),
+			gain:       or_default(def.Gain, 0.5),
+		}, nil
+	case "domain_warp":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		return &DomainWarpNode{
+			input:     in,
+			scale:     or_default(def.Scale, 1),
+			amplitude: or_default(def.Amplitude, 0.1),
+			wind:      vec(def.Wind),
+		}, nil
+	case "curl_warp":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		steps := def.Steps
+		if steps <= 0 {
+			steps = 2
+		}
+		return &CurlWarpNode{
+			input:     in,
+			scale:     or_default(def.Scale, 1),
+			amplitude: or_default(def.Amplitude, 0.1),
+			steps:     steps,
+			wind:      vec(def.Wind),
+		}, nil
+	case "wind":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		return &WindAdvectNode{input: in, speed: or_default(def.Speed, 1), altitude: def.Altitude}, nil
+	case "remap":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		if def.InMin == def.InMax {
+			return nil, fmt.Errorf("remap needs in_min != in_max")
+		}
+		return &RemapNode{
+			input:   in,
+			in_min:  def.InMin,
+			in_max:  def.InMax,
+			out_min: def.OutMin,
+			out_max: def.OutMax,
+		}, nil
+	case "clamp":
+		in, err := input()
+		if err != nil {
+			return nil, err
+		}
+		n := &ClampNode{input: in, min: 0, max: 1}
+		if def.Min != nil {
+			n.min = *def.Min
+		}
+		if def.Max != nil {
+			n.max = *def.Max
+		}
+		return n, nil
+	case "multiply":
+		ins, err := inputs()
+		if err != nil {
+			return nil, err
+		}
+		return &MultiplyNode{inputs: ins}, nil
+	case "add":
+		ins, err := inputs()
+		if err != nil {
+			return nil, err
+		}
+		return &AddNode{inputs: ins, weights: def.Weights}, nil
+	case "constant":
+		return &ConstantNode{value: def.Value}, nil
+	case "height_gradient":
+		if def.Top <= def.Bottom {
+			return nil, fmt.Errorf("height_gradient needs top > bottom")
+		}
+		return &HeightGradientNode{
+			bottom: def.Bottom,
+			top:    def.Top,
+			fade:   or_default(def.Fade, (def.Top-def.Bottom)*0.1),
+		}, nil
+	case "sdf_falloff":
+		return &SdfFalloffNode{
+			center: vec(def.Center),
+			radius: or_default(def.Radius, 1),
+			width:  or_default(def.Width, 0.2),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown node type %q", def.Type)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// noise grids filled with random values, what the graphs sample doesn't matter to them
+func test_noises() *Noises {
+	rng := rand.New(rand.NewSource(5))
+	grid := NewMatrix3D[float64](16, 16, 16)
+	for i := range grid.values {
+		grid.values[i] = rng.Float64()*1.4 - 0.2
+	}
+	tex := NewDataMatrix[float64](32, 32)
+	for i := range tex.values {
+		tex.values[i] = rng.Float64()
+	}
+	return &Noises{perlin_values: grid, perlin_values_tiled: grid, tex_values: tex, fast_noise: NewFastNoise(1234)}
+}
+
+func build_noise_json(t *testing.T, s string) (NoiseNode, error) {
+	t.Helper()
+	var def NoiseNodeDef
+	if err := json.Unmarshal([]byte(s), &def); err != nil {
+		t.Fatal(err)
+	}
+	return build_noise_node(&def)
+}
+
+func TestNoiseGraphDefaults(t *testing.T) {
+	node, err := build_noise_json(t, `{"type": "fbm", "input": {"type": "source", "noise": "gradient"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fbm := node.(*FbmNode)
+	if fbm.octaves != 4 || fbm.lacunarity != 2 || fbm.gain != 0.5 {
+		t.Errorf("fbm defaults %+v", fbm)
+	}
+	if source := fbm.input.(*NoiseSourceNode); source.kind != NoiseKind_Gradient || source.scale != 1 {
+		t.Errorf("source defaults %+v", source)
+	}
+
+	node, _ = build_noise_json(t, `{"type": "curl_warp", "input": {"type": "constant", "value": 0.3}}`)
+	if warp := node.(*CurlWarpNode); warp.scale != 1 || warp.amplitude != 0.1 || warp.steps != 2 {
+		t.Errorf("curl_warp defaults %+v", warp)
+	}
+	node, _ = build_noise_json(t, `{"type": "clamp", "input": {"type": "constant", "value": 3}}`)
+	if clamp := node.(*ClampNode); clamp.min != 0 || clamp.max != 1 {
+		t.Errorf("clamp defaults %+v", clamp)
+	}
+	// an explicit 0 bound is kept
+	node, _ = build_noise_json(t, `{"type": "clamp", "min": -1, "max": 0, "input": {"type": "constant", "value": 3}}`)
+	if v := node.eval(Vec3{}, nil, 0); v != 0 {
+		t.Errorf("clamp to [-1, 0] gave %v", v)
+	}
+	node, _ = build_noise_json(t, `{"type": "height_gradient", "bottom": 1, "top": 3}`)
+	if h := node.(*HeightGradientNode); math.Abs(h.fade-0.2) > 1e-12 {
+		t.Errorf("height_gradient fade %v, want a tenth of the height", h.fade)
+	}
+	node, _ = build_noise_json(t, `{"type": "sdf_falloff"}`)
+	if s := node.(*SdfFalloffNode); s.radius != 1 || s.width != 0.2 {
+		t.Errorf("sdf_falloff defaults %+v", s)
+	}
+}
+
+func TestNoiseGraphErrors(t *testing.T) {
+	for _, c := range []struct{ def, want string }{
+		{`{"type": "blur"}`, `unknown node type "blur"`},
+		{`{"type": "source", "noise": "worley"}`, `unknown noise "worley"`},
+		{`{"type": "fbm"}`, "fbm node needs an input"},
+		{`{"type": "domain_warp"}`, "domain_warp node needs an input"},
+		{`{"type": "clamp"}`, "clamp node needs an input"},
+		{`{"type": "add"}`, "add node needs inputs"},
+		{`{"type": "multiply", "inputs": []}`, "multiply node needs inputs"},
+		{`{"type": "fbm", "input": {"type": "add", "inputs": [{"type": "nope"}]}}`, `unknown node type "nope"`},
+		{`{"type": "remap", "in_min": 1, "in_max": 1, "input": {"type": "constant"}}`, "in_min != in_max"},
+		{`{"type": "height_gradient", "bottom": 2, "top": 1}`, "top > bottom"},
+	} {
+		if _, err := build_noise_json(t, c.def); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: error %v, want %q", c.def, err, c.want)
+		}
+	}
+}
+
+// The graphs the density types are made of give what the hand-written functions they replaced gave, and so does
+// the same graph written in a scene file
+func TestNoiseGraphMatchesLegacy(t *testing.T) {
+	noises := test_noises()
+	legacy_pre_calc_1 := func(point Vec3, time float64) float64 {
+		phase := time * 0.08
+		coords := point.Scale(0.8).Add(Vec3{phase * 1, phase * 0, phase * 2}).Add(Vec3{0.2, 0.2, 0.2})
+		return clamp01(noises.perlin_values.getFromVectorWrap(coords))
+	}
+	legacy_pre_calc_2 := func(point Vec3, time float64) float64 {
+		phase := time * 0.08
+		sample := func(scale float64) float64 {
+			coords := point.Scale(scale).Add(Vec3{phase * 1, phase * 0, phase * 2}).Add(Vec3{0.05, 0.1, 0.15})
+			return clamp01(noises.perlin_values.getFromVectorWrap(coords))
+		}
+		return mix(sample(0.4), sample(0.8), 0.5)
+	}
+	legacy_2D_texture := func(point Vec3, time float64) float64 {
+		phase := time * 4
+		x := int(math.Abs(point.X*20 + phase))
+		y := int(math.Abs(point.Y*20 + phase))
+		return noises.tex_values.getWrap(x, y)
+	}
+	from_scene, err := build_noise_json(t, `{"type": "add", "weights": [0.5, 0.5], "inputs": [
+		{"type": "clamp", "input": {"type": "source", "noise": "perlin_grid", "scale": 0.4, "velocity": [0.08, 0, 0.16], "offset": [0.05, 0.1, 0.15]}},
+		{"type": "clamp", "input": {"type": "source", "noise": "perlin_grid", "scale": 0.8, "velocity": [0.08, 0, 0.16], "offset": [0.05, 0.1, 0.15]}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(6))
+	for range 200 {
+		p := Vec3{rng.Float64()*4 - 2, rng.Float64()*4 - 2, rng.Float64()*4 - 2}
+		time := rng.Float64() * 10
+		for _, c := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"pre_calc_perlin_1", sample_density_pre_calc_perlin_1(p, noises, time), legacy_pre_calc_1(p, time)},
+			{"pre_calc_perlin_2", sample_density_pre_calc_perlin_2(p, noises, time), legacy_pre_calc_2(p, time)},
+			{"scene file pre_calc_perlin_2", from_scene.eval(p, noises, time), legacy_pre_calc_2(p, time)},
+			{"2D_texture", sample_density_2D_texture(p, noises, time), legacy_2D_texture(p, time)},
+		} {
+			if math.Abs(c.got-c.want) > 1e-12 {
+				t.Fatalf("%s at %v, %vs: %v, the legacy function gives %v", c.name, p, time, c.got, c.want)
+			}
+		}
+	}
+}
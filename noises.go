@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"path/filepath"
 
 	"github.com/aquilax/go-perlin"
 	rl "github.com/gen2brain/raylib-go/raylib"
@@ -11,7 +12,11 @@ type Noises struct {
 	tex_values          *Matrix2D[float64]
 	perlin_values       *Matrix3D[float64]
 	perlin_values_tiled *Matrix3D[float64]
-	perlin_gen          *perlin.Perlin
+	fast_noise          *FastNoise
+	density_graph       NoiseNode    // from the scene file, nil if not defined
+	voxel_volume        *VoxelVolume // from the scene file, nil if not defined
+	wind                *WindField   // advects the densities that use it, nil for none
+	fluid               *FluidSim    // from the scene file, or created by the fluid density keys
 }
 
 func NewNoises() *Noises {
@@ -23,63 +28,86 @@ func NewNoises() *Noises {
 		noise_values.values[i] = float64(noise_pixels[i].R) / 255.0
 	}
 
-	// does not tile, blocky appearance
-	var perlin_pre_gen = perlin.NewPerlin(0.8, 1, 2, 1234) // contrast, zoom, iterations (details), seed
-	dim := 128
-	w, h, d := dim, dim, dim
-	perlin_scale := 8.0
-	perlin_values := NewMatrix3D[float64](w, h, d)
-	// easing_treshold := 0.2
-	for y := range h {
-		for x := range w {
-			for z := range d {
-
-				xf := float64(x) / float64(w)
-				yf := float64(y) / float64(h)
-				zf := float64(z) / float64(d)
-
-				xv := xf * perlin_scale
-				yv := yf * perlin_scale
-				zv := zf * perlin_scale
-
-				val := clamp01(perlin_pre_gen.Noise3D(xv, yv, zv))
-
-				// apply fade-out towards edges to fake tiling
-				xs := circular_out(xf)
-				ys := circular_out(yf)
-				zs := circular_out(zf)
-				fade := min(min(xs, ys), zs)
-				val *= fade
-
-				perlin_values.set(val, x, y, z)
-			}
-		}
-	}
-
-	// doesn't look good
-	perlin_values_tiled := NewMatrix3D[float64](w, h, d)
-	for y := range h {
-		for x := range w {
-			for z := range d {
-				xf := float64(x) / float64(w)
-				yf := float64(y) / float64(h)
-				zf := float64(z) / float64(d)
-				val := perlin_tiled(xf, yf, zf, perlin_pre_gen)
-				perlin_values_tiled.set(val, x, y, z)
-			}
-		}
-	}
+	perlin_values := load_or_generate_volume(
+		filepath.Join(noise_cache_dir, "perlin_values.gcvol"), perlin_values_params, generate_perlin_faded)
+	perlin_values_tiled := load_or_generate_volume(
+		filepath.Join(noise_cache_dir, "perlin_values_tiled.gcvol"), perlin_values_tiled_params, generate_perlin_tiled)
 
-	var perlin_gen = perlin.NewPerlin(0.2, 1.0, 1, 1234) // contrast, zoom, iterations (details), seed
+	fast_noise := NewFastNoise(1234)
+	wind := default_wind
 
 	return &Noises{
 		tex_values:          noise_values,
 		perlin_values:       perlin_values,
 		perlin_values_tiled: perlin_values_tiled,
-		perlin_gen:          perlin_gen,
+		fast_noise:          fast_noise,
+		wind:                &wind,
 	}
 }
 
+// does not tile, blocky appearance
+var perlin_values_params = NoiseGridParams{
+	Generator:  "perlin_faded",
+	Dim:        128,
+	Alpha:      0.8, // contrast
+	Beta:       1,   // zoom
+	Iterations: 2,   // details
+	Scale:      8.0,
+	Seed:       1234,
+}
+
+// doesn't look good
+var perlin_values_tiled_params = NoiseGridParams{
+	Generator:  "perlin_tiled",
+	Dim:        128,
+	Alpha:      0.8,
+	Beta:       1,
+	Iterations: 2,
+	Seed:       1234,
+}
+
+func generate_perlin_faded(params NoiseGridParams, progress func(done, total int)) *Matrix3D[float64] {
+	perlin_pre_gen := perlin.NewPerlin(params.Alpha, params.Beta, params.Iterations, params.Seed)
+	dim := params.Dim
+	w, h, d := dim, dim, dim
+	perlin_scale := params.Scale
+	perlin_values := NewMatrix3D[float64](w, h, d)
+	// easing_treshold := 0.2
+	fill_matrix3D_parallel(perlin_values, bake_workers, progress, func(x, y, z int) float64 {
+		xf := float64(x) / float64(w)
+		yf := float64(y) / float64(h)
+		zf := float64(z) / float64(d)
+
+		xv := xf * perlin_scale
+		yv := yf * perlin_scale
+		zv := zf * perlin_scale
+
+		val := clamp01(perlin_pre_gen.Noise3D(xv, yv, zv))
+
+		// apply fade-out towards edges to fake tiling
+		xs := circular_out(xf)
+		ys := circular_out(yf)
+		zs := circular_out(zf)
+		fade := min(min(xs, ys), zs)
+		return val * fade
+	})
+	return perlin_values
+}
+
+func generate_perlin_tiled(params NoiseGridParams, progress func(done, total int)) *Matrix3D[float64] {
+	perlin_pre_gen := perlin.NewPerlin(params.Alpha, params.Beta, params.Iterations, params.Seed)
+	dim := params.Dim
+	w, h, d := dim, dim, dim
+	perlin_values_tiled := NewMatrix3D[float64](w, h, d)
+	fill_matrix3D_parallel(perlin_values_tiled, bake_workers, progress, func(x, y, z int) float64 {
+		xf := float64(x) / float64(w)
+		yf := float64(y) / float64(h)
+		zf := float64(z) / float64(d)
+		return perlin_tiled(xf, yf, zf, perlin_pre_gen)
+	})
+	return perlin_values_tiled
+}
+
 // https://gamedev.stackexchange.com/a/23679
 func perlin_tiled(x, y, z float64, perlin_generator *perlin.Perlin) float64 {
 	// x, y, z must be between 0 and 1
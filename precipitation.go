@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// Rain and virga: streaky, vertically stretched shafts of low density hanging below the cloud layer's base where
+// the weather map precipitates. They lean with the wind as the drops fall, and evaporate on the way down, light
+// rain soon after leaving the cloud and the heaviest after falling `reach` of the way to the ground.
+
+type RainShafts struct {
+	threshold  float64 // precipitation that stays inside the cloud
+	density    float64 // extinction of the heaviest rain, per unit distance
+	color      Vec3    // scattering color, greyer than the clouds
+	reach      float64 // fraction of the height of the cloud base
+	streaks    NoiseNode
+	stretch    float64 // vertical frequency of the streak noise relative to the horizontal one
+	fall_speed float64 // world units per second, slants the shafts in the wind and moves the streaks
+}
+
+func (r *RainShafts) density_at(l *CloudLayer, p Vec3, noises *Noises, time float64) float64 {
+	alt := l.altitude(p)
+	if alt <= 0 || alt >= l.bottom {
+		return 0
+	}
+	// where the drops at p left the cloud
+	fall := l.bottom - alt
+	drift := noises.wind.velocity((alt + l.bottom) / 2).Scale(fall / r.fall_speed)
+	origin := p.Sub(Vec3{drift.X, 0, drift.Z})
+	w := l.weather.sample(origin.X, origin.Z)
+	amount := clamp01(remap(w.precipitation, r.threshold, 1, 0, 1))
+	if amount <= 0 {
+		return 0
+	}
+	reach := r.reach * (0.3 + 0.7*amount)
+	evaporated := linear_step(reach*0.3, reach, fall/l.bottom)
+	if evaporated >= 1 {
+		return 0
+	}
+	streak_p := Vec3{origin.X, (p.Y + time*r.fall_speed) * r.stretch, origin.Z}
+	streak := clamp01(remap(r.streaks.eval(streak_p, noises, time), 0.35, 0.7, 0, 1))
+	return r.density * amount * (1 - evaporated) * streak
+}
+
+// Sun and sky light falling on rain at p, through the clouds above it
+func (r *RainShafts) light_at(l *CloudLayer, p Vec3, noises *Noises, time float64) float64 {
+	sky := LAYER_AMBIENT * 0.5 // under the clouds
+	if l.sun_dir.Y <= 0 {
+		return sky
+	}
+	base := p.Add(l.sun_dir.Scale((l.bottom - l.altitude(p)) / max(l.sun_dir.Y, 0.05)))
+	return sky + beers_law(l.optical_depth_to_sun(base, noises, time), 1)
+}
+
+// Scene file representation of the rain under a cloud layer, see build_rain for defaults
+type RainDef struct {
+	Threshold float64    `json:"threshold,omitempty"`
+	Density   float64    `json:"density,omitempty"`
+	Color     [3]float64 `json:"color,omitempty"`
+	Reach     float64    `json:"reach,omitempty"`
+	Scale     float64    `json:"scale,omitempty"`   // streak noise frequency
+	Stretch   float64    `json:"stretch,omitempty"` // vertical frequency relative to scale, small makes long streaks
+	FallSpeed float64    `json:"fall_speed,omitempty"`
+}
+
+func build_rain(def *RainDef) (*RainShafts, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	r := RainShafts{
+		threshold:  or_default(def.Threshold, 0.1),
+		density:    or_default(def.Density, 3),
+		color:      Vec3{0.55, 0.58, 0.62},
+		reach:      or_default(def.Reach, 1),
+		streaks:    cloud_layer_noise(or_default(def.Scale, 3), 2),
+		stretch:    or_default(def.Stretch, 0.08),
+		fall_speed: or_default(def.FallSpeed, 2),
+	}
+	if def.Color != ([3]float64{}) {
+		r.color = Vec3{def.Color[0], def.Color[1], def.Color[2]}
+	}
+	if r.threshold >= 1 || r.threshold < 0 {
+		return nil, fmt.Errorf("threshold %v must be in [0, 1)", r.threshold)
+	}
+	return &r, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRainShafts(t *testing.T) {
+	layer, err := build_cloud_layer(&CloudLayerDef{Bottom: 2, Top: 4, Weather: WeatherMapDef{Resolution: 4}, Rain: &RainDef{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noises := &Noises{fast_noise: NewFastNoise(1)}
+	// no wind so the shafts hang straight under the rain
+	rain_at := func(precipitation float32) func(p Vec3) float64 {
+		for i := range layer.weather.precipitation.values {
+			layer.weather.precipitation.values[i] = precipitation
+		}
+		return func(p Vec3) float64 {
+			return layer.rain.density_at(layer, p, noises, 0)
+		}
+	}
+
+	density := rain_at(0)
+	for x := range 20 {
+		if d := density(Vec3{float64(x) * 0.37, 1.5, 0}); d != 0 {
+			t.Fatalf("rain %v without precipitation", d)
+		}
+	}
+
+	density = rain_at(1)
+	total := func(alt float64) float64 {
+		sum := 0.0
+		for x := range 200 {
+			for z := range 10 {
+				sum += density(Vec3{float64(x) * 0.13, alt, float64(z) * 0.71})
+			}
+		}
+		return sum
+	}
+	under_base, halfway, near_ground := total(1.9), total(1), total(0.1)
+	if under_base <= 0 {
+		t.Fatal("no rain under the base")
+	}
+	if !(under_base > halfway && halfway > near_ground) {
+		t.Errorf("rain doesn't thin out towards the ground: %.1f, %.1f, %.1f", under_base, halfway, near_ground)
+	}
+	if d := total(2.5); d != 0 {
+		t.Errorf("rain %v inside the cloud", d)
+	}
+
+	layer.rain.reach = 0.4 // virga
+	if d := total(0.5); d != 0 {
+		t.Errorf("virga reaches %v down to the ground", d)
+	}
+}
+
+// Rain is opt in, a layer without a rain object has none
+func TestRainOptIn(t *testing.T) {
+	layer, err := build_cloud_layer(&CloudLayerDef{Preset: "cumulonimbus", Weather: WeatherMapDef{Resolution: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.rain != nil {
+		t.Error("rain without a rain object")
+	}
+	var def CloudLayerDef
+	if err := json.Unmarshal([]byte(`{"preset": "cumulonimbus", "weather": {"resolution": 4}, "rain": {}}`), &def); err != nil {
+		t.Fatal(err)
+	}
+	if layer, err = build_cloud_layer(&def); err != nil || layer.rain == nil || layer.rain.threshold != 0.1 {
+		t.Errorf("an empty rain object doesn't give the default rain: %v", err)
+	}
+}
@@ -5,9 +5,14 @@ package main
 // go tool pprof -http=:8080 cpu.prof
 
 import (
+	"math"
+	"math/rand"
 	"os"
 	"runtime/pprof"
+	"slices"
 	"testing"
+
+	"github.com/aquilax/go-perlin"
 )
 
 func BenchmarkProf(b *testing.B) {
@@ -17,6 +22,64 @@ func BenchmarkProf(b *testing.B) {
 	}
 	defer f.Close()
 
+	render_parameters := bench_render_parameters()
+
+	pprof.StartCPUProfile(f)
+	for b.Loop() {
+		ray_march(render_parameters)
+	}
+	pprof.StopCPUProfile()
+}
+
+// full frame with the runtime density, noise carried by the wind evaluated per sample
+func BenchmarkProf_PerlinRuntime(b *testing.B) {
+	render_parameters := bench_render_parameters()
+	prev_density_type := density_type
+	density_type = DensityType_PerlinRuntime
+	defer func() { density_type = prev_density_type }()
+
+	for b.Loop() {
+		ray_march(render_parameters)
+	}
+}
+
+// the runtime density as it was before the wind, two clamped octaves, with go-perlin and with the native noise.
+// go test -bench 'Prof_.*Perlin'
+func BenchmarkProf_GoPerlin(b *testing.B) {
+	gen := perlin.NewPerlin(0.2, 1.0, 1, 1234)
+	bench_noise_frame(b, &two_octave_node{noise: gen.Noise3D})
+}
+
+func BenchmarkProf_NativePerlin(b *testing.B) {
+	gen := NewFastNoise(1234)
+	bench_noise_frame(b, &two_octave_node{noise: gen.gradient3})
+}
+
+type two_octave_node struct {
+	noise func(x, y, z float64) float64
+}
+
+func (n *two_octave_node) eval(p Vec3, noises *Noises, time float64) float64 {
+	phase := time * 0.5
+	p1 := clamp01(n.noise(p.X*2+phase, p.Y*2, p.Z*2+phase*2))
+	phase = time
+	p2 := clamp01(n.noise(p.X*7+phase, p.Y*7, math.Abs(p.Z)*7+phase)) // go-perlin falls back to 3D for z < 0
+	return mix(p1, p2, 0.5)
+}
+
+func bench_noise_frame(b *testing.B, density NoiseNode) {
+	render_parameters := bench_render_parameters()
+	render_parameters.noises.density_graph = density
+	prev_density_type := density_type
+	density_type = DensityType_Graph
+	defer func() { density_type = prev_density_type }()
+
+	for b.Loop() {
+		ray_march(render_parameters)
+	}
+}
+
+func bench_render_parameters() *RenderParameters {
 	screen_w := 640
 	screen_h := 480
 	pixel_count := screen_w * screen_h
@@ -44,18 +107,157 @@ func BenchmarkProf(b *testing.B) {
 		R: 1,
 	}
 
-	render_parameters := RenderParameters{
+	return &RenderParameters{
 		img:    &image_target,
 		camera: &camera,
 		light:  &light,
-		sphere: &sphere,
+		shape:  &sphere,
 		noises: noises,
 		time:   0.0,
 	}
+}
 
-	pprof.StartCPUProfile(f)
+var bench_noise_sink float64
+
+// sample points spread over a few lattice cells, same for every noise benchmark
+func bench_noise_points() [][3]float64 {
+	points := make([][3]float64, 4096)
+	for i := range points {
+		f := float64(i)
+		points[i] = [3]float64{f*0.0137 - 20, f*0.0291 + 3, f * 0.0173}
+	}
+	return points
+}
+
+// the generator sample_density_runtime_perlin used before the native noise
+func BenchmarkNoise3D_GoPerlin(b *testing.B) {
+	gen := perlin.NewPerlin(0.2, 1.0, 1, 1234)
+	points := bench_noise_points()
+	i := 0
 	for b.Loop() {
-		ray_march(&render_parameters)
+		p := points[i&4095]
+		bench_noise_sink += gen.Noise3D(p[0], p[1], p[2])
+		i++
 	}
-	pprof.StopCPUProfile()
+}
+
+func BenchmarkNoise3D_Gradient(b *testing.B) {
+	gen := NewFastNoise(1234)
+	points := bench_noise_points()
+	i := 0
+	for b.Loop() {
+		p := points[i&4095]
+		bench_noise_sink += gen.gradient3(p[0], p[1], p[2])
+		i++
+	}
+}
+
+func BenchmarkNoise3D_GradientDeriv(b *testing.B) {
+	gen := NewFastNoise(1234)
+	points := bench_noise_points()
+	i := 0
+	for b.Loop() {
+		p := points[i&4095]
+		v, dx, dy, dz := gen.gradient3_deriv(p[0], p[1], p[2])
+		bench_noise_sink += v + dx + dy + dz
+		i++
+	}
+}
+
+func BenchmarkNoise3D_Value(b *testing.B) {
+	gen := NewFastNoise(1234)
+	points := bench_noise_points()
+	i := 0
+	for b.Loop() {
+		p := points[i&4095]
+		bench_noise_sink += gen.value3(p[0], p[1], p[2])
+		i++
+	}
+}
+
+func BenchmarkNoise3D_Simplex(b *testing.B) {
+	gen := NewFastNoise(1234)
+	points := bench_noise_points()
+	i := 0
+	for b.Loop() {
+		p := points[i&4095]
+		bench_noise_sink += gen.simplex3(p[0], p[1], p[2])
+		i++
+	}
+}
+
+func BenchmarkNoise3D_Curl(b *testing.B) {
+	gen := NewFastNoise(1234)
+	points := bench_noise_points()
+	i := 0
+	for b.Loop() {
+		p := points[i&4095]
+		cx, cy, cz := gen.curl3(p[0], p[1], p[2])
+		bench_noise_sink += cx + cy + cz
+		i++
+	}
+}
+
+// frame with the light transmittance looked up in a shadow grid, built before the timer starts. Also reports the
+// error against the same frame marched to the light, as mean_error and worst_error of a color channel in [0, 1].
+// go test -bench 'Prof$|Prof_ShadowGrid'
+func BenchmarkProf_ShadowGrid(b *testing.B) {
+	render_parameters := bench_render_parameters()
+	ray_march(render_parameters)
+	full := slices.Clone(render_parameters.img.Pixels)
+	render_parameters.shadow_grid, _ = build_shadow_grid(&ShadowGridDef{})
+	render_parameters.shadow_grid.update(render_parameters)
+
+	for b.Loop() {
+		ray_march(render_parameters)
+	}
+	mean, worst, _ := shadow_grid_error(full, render_parameters.img.Pixels)
+	b.ReportMetric(mean, "mean_error")
+	b.ReportMetric(worst, "worst_error")
+}
+
+// sdf of a field of 1k cloud volumes through the hierarchy, and testing every volume
+// go test -bench VolumeSet
+func BenchmarkVolumeSetSdf(b *testing.B) {
+	s := test_volume_field(1000, Vec3{})
+	rng := rand.New(rand.NewSource(1))
+	points := make([]Vec3, 1024)
+	for i := range points {
+		points[i] = Vec3{rng.Float64()*8 - 4, rng.Float64() - 0.5, rng.Float64()*8 - 10}
+	}
+	b.Run("bvh", func(b *testing.B) {
+		i := 0
+		for b.Loop() {
+			s.sdf(points[i%len(points)])
+			i++
+		}
+	})
+	b.Run("every volume", func(b *testing.B) {
+		i := 0
+		for b.Loop() {
+			volume_set_sdf_every(s, points[i%len(points)])
+			i++
+		}
+	})
+}
+
+// full frame looking into a deck of 1k drifting cloud volumes, a bit further every frame
+func BenchmarkProf_VolumeSet(b *testing.B) {
+	render_parameters := bench_render_parameters()
+	render_parameters.shape = test_volume_field(1000, Vec3{0.3, 0, 0.1})
+	for b.Loop() {
+		render_parameters.time += 1.0 / 30
+		ray_march(render_parameters)
+	}
+}
+
+// moving 1k volumes and refitting, or rebuilding, the hierarchy
+func BenchmarkVolumeSetAdvance(b *testing.B) {
+	s := test_volume_field(1000, Vec3{0.3, 0, 0.1})
+	t := 0.0
+	for b.Loop() {
+		t += 1.0 / 30
+		s.advance(t)
+	}
+	b.ReportMetric(float64(s.bvh.rebuilds)/float64(b.N), "rebuilds/op")
 }
@@ -4,6 +4,7 @@ import (
 	"math"
 	"runtime"
 	"sync"
+	"time"
 )
 
 func ray_march(render_params *RenderParameters) {
@@ -27,6 +28,12 @@ func ray_march(render_params *RenderParameters) {
 
 	img := render_params.img
 	camera := *render_params.camera
+	if set, ok := render_params.shape.(*VolumeSet); ok {
+		set.advance(render_params.time)
+	}
+	render_params.macro_grid.update(render_params) // before the shadow grid, its light marches skip empty cells too
+	render_params.shadow_grid.update(render_params)
+	start := time.Now()
 
 	// Multi-goroutine
 	var wg sync.WaitGroup
@@ -36,59 +43,39 @@ func ray_march(render_params *RenderParameters) {
 
 	for y_mark < img.H {
 		wg.Add(1)
-		go func(y_mark int, render_params *RenderParameters) {
+		go func(y_mark int, render_params RenderParameters) { // a copy, solid_depth changes per pixel
 			end := min(y_mark+dH, img.H)
 			for y := y_mark; y < end; y++ {
 				for x := range img.W {
 					ray := camera.MakeRay(x, y, img.W, img.H)
-					colorf := march_volume(&ray, render_params)
+					color_solids, solid_depth := march_solid(&ray, &render_params)
+					render_params.solid_depth = solid_depth
+					var colorf Vec4
+					if render_params.layer != nil {
+						colorf = march_cloud_layer(&ray, &render_params)
+					} else {
+						colorf = march_volume(&ray, &render_params)
+					}
+					colorf = apply_atmosphere(&ray, colorf, color_solids, &render_params)
 					if RENDER_LIGHT_SOURCE {
-						color_light_source := march_light(&ray, render_params)
+						color_light_source := march_light(&ray, &render_params)
 						colorf = colorf.Add(color_light_source)
 					}
-					// color_solids := march_solid(&ray, render_params)
-					// colorf = colorf.Add(color_solids)
 
 					p := pixel_from_fvec4(colorf)
 					img.Pixels[y*img.W+x] = p
 				}
 			}
 			wg.Done()
-		}(y_mark, render_params)
+		}(y_mark, *render_params)
 		y_mark += dH
 	}
 	wg.Wait()
-}
-
-func march_solid(starting_ray *Ray, render_params *RenderParameters) Vec4 {
-	ray := *starting_ray
-	sphere := render_params.sphere
-	light := render_params.light
-	background := Vec4{0, 0, 0, 0}
-	count := 0
-	for {
-		ray_origin_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(ray_origin_in_sphere_space, sphere.R)
-		if sdf < 0.02 {
-			// v := math.Abs(sdf / (sdf + 1))
-			// return Vec3{X: v, Y: v, Z: v}
-
-			// when orientations are introduced, the normals will have to be transformed
-			// as long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-			sphere_normal := ray_origin_in_sphere_space.Sub(sphere.C).Normalized()
-			dir_to_light := light.origin.Sub(ray.origin).Normalized()
-			light_amount := sphere_normal.Dot(dir_to_light)
-			return Vec4{light_amount, light_amount, light_amount, 1.0}
-		}
-
-		// advance ray
-		dv := ray.dir.Scale(sdf)
-		ray.origin = ray.origin.Add(dv)
-
-		if sdf >= 10 || count >= 10 {
-			return background
-		}
-		count++
+	if render_params.god_rays != nil && render_params.god_rays.quality == GodRayQuality_Screen {
+		screen_space_god_rays(render_params)
+	}
+	if g := render_params.shadow_grid; g != nil {
+		g.frame_time = time.Since(start)
 	}
 }
 
@@ -116,6 +103,9 @@ func march_light(starting_ray *Ray, render_params *RenderParameters) Vec4 {
 }
 
 func march_volume(starting_ray *Ray, render_params *RenderParameters) Vec4 {
+	if set, ok := render_params.shape.(*VolumeSet); ok {
+		return march_volume_set(starting_ray, set, render_params)
+	}
 	ray := *starting_ray
 
 	jump_count := 0
@@ -134,31 +124,67 @@ func march_volume(starting_ray *Ray, render_params *RenderParameters) Vec4 {
 	return acc_color
 }
 
+// Sphere traces only the stretches of the view ray through the volumes' boxes, each with its own jump budget
+func march_volume_set(starting_ray *Ray, set *VolumeSet, render_params *RenderParameters) Vec4 {
+	t_max := math.Inf(1)
+	if render_params.solid_depth > 0 {
+		t_max = render_params.solid_depth
+	}
+	var acc_color Vec4
+	t := 0.0
+	for _, interval := range set.intervals(starting_ray, t_max) {
+		t = max(t, interval.t0)
+		for jump_count := 0; t < interval.t1 && jump_count < MAX_JUMPS; jump_count++ {
+			ray := Ray{origin: starting_ray.origin.Add(starting_ray.dir.Scale(t)), dir: starting_ray.dir}
+			if sdf := view_sdf(&ray, render_params); sdf > 0 {
+				t += max(sdf, MIN_JUMP)
+				continue
+			}
+			acc_color = acc_color.Add(march_through_volume(&ray, render_params))
+			walked := ray.origin.Sub(starting_ray.origin)
+			t = walked.Dot(starting_ray.dir)
+		}
+	}
+	return acc_color
+}
+
 func march_outside_volume(ray *Ray, render_params *RenderParameters, jump_count *int) bool {
-	sphere := render_params.sphere
-	prev_sdf := math.MaxFloat64
+	shape := render_params.shape
+	bounds := shape.bounding_sphere()
+	prev_bounds_sdf := math.MaxFloat64
 	for *jump_count < MAX_JUMPS {
 		*jump_count++
 
-		ray_origin_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(ray_origin_in_sphere_space, sphere.R)
+		sdf := view_sdf(ray, render_params)
 
 		if sdf <= 0 {
 			return true // found a volume
 		}
 
-		// break out if moving away from near objects (won't work if there are both near and far objects)
-		if sdf > prev_sdf {
+		// break out if moving away from the shape's bounds (won't work if there are both near and far objects)
+		bounds_sdf := bounds.sdf(ray.origin)
+		if bounds_sdf > 0 && bounds_sdf > prev_bounds_sdf {
 			return false
 		}
 
-		dv := ray.dir.Scale(sdf) // advance ray; don't attempt to advance by zero
+		dv := ray.dir.Scale(max(sdf, MIN_JUMP)) // advance ray; don't attempt to advance by zero
 		ray.origin = ray.origin.Add(dv)
-		prev_sdf = sdf
+		prev_bounds_sdf = bounds_sdf
 	}
 	return false
 }
 
+// The shape's sdf at a view ray's point, cut off at the solid the ray hits so clouds behind it aren't marched
+func view_sdf(ray *Ray, render_params *RenderParameters) float64 {
+	sdf := render_params.shape.sdf(ray.origin)
+	if render_params.solid_depth > 0 {
+		from_camera := ray.origin.Sub(render_params.camera.origin)
+		behind_solid := from_camera.Dot(ray.dir) - render_params.solid_depth
+		sdf = max(sdf, behind_solid)
+	}
+	return sdf
+}
+
 func march_through_volume(ray *Ray, render_params *RenderParameters) Vec4 {
 	switch SHADING_TYPE {
 	case ShadingType_NoLight:
@@ -173,30 +199,42 @@ func march_through_volume(ray *Ray, render_params *RenderParameters) Vec4 {
 }
 
 func march_through_volume_no_light(ray *Ray, render_params *RenderParameters) Vec4 {
-	sphere := render_params.sphere
+	shape := render_params.shape
 
 	acc_density := 0.0
 	acc_distance := 0.0 // accumulated distance inside the volume
+	acc_emitted := Vec3{}
 	count := 0.0
+	skipping := skipping_allowed(render_params)
 
 	var ds float64
 	if SCALE_STEP_RES_TO_OBJECT {
-		ds = sphere.R / NUM_STEPS_OBJECT_SCALING
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
 	} else {
 		ds = VOLUME_RESOLUTION
 	}
 
-	// when orientations are introduced, the normals will have to be transformed
-	// as long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-
 	for {
-		point_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(point_in_sphere_space, sphere.R)
+		sdf := view_sdf(ray, render_params)
 		if sdf > 0 {
 			break // went outside the volume
 		}
+		if skipping {
+			if steps := float64(render_params.macro_grid.leap(ray, ds, -sdf)); steps > 0 {
+				ray.origin = ray.origin.Add(ray.dir.Scale(ds * steps))
+				acc_distance += ds * steps
+				count += steps
+				if count > float64(MAX_JUMPS) {
+					break
+				}
+				continue
+			}
+		}
 
-		density := sample_density(ray.origin, render_params.noises, render_params.time) * VOLUME_RESOLUTION
+		sample := sample_density(ray.origin, render_params.noises, render_params.time)
+		density := sample * VOLUME_RESOLUTION
+		emitted := render_params.emission.emitted(ray.origin, sample, render_params.noises)
+		acc_emitted = acc_emitted.Add(emitted.Scale(beers_law(acc_distance, acc_density) * ds))
 
 		// advance ray inside volume
 		dv := ray.dir.Scale(ds)
@@ -213,40 +251,40 @@ func march_through_volume_no_light(ray *Ray, render_params *RenderParameters) Ve
 	diffuse := cloud_color
 	background_passthrough := beers_law(acc_distance, acc_density)
 	alpha := 1 - background_passthrough
-	return Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}
+	return add_emission(Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}, acc_emitted)
 }
 
 func march_through_volume_naive_light(ray *Ray, render_params *RenderParameters) Vec4 {
-	sphere := render_params.sphere
+	shape := render_params.shape
 	light := render_params.light
 
 	acc_density := 0.0
 	acc_distance := 0.0      // accumulated distance inside the volume
 	acc_color := Vec3Fill(0) // accumulated color
+	acc_emitted := Vec3{}
 	count := 0.0
 
 	var ds float64
 	if SCALE_STEP_RES_TO_OBJECT {
-		ds = sphere.R / NUM_STEPS_OBJECT_SCALING
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
 	} else {
 		ds = VOLUME_RESOLUTION
 	}
 
-	// when orientations are introduced, the normals will have to be transformed
-	// as long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-
 	for {
-		point_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(point_in_sphere_space, sphere.R)
+		sdf := view_sdf(ray, render_params)
 		if sdf > 0 {
 			break // went outside the volume
 		}
 
-		density := sample_density(ray.origin, render_params.noises, render_params.time) * VOLUME_RESOLUTION
+		sample := sample_density(ray.origin, render_params.noises, render_params.time)
+		density := sample * VOLUME_RESOLUTION
 		// density *= asymptote_to_one(math.Abs(sdf), 10.0) // make density closer to the surface softer
+		emitted := render_params.emission.emitted(ray.origin, sample, render_params.noises)
+		acc_emitted = acc_emitted.Add(emitted.Scale(beers_law(acc_distance, acc_density) * ds))
 		acc_density += density
 
-		sub_sphere_normal := point_in_sphere_space.Sub(sphere.C).Normalized()
+		sub_sphere_normal := shape_normal(shape, ray.origin)
 		dir_to_light := (*light).origin.Sub(ray.origin).Normalized()
 		light_factor := sub_sphere_normal.Dot(dir_to_light)
 		// light_factor = max(0.05, light_factor)
@@ -263,43 +301,58 @@ func march_through_volume_naive_light(ray *Ray, render_params *RenderParameters)
 	}
 	diffuse := acc_color
 	alpha := 1 - beers_law(acc_distance, acc_density)
-	return Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}
+	return add_emission(Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}, acc_emitted)
 }
 
 // accumulating color
 func march_through_volume_raymarched_light_1(ray *Ray, render_params *RenderParameters) Vec4 {
-	sphere := render_params.sphere
+	shape := render_params.shape
 	light := render_params.light
 
 	acc_density := 0.0
 	acc_distance := 0.0      // accumulated distance inside the volume
 	acc_color := Vec3Fill(0) // accumulated color
 	acc_alpha := 0.0
+	acc_emitted := Vec3{}
+	occlusion := shape_occlusion(render_params)
+	skipping := skipping_allowed(render_params)
 
 	var ds float64
 	if SCALE_STEP_RES_TO_OBJECT {
-		ds = sphere.R / NUM_STEPS_OBJECT_SCALING
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
 	} else {
 		ds = VOLUME_RESOLUTION
 	}
 
-	// when orientations are introduced, the normals will have to be transformed
-	// as long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-
 	for {
-		point_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(point_in_sphere_space, sphere.R)
+		sdf := view_sdf(ray, render_params)
 		if sdf > 0 {
 			break // went outside the volume
 		}
+		if skipping {
+			// the empty samples are lit alike, light them once in the middle
+			if steps := float64(render_params.macro_grid.leap(ray, ds, -sdf)); steps > 0 {
+				mid := ray.origin.Add(ray.dir.Scale(ds * (steps - 1) / 2))
+				light_color_at_point := light.color.Scale(shape_light_amount(mid, render_params))
+				light_color_at_point = light_color_at_point.Add(render_params.lightning.light_at(mid, render_params.time, occlusion))
+				acc_color = acc_color.Add(cloud_color.Mul(light_color_at_point).Scale(steps))
+				acc_alpha += (1 - beers_law(acc_distance, acc_density)) * steps
+				ray.origin = ray.origin.Add(ray.dir.Scale(ds * steps))
+				acc_distance += ds * steps
+				continue
+			}
+		}
 
-		density := sample_density(ray.origin, render_params.noises, render_params.time) * VOLUME_RESOLUTION
+		sample := sample_density(ray.origin, render_params.noises, render_params.time)
+		density := sample * VOLUME_RESOLUTION
 		// density *= asymptote_to_one(math.Abs(sdf), 10.0) // make density closer to the surface softer
+		emitted := render_params.emission.emitted(ray.origin, sample, render_params.noises)
+		acc_emitted = acc_emitted.Add(emitted.Scale(beers_law(acc_distance, acc_density) * ds))
 		acc_density += density
 
-		distance_sampled_to_light, density_to_light := march_through_volume_to_light(ray.origin, sphere, light, render_params.noises, render_params.time)
-		light_amount := beers_law(distance_sampled_to_light, density_to_light)
+		light_amount := shape_light_amount(ray.origin, render_params)
 		light_color_at_point := light.color.Scale(light_amount)
+		light_color_at_point = light_color_at_point.Add(render_params.lightning.light_at(ray.origin, render_params.time, occlusion))
 		point_color := cloud_color.Mul(light_color_at_point)
 		acc_color = acc_color.Add(point_color)
 		acc_alpha += 1 - beers_law(acc_distance, acc_density)
@@ -311,46 +364,62 @@ func march_through_volume_raymarched_light_1(ray *Ray, render_params *RenderPara
 	}
 	diffuse := acc_color
 	alpha := 1 - beers_law(acc_distance, acc_density)
-	return Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}
+	return add_emission(Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}, acc_emitted)
 }
 
 // accumulating light intensity
 func march_through_volume_raymarched_light_2(ray *Ray, render_params *RenderParameters) Vec4 {
-	sphere := render_params.sphere
+	shape := render_params.shape
 	light := render_params.light
 
 	acc_density := 0.0
 	acc_distance := 0.0 // accumulated distance inside the volume
 	acc_light_amount := 0.0
 	acc_sdf := 0.0
+	acc_emitted := Vec3{}
+	acc_flash := Vec3{} // lightning
+	occlusion := shape_occlusion(render_params)
 	count := 0.0
+	skipping := skipping_allowed(render_params)
 
 	var ds float64
 	if SCALE_STEP_RES_TO_OBJECT {
-		ds = sphere.R / NUM_STEPS_OBJECT_SCALING
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
 	} else {
 		ds = VOLUME_RESOLUTION
 	}
 
-	// when orientations are introduced, the normals will have to be transformed
-	// as long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-
 	for {
-		point_in_sphere_space := ray.origin.Sub(sphere.C)
-		sdf := sdfSphere(point_in_sphere_space, sphere.R)
+		sdf := view_sdf(ray, render_params)
 		if sdf > 0 {
 			break // went outside the volume
 		}
-		acc_sdf += math.Abs(sdf)
+		if skipping {
+			// the empty samples are lit alike and their distances to the surface change about linearly, take the
+			// middle one for all
+			if steps := float64(render_params.macro_grid.leap(ray, ds, -sdf)); steps > 0 {
+				mid := Ray{origin: ray.origin.Add(ray.dir.Scale(ds * (steps - 1) / 2)), dir: ray.dir}
+				acc_sdf += math.Abs(view_sdf(&mid, render_params)) / shape.depth() * steps
+				acc_light_amount += shape_light_amount(mid.origin, render_params) * steps
+				acc_flash = acc_flash.Add(render_params.lightning.light_at(mid.origin, render_params.time, occlusion).Scale(steps))
+				ray.origin = ray.origin.Add(ray.dir.Scale(ds * steps))
+				acc_distance += ds * steps
+				count += steps
+				continue
+			}
+		}
+		acc_sdf += math.Abs(sdf) / shape.depth() // relative to the shape's thickness, so thin shapes don't fade out
 
 		density := sample_density(ray.origin, render_params.noises, render_params.time) //* volume_resolution
+		emitted := render_params.emission.emitted(ray.origin, density, render_params.noises)
+		acc_emitted = acc_emitted.Add(emitted.Scale(beers_law(acc_distance, acc_density) * ds))
 		acc_density += density
 
-		distance_sampled_to_light, density_to_light := march_through_volume_to_light(ray.origin, sphere, light, render_params.noises, render_params.time)
-		light_amount := beers_law(distance_sampled_to_light, density_to_light) // light transmittance from light to point
+		light_amount := shape_light_amount(ray.origin, render_params) // light transmittance from light to point
 		// light_amount *= beers_law(acc_distance, acc_density) // light transmittance from point to camera
 		// light_amount += MultipleOctaveScattering(density, 0.8)
 		acc_light_amount += light_amount
+		acc_flash = acc_flash.Add(render_params.lightning.light_at(ray.origin, render_params.time, occlusion))
 
 		// advance ray inside volume
 		dv := ray.dir.Scale(ds)
@@ -360,7 +429,7 @@ func march_through_volume_raymarched_light_2(ray *Ray, render_params *RenderPara
 		count += 1.0
 	}
 	light_amount := acc_light_amount / count // average
-	light_color := light.color.Scale(light_amount)
+	light_color := light.color.Scale(light_amount).Add(acc_flash.Scale(1 / count))
 	diffuse := cloud_color.Mul(light_color)
 	alpha := 1 - beers_law(acc_distance, acc_density)
 	if EASE_IN_EDGES { // soften edges
@@ -369,44 +438,101 @@ func march_through_volume_raymarched_light_2(ray *Ray, render_params *RenderPara
 		}
 		alpha *= ease_in(linear_step(0.0, 3.0, acc_sdf)) // soften object outline; 3 by experimentation
 	}
-	return Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}
+	return add_emission(Vec4{diffuse.X, diffuse.Y, diffuse.Z, alpha}, acc_emitted)
+}
+
+// Fraction of the light passing through the shape's volume along the ray, up to distance, for shadows on solids
+func march_volume_transmittance(ray *Ray, distance float64, render_params *RenderParameters) float64 {
+	shape := render_params.shape
+	ds := VOLUME_RESOLUTION
+	if SCALE_STEP_RES_TO_OBJECT {
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
+	}
+	bounds := shape.bounding_sphere()
+	depth := 0.0
+	t := 0.0
+	for range MAX_JUMPS * 4 {
+		if t >= distance {
+			break
+		}
+		p := ray.origin.Add(ray.dir.Scale(t))
+		sdf := shape.sdf(p)
+		if sdf > 0 {
+			if to_center := bounds.C.Sub(p); bounds.sdf(p) > 0 && to_center.Dot(ray.dir) < 0 {
+				break // left the shape's bounds for good
+			}
+			t += max(sdf, MIN_JUMP)
+			continue
+		}
+		depth += sample_density(p, render_params.noises, render_params.time) * ds
+		t += ds
+	}
+	return beers_law(depth, CLOUD_SHADOW_ABSORPTION)
 }
 
+// Transmittance between two points of the shape's volume, for lights inside it
+func shape_occlusion(render_params *RenderParameters) func(from, to Vec3) float64 {
+	return func(from, to Vec3) float64 {
+		distance, density := march_through_volume_to_light(from, render_params.shape, render_params.macro_grid, &Light{origin: to}, render_params.noises, render_params.time)
+		return beers_law(distance, density)
+	}
+}
+
+// Density along the way from point to the light until it leaves the shape, a sample every ds. The samples in runs of
+// empty macro cells are leapt over.
 func march_through_volume_to_light(
 	point Vec3,
-	sphere *Sphere,
+	shape Shape,
+	macro_grid *MacroGrid,
 	light *Light,
 	noises *Noises,
 	time float64,
 ) (distance, density float64) {
-	// As long as there are only translations, directions are OK in any translated space (not rotated or scaled)
-	light_origin_s := light.origin.Sub(sphere.C) // light origin in sphere space
-	point_s := point.Sub(sphere.C)               // point in sphere space
-	dir_to_light := light_origin_s.Sub(point_s).Normalized()
+	to_light := light.origin.Sub(point)
+	dir_to_light := to_light.Normalized()
 
 	acc_distance := 0.0
 	acc_density := 0.0
 
 	var ds float64
 	if SCALE_STEP_RES_TO_OBJECT {
-		ds = sphere.R / NUM_STEPS_OBJECT_SCALING
+		ds = shape.depth() / NUM_STEPS_OBJECT_SCALING
 	} else {
 		ds = VOLUME_RESOLUTION
 	}
 
+	samples := int(math.Ceil(to_light.Len() / ds)) // before the light
+	inside := 0                                    // the samples before it are inside the shape
+	sample := 0.0
+	j := 0
 	for {
-		sdf := sdfSphere(point_s, sphere.R)
-		if sdf > 0 {
-			acc_distance -= sdf // decrease by the over-shot distance outside the volume
-			break               // went outside the volume
+		t := float64(j) * ds
+		p := point.Add(dir_to_light.Scale(t))
+		if j >= inside {
+			sdf := shape.sdf(p)
+			if sdf > 0 {
+				acc_distance -= sdf // decrease by the over-shot distance outside the volume
+				break               // went outside the volume
+			}
+			if j >= samples {
+				break // reached a light inside the volume
+			}
+			// every step up to -sdf further is still inside, stopping at the light
+			inside = min(j+1+int(-sdf/ds), samples)
 		}
 
-		acc_density += sample_density(point, noises, time) //* volume_resolution
-
-		// advance point towards light
-		dv := dir_to_light.Scale(ds)
-		point_s = point_s.Add(dv)
-		acc_distance += VOLUME_RESOLUTION
+		// empty runs are only looked for after an empty sample, a dense one is in a dense cell
+		if sample <= MACRO_GRID_EMPTY_DENSITY {
+			ray := Ray{origin: p, dir: dir_to_light}
+			if leapt := macro_grid.leap(&ray, ds, float64(inside-j)*ds); leapt > 0 {
+				j = min(j+leapt, inside)
+				continue
+			}
+		}
+		sample = sample_density(p, noises, time) //* volume_resolution
+		acc_density += sample
+		j++
 	}
+	acc_distance += VOLUME_RESOLUTION * float64(j)
 	return acc_distance, acc_density
 }
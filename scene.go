@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Scene description loaded from SCENE_FILE at startup, everything is optional
+type SceneFile struct {
+	Density    *NoiseNodeDef   `json:"density"`     // noise graph used by DensityType_Graph
+	Volume     *VoxelVolumeDef `json:"volume"`      // imported voxel grid used by DensityType_Voxel
+	Shape      *ShapeDef       `json:"shape"`       // replaces the marched sphere
+	Layer      *CloudLayerDef  `json:"layer"`       // sky-wide cloud layer rendered instead of the shape
+	Wind       *WindDef        `json:"wind"`        // replaces the default wind
+	Fluid      *FluidSimDef    `json:"fluid"`       // smoke simulation used by DensityType_Fluid
+	Emission   *EmissionDef    `json:"emission"`    // light given off by the shape's volume
+	Lightning  *LightningDef   `json:"lightning"`   // flashes inside the shape or the layer
+	Solids     []SolidDef      `json:"solids"`      // opaque ground, spheres and terrain
+	Fog        *FogDef         `json:"fog"`         // height fog and aerial perspective
+	GodRays    *GodRaysDef     `json:"god_rays"`    // light shafts between the clouds
+	ShadowGrid *ShadowGridDef  `json:"shadow_grid"` // precomputed self-shadowing of the shape
+	MacroGrid  *MacroGridDef   `json:"empty_space"` // empty-space skipping in the shape
+}
+
+type VoxelVolumeDef struct {
+	Path         string     `json:"path"`
+	Center       [3]float64 `json:"center"`
+	Size         [3]float64 `json:"size"` // world extent of the whole grid, defaults to 1
+	Yaw          float64    `json:"yaw"`  // degrees around the y axis
+	DensityScale float64    `json:"density_scale"`
+}
+
+func load_scene(path string) (*SceneFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scene SceneFile
+	if err := json.Unmarshal(data, &scene); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &scene, nil
+}
+
+// applies the scene file on top of the defaults, a missing file keeps the defaults
+func apply_scene_file(path string, state *State) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	scene, err := load_scene(path)
+	if err != nil {
+		return err
+	}
+	if scene.Wind != nil {
+		wind, err := build_wind(scene.Wind)
+		if err != nil {
+			return fmt.Errorf("%s: wind: %w", path, err)
+		}
+		state.noises.wind = wind
+	}
+	if scene.Density != nil {
+		graph, err := build_noise_node(scene.Density)
+		if err != nil {
+			return fmt.Errorf("%s: density: %w", path, err)
+		}
+		state.noises.density_graph = graph
+		density_type = DensityType_Graph
+	}
+	if scene.Volume != nil {
+		def := scene.Volume
+		grid, err := load_voxel_grid(def.Path)
+		if err != nil {
+			return err
+		}
+		size := Vec3{def.Size[0], def.Size[1], def.Size[2]}
+		if size == (Vec3{}) {
+			size = Vec3Fill(1)
+		}
+		density_scale := def.DensityScale
+		if density_scale == 0 {
+			density_scale = 1
+		}
+		center := Vec3{def.Center[0], def.Center[1], def.Center[2]}
+		state.noises.voxel_volume = NewVoxelVolume(grid, center, size, def.Yaw, density_scale)
+		density_type = DensityType_Voxel
+	}
+	if scene.Fluid != nil {
+		sim, err := build_fluid_sim(scene.Fluid)
+		if err != nil {
+			return fmt.Errorf("%s: fluid: %w", path, err)
+		}
+		state.noises.fluid = sim
+		density_type = DensityType_Fluid
+	}
+	if scene.Emission != nil {
+		emission, err := build_emission(scene.Emission)
+		if err != nil {
+			return fmt.Errorf("%s: emission: %w", path, err)
+		}
+		state.emission = emission
+	}
+	if scene.Lightning != nil {
+		lightning, err := build_lightning(scene.Lightning)
+		if err != nil {
+			return fmt.Errorf("%s: lightning: %w", path, err)
+		}
+		state.lightning = lightning
+	}
+	for i := range scene.Solids {
+		solid, err := build_solid(&scene.Solids[i])
+		if err != nil {
+			return fmt.Errorf("%s: solids[%d]: %w", path, i, err)
+		}
+		state.solids = append(state.solids, solid)
+	}
+	if scene.Fog != nil {
+		fog, err := build_fog(scene.Fog)
+		if err != nil {
+			return fmt.Errorf("%s: fog: %w", path, err)
+		}
+		state.fog = fog
+	}
+	if scene.GodRays != nil {
+		god_rays, err := build_god_rays(scene.GodRays)
+		if err != nil {
+			return fmt.Errorf("%s: god_rays: %w", path, err)
+		}
+		state.god_rays = god_rays
+	}
+	if scene.ShadowGrid != nil {
+		shadow_grid, err := build_shadow_grid(scene.ShadowGrid)
+		if err != nil {
+			return fmt.Errorf("%s: shadow_grid: %w", path, err)
+		}
+		state.shadow_grid = shadow_grid
+	}
+	if scene.MacroGrid != nil {
+		macro_grid, err := build_macro_grid(scene.MacroGrid)
+		if err != nil {
+			return fmt.Errorf("%s: empty_space: %w", path, err)
+		}
+		state.macro_grid = macro_grid
+	}
+	if scene.Shape != nil {
+		shape, err := build_shape(scene.Shape)
+		if err != nil {
+			return fmt.Errorf("%s: shape: %w", path, err)
+		}
+		state.shape = shape
+	}
+	if scene.Layer != nil {
+		layer, err := build_cloud_layer(scene.Layer)
+		if err != nil {
+			return fmt.Errorf("%s: layer: %w", path, err)
+		}
+		state.layer = layer
+		state.layer_def = scene.Layer
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"time"
+)
+
+// Deep shadow volume: the transmittance from the point light to every cell of a coarse grid over the shape's bounds,
+// marched once with march_through_volume_to_light and looked up trilinearly while shading instead of marching
+// towards the light from every sample. It is rebuilt when the light moves more than light_tolerance cells, when the
+// shape, the density type or the voxel volume change, or when the volume is more than time_tolerance seconds older
+// than the frame.
+
+type ShadowGrid struct {
+	resolution      int     // cells along each axis
+	light_tolerance float64 // in cells
+	time_tolerance  float64 // seconds
+
+	grid       *Matrix3D[float32]
+	min        Vec3    // corner of the first cell
+	cell       float64 // world size of a cell
+	light      Vec3    // what the grid was built for
+	shape      Shape
+	density    DensityType
+	voxels     *VoxelVolume
+	built_at   float64
+	build_time time.Duration // of the last rebuild
+	frame_time time.Duration // of the last frame rendered with it, without the rebuild
+}
+
+// Rebuilds the grid if it is out of date, before the frame is rendered
+func (g *ShadowGrid) update(render_params *RenderParameters) {
+	if g == nil || render_params.layer != nil || render_params.shape == nil {
+		return
+	}
+	if !g.stale(render_params) {
+		return
+	}
+	start := time.Now()
+	g.build(render_params)
+	g.build_time = time.Since(start)
+}
+
+func (g *ShadowGrid) stale(render_params *RenderParameters) bool {
+	return g.grid == nil ||
+		g.shape != render_params.shape ||
+		g.density != density_type ||
+		g.voxels != render_params.noises.voxel_volume ||
+		g.light.Sub(render_params.light.origin).Len() > g.light_tolerance*g.cell ||
+		math.Abs(volume_time(render_params)-g.built_at) > g.time_tolerance
+}
+
+// The time the volume is at: the simulation's when the fluid is rendered, the frame's otherwise
+func volume_time(render_params *RenderParameters) float64 {
+	if rendering_fluid(render_params.noises) {
+		fluid := render_params.noises.fluid
+		return float64(fluid.steps) * fluid.params.dt
+	}
+	return render_params.time
+}
+
+func (g *ShadowGrid) build(render_params *RenderParameters) {
+	shape, light := render_params.shape, render_params.light
+	bounds := shape.bounding_sphere()
+	n := g.resolution
+	g.cell = 2 * bounds.R / float64(n)
+	g.min = bounds.C.Sub(Vec3Fill(bounds.R))
+	g.light, g.shape, g.density = light.origin, shape, density_type
+	g.voxels = render_params.noises.voxel_volume
+	g.built_at = volume_time(render_params)
+	if g.grid == nil || g.grid.W != n {
+		g.grid = NewMatrix3D[float32](n, n, n)
+	}
+
+	// cells outside the shape are filled from their neighbours inside, so lookups near the surface don't blend in
+	// unshadowed light
+	inside := NewMatrix3D[bool](n, n, n)
+	fill_matrix3D_parallel(g.grid, runtime.NumCPU(), nil, func(x, y, z int) float32 {
+		p := g.cell_center(x, y, z)
+		if shape.sdf(p) > 0 {
+			return 1
+		}
+		inside.set(true, x, y, z)
+		distance, density := march_through_volume_to_light(p, shape, render_params.macro_grid, light, render_params.noises, render_params.time)
+		return float32(beers_law(distance, density))
+	})
+	marched := make([]float32, len(g.grid.values))
+	copy(marched, g.grid.values)
+	fill_matrix3D_parallel(g.grid, runtime.NumCPU(), nil, func(x, y, z int) float32 {
+		if inside.get(x, y, z) {
+			return marched[y*n*n+x*n+z]
+		}
+		sum, count := float32(0), 0
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				for dz := -1; dz <= 1; dz++ {
+					nx, ny, nz := x+dx, y+dy, z+dz
+					if nx < 0 || ny < 0 || nz < 0 || nx >= n || ny >= n || nz >= n || !inside.get(nx, ny, nz) {
+						continue
+					}
+					sum += marched[ny*n*n+nx*n+nz]
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			return 1
+		}
+		return sum / float32(count)
+	})
+}
+
+func (g *ShadowGrid) cell_center(x, y, z int) Vec3 {
+	return g.min.Add(Vec3{float64(x) + 0.5, float64(y) + 0.5, float64(z) + 0.5}.Scale(g.cell))
+}
+
+func (g *ShadowGrid) lookup(p Vec3) float64 {
+	c := p.Sub(g.min).Scale(1 / g.cell)
+	return matrix3D_sample_trilinear(g.grid, c.X-0.5, c.Y-0.5, c.Z-0.5)
+}
+
+// Transmittance from the point light to p inside the shape's volume, from the shadow grid when there is one
+func shape_light_amount(p Vec3, render_params *RenderParameters) float64 {
+	if g := render_params.shadow_grid; g != nil && g.grid != nil && g.shape == render_params.shape {
+		return g.lookup(p)
+	}
+	distance, density := march_through_volume_to_light(p, render_params.shape, render_params.macro_grid, render_params.light, render_params.noises, render_params.time)
+	return beers_law(distance, density)
+}
+
+// Scene file representation of the shadow grid
+type ShadowGridDef struct {
+	Resolution     int     `json:"resolution,omitempty"`
+	LightTolerance float64 `json:"light_tolerance,omitempty"` // cells
+	TimeTolerance  float64 `json:"time_tolerance,omitempty"`  // seconds, negative rebuilds every frame
+}
+
+func build_shadow_grid(def *ShadowGridDef) (*ShadowGrid, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	g := ShadowGrid{
+		resolution:      or_default_int(def.Resolution, SHADOW_GRID_RESOLUTION),
+		light_tolerance: or_default(def.LightTolerance, 0.5),
+		time_tolerance:  max(0, or_default(def.TimeTolerance, 0.1)),
+	}
+	if g.resolution < 2 || g.resolution > 256 {
+		return nil, fmt.Errorf("resolution %d, between 2 and 256", g.resolution)
+	}
+	return &g, nil
+}
+
+func shadow_grid_label(g *ShadowGrid) string {
+	if g == nil {
+		return "off"
+	}
+	return fmt.Sprintf("%d³, frame %.0fms, built in %.0fms", g.resolution,
+		float64(g.frame_time.Microseconds())/1000, float64(g.build_time.Microseconds())/1000)
+}
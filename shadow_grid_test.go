@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// go test -run ShadowGridError -v reports the frame times and the error
+func TestShadowGridError(t *testing.T) {
+	prev := density_type
+	density_type = DensityType_PerlinRuntime
+	defer func() { density_type = prev }()
+
+	rp := bench_render_parameters()
+	render := func(shadow_grid *ShadowGrid) ([]Pixel, time.Duration) {
+		rp.img = &ImageTarget{Pixels: make([]Pixel, 320*240), W: 320, H: 240}
+		rp.shadow_grid = shadow_grid
+		start := time.Now()
+		ray_march(rp)
+		return rp.img.Pixels, time.Since(start)
+	}
+	full, full_time := render(nil)
+	shadow_grid, err := build_shadow_grid(&ShadowGridDef{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	render(shadow_grid) // builds the grid
+	build_time := shadow_grid.build_time
+	looked_up, grid_time := render(shadow_grid)
+	if shadow_grid.build_time != build_time {
+		t.Error("the grid was rebuilt for the same frame")
+	}
+
+	mean, worst, covered := shadow_grid_error(full, looked_up)
+	t.Logf("marching to the light %v, shadow grid %v (built in %v), mean error %.4f, worst %.3f over %d pixels",
+		full_time, grid_time, build_time, mean, worst, covered)
+	if covered == 0 || mean > 0.05 || worst > 0.35 {
+		t.Errorf("mean error %v and worst %v over %d pixels", mean, worst, covered)
+	}
+}
+
+// Mean and largest difference of a color channel between frames marched to the light and looked up in the grid, over
+// the pixels the clouds cover
+func shadow_grid_error(full, looked_up []Pixel) (mean, worst float64, covered int) {
+	sum := 0.0
+	for i := range full {
+		if full[i].A == 0 {
+			continue
+		}
+		covered++
+		for _, d := range []float64{
+			float64(full[i].R) - float64(looked_up[i].R),
+			float64(full[i].G) - float64(looked_up[i].G),
+			float64(full[i].B) - float64(looked_up[i].B),
+		} {
+			sum += math.Abs(d) / 255
+			worst = max(worst, math.Abs(d)/255)
+		}
+	}
+	return sum / float64(max(3*covered, 1)), worst, covered
+}
+
+func TestShadowGridLabel(t *testing.T) {
+	g := &ShadowGrid{resolution: 32, build_time: 15 * time.Millisecond, frame_time: 95 * time.Millisecond}
+	if got, want := shadow_grid_label(g), "32³, frame 95ms, built in 15ms"; got != want {
+		t.Errorf("label %q, want %q", got, want)
+	}
+	if got := shadow_grid_label(nil); got != "off" {
+		t.Errorf("label %q without a grid", got)
+	}
+}
+
+func TestShadowGridRebuild(t *testing.T) {
+	rp := bench_render_parameters()
+	g, _ := build_shadow_grid(&ShadowGridDef{Resolution: 8})
+	g.update(rp)
+	built := g.grid
+	if built == nil || g.stale(rp) {
+		t.Fatal("the grid isn't up to date after an update")
+	}
+
+	rp.light.origin.X += g.cell * 0.2
+	rp.time += 0.05
+	if g.stale(rp) {
+		t.Error("a small change made the grid stale")
+	}
+	rp.light.origin.X += g.cell
+	if !g.stale(rp) {
+		t.Error("moving the light a cell didn't make the grid stale")
+	}
+	g.update(rp)
+	rp.time += 1
+	if !g.stale(rp) {
+		t.Error("a second later the grid isn't stale")
+	}
+	g.update(rp)
+	rp.shape = &Sphere{C: Vec3{0, 0, -1}, R: 0.5}
+	if !g.stale(rp) {
+		t.Error("a new shape didn't make the grid stale")
+	}
+	// a grid built for another shape isn't used
+	rp.shadow_grid = g
+	distance, density := march_through_volume_to_light(Vec3{0, 0, -1}, rp.shape, rp.macro_grid, rp.light, rp.noises, rp.time)
+	if got, want := shape_light_amount(Vec3{0, 0, -1}, rp), beers_law(distance, density); got != want {
+		t.Errorf("light amount %v from the stale grid, marched %v", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+)
+
+// Region the volume marcher renders, density is only sampled where sdf < 0
+type Shape interface {
+	sdf(p Vec3) float64
+	// encloses the shape, rays moving away from it give up
+	bounding_sphere() Sphere
+	// largest distance from the surface inwards, scales the march step size and the outline softening
+	depth() float64
+}
+
+func (s *Sphere) sdf(p Vec3) float64 {
+	return sdfSphere(p.Sub(s.C), s.R)
+}
+
+func (s *Sphere) bounding_sphere() Sphere {
+	return *s
+}
+
+func (s *Sphere) depth() float64 {
+	return s.R
+}
+
+// Outward surface normal from the sdf gradient (central differences)
+func shape_normal(shape Shape, p Vec3) Vec3 {
+	return sdf_normal(shape.sdf, p)
+}
+
+func sdf_normal(sdf func(p Vec3) float64, p Vec3) Vec3 {
+	const e = 1e-3
+	n := Vec3{
+		X: sdf(Vec3{p.X + e, p.Y, p.Z}) - sdf(Vec3{p.X - e, p.Y, p.Z}),
+		Y: sdf(Vec3{p.X, p.Y + e, p.Z}) - sdf(Vec3{p.X, p.Y - e, p.Z}),
+		Z: sdf(Vec3{p.X, p.Y, p.Z + e}) - sdf(Vec3{p.X, p.Y, p.Z - e}),
+	}
+	if n.LenSq() == 0 {
+		return Vec3{0, 1, 0}
+	}
+	return n.Normalized()
+}
+
+// Scene file representation of a shape
+type ShapeDef struct {
+	Type   string     `json:"type"` // sphere (default), mesh, mask, text, metaballs or volumes
+	Center [3]float64 `json:"center"`
+	Radius float64    `json:"radius"` // sphere, defaults to 1; metaballs: points without a radius, defaults to size / 10
+
+	// mesh: an OBJ file, mask: a PNG silhouette, text: rendered with the embedded font, metaballs: CSV or PLY points.
+	// All are rescaled so their largest extent is size and centered on center.
+	Path       string  `json:"path,omitempty"`
+	Text       string  `json:"text,omitempty"`
+	Size       float64 `json:"size,omitempty"`       // defaults to 2
+	Resolution int     `json:"resolution,omitempty"` // mesh sdf grid points along the largest extent (64), text pixels per line (64)
+
+	// mask, text: extruded along z
+	Depth    float64 `json:"depth,omitempty"`    // defaults to 0.4
+	Rounding float64 `json:"rounding,omitempty"` // radius of the rounded profile, defaults to half the stroke width
+	Invert   bool    `json:"invert,omitempty"`   // mask: dark pixels are inside
+
+	// metaballs: points from path, or generated
+	Generator string  `json:"generator,omitempty"` // cumulus or stratus
+	Seed      int64   `json:"seed,omitempty"`
+	Count     int     `json:"count,omitempty"` // generated spheres, defaults to 60 (metaballs) or 200 (volumes)
+	Blend     float64 `json:"blend,omitempty"` // smooth min radius, defaults to size / 40
+
+	// volumes: the shapes listed, or count spheres of about radius (size / 40) generated over a size wide deck
+	Volumes []ShapeDef `json:"volumes,omitempty"`
+	Drift   [3]float64 `json:"drift,omitempty"` // world units per second, volumes wrap around the field
+}
+
+func build_shape(def *ShapeDef) (Shape, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	center := Vec3{def.Center[0], def.Center[1], def.Center[2]}
+	switch def.Type {
+	case "", "sphere":
+		return &Sphere{C: center, R: or_default(def.Radius, 1)}, nil
+	case "mesh":
+		mesh, err := load_obj(def.Path)
+		if err != nil {
+			return nil, err
+		}
+		if len(mesh.triangles) == 0 {
+			return nil, fmt.Errorf("%s: no triangles", filepath.Base(def.Path))
+		}
+		if err := fit_mesh(mesh, center, or_default(def.Size, 2)); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(def.Path), err)
+		}
+		return NewMeshSdf(mesh, or_default_int(def.Resolution, 64)), nil
+	case "mask", "text":
+		var mask *Matrix2D[bool]
+		var err error
+		if def.Type == "mask" {
+			mask, err = load_png_mask(def.Path, def.Invert)
+		} else {
+			mask, err = text_mask(def.Text, or_default_int(def.Resolution, 64))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewExtrudedShape(mask, center, or_default(def.Size, 2), or_default(def.Depth, 0.4), def.Rounding), nil
+	case "metaballs":
+		size := or_default(def.Size, 2)
+		rng := rand.New(rand.NewSource(def.Seed))
+		var balls []Metaball
+		switch def.Generator {
+		case "cumulus":
+			balls = generate_cumulus(rng, center, size, or_default_int(def.Count, 60))
+		case "stratus":
+			balls = generate_stratus(rng, center, size, or_default_int(def.Count, 60))
+		case "":
+			var err error
+			if balls, err = load_points(def.Path); err != nil {
+				return nil, err
+			}
+			fit_points(balls, center, size, or_default(def.Radius, size/10))
+		default:
+			return nil, fmt.Errorf("unknown metaball generator %q", def.Generator)
+		}
+		if len(balls) == 0 {
+			return nil, fmt.Errorf("no metaballs")
+		}
+		return NewMetaballShape(balls, or_default(def.Blend, size/40)), nil
+	case "volumes":
+		drift := Vec3{def.Drift[0], def.Drift[1], def.Drift[2]}
+		if len(def.Volumes) == 0 {
+			size := or_default(def.Size, 20)
+			half := Vec3{size, size / 8, size}.Scale(0.5)
+			rng := rand.New(rand.NewSource(def.Seed))
+			volumes, drifts := generate_volume_field(rng, center.Sub(half), center.Add(half), or_default(def.Radius, size/40),
+				or_default_int(def.Count, 200), drift)
+			return NewVolumeSet(volumes, drifts, center.Sub(half), center.Add(half)), nil
+		}
+		volumes := make([]Shape, len(def.Volumes))
+		drifts := make([]Vec3, len(def.Volumes))
+		lo, hi := Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+		for i := range def.Volumes {
+			volume, err := build_shape(&def.Volumes[i])
+			if err != nil {
+				return nil, fmt.Errorf("volume %d: %w", i, err)
+			}
+			b := volume.bounding_sphere()
+			lo, hi = Vec3Min(lo, b.C.Sub(Vec3Fill(b.R))), Vec3Max(hi, b.C.Add(Vec3Fill(b.R)))
+			volumes[i], drifts[i] = volume, drift
+		}
+		return NewVolumeSet(volumes, drifts, lo, hi), nil
+	}
+	return nil, fmt.Errorf("unknown shape type %q", def.Type)
+}
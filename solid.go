@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Opaque objects under and among the clouds: a ground plane, spheres and heightfield terrain, sphere traced and
+// Lambert shaded. The light reaching them is shadowed by the other solids and by the clouds, and clouds are only
+// marched up to the nearest solid along a view ray so they composite in front of it.
+
+type Solid interface {
+	sdf(p Vec3) float64
+	albedo(p Vec3) Vec3
+}
+
+type Solids []Solid
+
+type GroundPlane struct {
+	height float64
+	color  Vec3
+}
+
+func (g *GroundPlane) sdf(p Vec3) float64 { return p.Y - g.height }
+func (g *GroundPlane) albedo(p Vec3) Vec3 { return g.color }
+
+type SolidSphere struct {
+	Sphere
+	color Vec3
+}
+
+func (s *SolidSphere) sdf(p Vec3) float64 { return s.Sphere.sdf(p) }
+func (s *SolidSphere) albedo(p Vec3) Vec3 { return s.color }
+
+// Distance to the nearest solid and which it is
+func (s Solids) sdf(p Vec3) (float64, Solid) {
+	nearest, hit := math.MaxFloat64, Solid(nil)
+	for _, solid := range s {
+		if d := solid.sdf(p); d < nearest {
+			nearest, hit = d, solid
+		}
+	}
+	return nearest, hit
+}
+
+// Sphere traces the ray up to max_t, 0 and nil when nothing is hit
+func (s Solids) trace(ray *Ray, max_t float64) (float64, Solid) {
+	t := 0.0
+	for range SOLID_MAX_STEPS {
+		d, solid := s.sdf(ray.origin.Add(ray.dir.Scale(t)))
+		if d < SOLID_HIT_DISTANCE*max(1, t) {
+			return t, solid
+		}
+		t += d
+		if t > max_t {
+			break
+		}
+	}
+	return 0, nil
+}
+
+// Lambert shaded solids along the view ray, and the distance to them (0 for none)
+func march_solid(starting_ray *Ray, render_params *RenderParameters) (Vec4, float64) {
+	solids := render_params.solids
+	if len(solids) == 0 {
+		return Vec4{}, 0
+	}
+	t, solid := solids.trace(starting_ray, SOLID_MAX_DISTANCE)
+	if solid == nil {
+		return Vec4{}, 0
+	}
+	p := starting_ray.origin.Add(starting_ray.dir.Scale(t))
+	normal := sdf_normal(func(p Vec3) float64 { d, _ := solids.sdf(p); return d }, p)
+
+	dir_to_light, light_distance := direction_to_light(p, render_params)
+	light_amount := max(0, normal.Dot(dir_to_light))
+	if light_amount > 0 {
+		// lifted off the surface so the shadow ray doesn't hit it
+		shadow_ray := Ray{origin: p.Add(normal.Scale(SOLID_HIT_DISTANCE * max(1, t) * 4)), dir: dir_to_light}
+		if _, blocker := solids.trace(&shadow_ray, light_distance); blocker != nil {
+			light_amount = 0
+		} else {
+			light_amount *= cloud_transmittance(shadow_ray.origin, dir_to_light, light_distance, render_params)
+		}
+	}
+	color := solid.albedo(p).Mul(render_params.light.color.Scale(light_amount).AddScalar(SOLID_AMBIENT))
+	return Vec4{color.X, color.Y, color.Z, 1}, t
+}
+
+// Towards the point light, or the cloud layer's sun
+func direction_to_light(p Vec3, render_params *RenderParameters) (Vec3, float64) {
+	if render_params.layer != nil {
+		return render_params.layer.sun_dir, SOLID_MAX_DISTANCE
+	}
+	to_light := render_params.light.origin.Sub(p)
+	distance := to_light.Len()
+	return to_light.Scale(1 / distance), distance
+}
+
+// Fraction of the light reaching p through the cloud layer or the shape's volume
+func cloud_transmittance(p, dir Vec3, distance float64, render_params *RenderParameters) float64 {
+	ray := Ray{origin: p, dir: dir}
+	if render_params.layer != nil {
+		return render_params.layer.transmittance(&ray, render_params.noises, render_params.time)
+	}
+	if render_params.shape == nil {
+		return 1
+	}
+	return march_volume_transmittance(&ray, distance, render_params)
+}
+
+// Scene file representation of a solid
+type SolidDef struct {
+	Type   string     `json:"type"` // plane, sphere or terrain
+	Center [3]float64 `json:"center"`
+	Color  [3]float64 `json:"color"`
+
+	Radius float64 `json:"radius,omitempty"` // sphere
+	Height float64 `json:"height,omitempty"` // plane: y of the ground, terrain: world height of the highest peak
+
+	// terrain, loaded from a heightmap or generated
+	Path       string  `json:"path,omitempty"` // 8 or 16-bit grayscale PNG
+	Size       float64 `json:"size,omitempty"` // world extent along x, along z it follows the heightmap
+	Resolution int     `json:"resolution,omitempty"`
+	Scale      float64 `json:"scale,omitempty"` // noise features across the terrain
+	Seed       int64   `json:"seed,omitempty"`
+}
+
+func build_solid(def *SolidDef) (Solid, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	or_default_int := func(v, d int) int {
+		if v <= 0 {
+			return d
+		}
+		return v
+	}
+	center := Vec3{def.Center[0], def.Center[1], def.Center[2]}
+	color := Vec3{def.Color[0], def.Color[1], def.Color[2]}
+	if color == (Vec3{}) {
+		color = Vec3{0.35, 0.45, 0.3}
+	}
+	switch def.Type {
+	case "plane":
+		return &GroundPlane{height: def.Height, color: color}, nil
+	case "sphere":
+		return &SolidSphere{Sphere: Sphere{C: center, R: or_default(def.Radius, 1)}, color: color}, nil
+	case "terrain":
+		var heights *Matrix2D[float32]
+		if def.Path != "" {
+			var err error
+			if heights, err = load_heightmap(def.Path); err != nil {
+				return nil, err
+			}
+		} else {
+			heights = generate_terrain_heights(def.Seed, or_default_int(def.Resolution, 256), or_default(def.Scale, 4))
+		}
+		return NewTerrain(heights, center, or_default(def.Size, 40), or_default(def.Height, 2), color), nil
+	}
+	return nil, fmt.Errorf("unknown solid type %q, available: plane, sphere, terrain", def.Type)
+}
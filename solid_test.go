@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSolidsTrace(t *testing.T) {
+	terrain := NewTerrain(generate_terrain_heights(1, 64, 4), Vec3{0, -2, 0}, 20, 1.5, Vec3Fill(0.5))
+	solids := Solids{&GroundPlane{height: -3}, &SolidSphere{Sphere: Sphere{C: Vec3{0, 0, 5}, R: 1}}, terrain}
+
+	ray := Ray{origin: Vec3{0, 0, 0}, dir: Vec3{0, 0, 1}}
+	if d, solid := solids.trace(&ray, SOLID_MAX_DISTANCE); math.Abs(d-4) > 0.01 || solid != solids[1] {
+		t.Errorf("hit %v at %v, want the sphere at 4", solid, d)
+	}
+
+	// straight down onto the terrain, and onto the ground plane beside it
+	ray = Ray{origin: Vec3{1.3, 5, -2.1}, dir: Vec3{0, -1, 0}}
+	want := 5 - terrain.height_at(1.3, -2.1)
+	if d, solid := solids.trace(&ray, SOLID_MAX_DISTANCE); math.Abs(d-want) > 0.01 || solid != terrain {
+		t.Errorf("hit %v at %v, want the terrain at %v", solid, d, want)
+	}
+	ray.origin.X = 30
+	if d, solid := solids.trace(&ray, SOLID_MAX_DISTANCE); math.Abs(d-8) > 0.01 || solid != solids[0] {
+		t.Errorf("hit %v at %v, want the ground at 8", solid, d)
+	}
+
+	// grazing rays over the terrain never end up under it
+	for i := range 50 {
+		ray := Ray{origin: Vec3{-9, 0, float64(i)*0.3 - 7}, dir: Vec3{1, -0.08, 0.1}.Normalized()}
+		d, solid := solids.trace(&ray, SOLID_MAX_DISTANCE)
+		if solid != terrain {
+			continue
+		}
+		p := ray.origin.Add(ray.dir.Scale(d))
+		if below := terrain.height_at(p.X, p.Z) - p.Y; below > 0.01 {
+			t.Errorf("ray %d stopped %v under the terrain", i, below)
+		}
+	}
+}
+
+func TestSolidOccludesClouds(t *testing.T) {
+	rp := bench_render_parameters()
+	ray := Ray{origin: rp.camera.origin, dir: Vec3{0, 0, -1}}
+	behind := march_volume(&ray, rp)
+
+	// a wall in the middle of the cloud hides its far half
+	rp.solid_depth = 2
+	in_front := march_volume(&ray, rp)
+	if !(in_front.W > 0 && in_front.W < behind.W) {
+		t.Errorf("alpha %v with the solid in the cloud, %v without", in_front.W, behind.W)
+	}
+
+	solid := Vec4{0.2, 0.4, 0.6, 1}
+	if c := composite_over(Vec4{}, solid); c != solid {
+		t.Errorf("nothing over a solid gives %v", c)
+	}
+	if c := composite_over(Vec4{1, 1, 1, 0.5}, solid); math.Abs(c.X-0.6) > 1e-9 || c.W != 1 {
+		t.Errorf("half a white cloud over a solid gives %v", c)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"math"
+	"os"
+)
+
+// Heightfield terrain, generated or loaded from a grayscale heightmap. It is sphere traced with the vertical distance
+// to the surface scaled down by the steepest slope, which never overshoots, and its normals come from finite
+// differences of the sdf like every other solid.
+
+// Heights on a grid centered on center, the base of the terrain. Outside the grid it is cut off.
+type Terrain struct {
+	heights        *Matrix2D[float32] // in [0, 1], row 0 at the lowest z
+	center         Vec3
+	size_x, size_z float64 // world extent, the heightmap's aspect ratio
+	height         float64 // world height of 1
+	color          Vec3    // lowlands, the peaks turn to rock
+	lipschitz      float64 // 1/sqrt(1 + steepest slope²), the vertical distance times it never overshoots the surface
+}
+
+// size is the extent along x, along z it follows the aspect ratio of the heights
+func NewTerrain(heights *Matrix2D[float32], center Vec3, size, height float64, color Vec3) *Terrain {
+	t := &Terrain{heights: heights, center: center, height: height, color: color}
+	t.size_x = size
+	t.size_z = size * float64(heights.H) / float64(heights.W)
+	// within a bilinear cell the x slope blends between the cell's two x edges and the z slope between its two z
+	// edges, so the gradient is at most the hypotenuse of the steepest of each
+	cell_x, cell_z := t.size_x/float64(heights.W), t.size_z/float64(heights.H)
+	steepest := 0.0
+	for y := range heights.H - 1 {
+		for x := range heights.W - 1 {
+			h00, h10 := float64(heights.get(x, y)), float64(heights.get(x+1, y))
+			h01, h11 := float64(heights.get(x, y+1)), float64(heights.get(x+1, y+1))
+			dx := max(math.Abs(h10-h00), math.Abs(h11-h01)) / cell_x
+			dz := max(math.Abs(h01-h00), math.Abs(h11-h10)) / cell_z
+			steepest = max(steepest, math.Hypot(dx, dz))
+		}
+	}
+	slope := steepest * height
+	t.lipschitz = 1 / math.Sqrt(1+slope*slope)
+	return t
+}
+
+func (t *Terrain) height_at(x, z float64) float64 {
+	u := ((x-t.center.X)/t.size_x+0.5)*float64(t.heights.W) - 0.5
+	v := ((z-t.center.Z)/t.size_z+0.5)*float64(t.heights.H) - 0.5
+	return t.center.Y + matrix2D_sample_bilinear(t.heights, u, v)*t.height
+}
+
+func (t *Terrain) sdf(p Vec3) float64 {
+	outside := max(math.Abs(p.X-t.center.X)-t.size_x/2, math.Abs(p.Z-t.center.Z)-t.size_z/2)
+	return max(outside, (p.Y-t.height_at(p.X, p.Z))*t.lipschitz)
+}
+
+func (t *Terrain) albedo(p Vec3) Vec3 {
+	rock := Vec3{0.45, 0.43, 0.4}
+	f := linear_step(0.4, 0.9, (p.Y-t.center.Y)/t.height)
+	return t.color.Scale(1 - f).Add(rock.Scale(f))
+}
+
+// Ridged fbm hills in [0, 1], scale is the number of features across the grid
+func generate_terrain_heights(seed int64, resolution int, scale float64) *Matrix2D[float32] {
+	m := NewDataMatrix[float32](resolution, resolution)
+	noise := NewFastNoise(seed)
+	lowest, highest := math.MaxFloat64, -math.MaxFloat64
+	values := make([]float64, resolution*resolution)
+	for y := range resolution {
+		for x := range resolution {
+			fx, fy := float64(x)/float64(resolution)*scale, float64(y)/float64(resolution)*scale
+			h, amplitude := 0.0, 0.5
+			for range 5 {
+				h += amplitude * (1 - math.Abs(noise.gradient3(fx, fy, 0.5)))
+				fx, fy, amplitude = fx*2, fy*2, amplitude*0.5
+			}
+			values[y*resolution+x] = h
+			lowest, highest = min(lowest, h), max(highest, h)
+		}
+	}
+	for i, h := range values {
+		m.set(float32(inverse_lerp(lowest, highest, h)), i%resolution, i/resolution)
+	}
+	return m
+}
+
+// Heights in [0, 1] from the luminance of an 8 or 16-bit PNG, white is highest. The top of the image is the far
+// (lowest z) edge, as seen from the default camera looking down -z.
+func load_heightmap(path string) (*Matrix2D[float32], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b := img.Bounds()
+	if b.Dx() < 2 || b.Dy() < 2 {
+		return nil, fmt.Errorf("%s: heightmap of %dx%d pixels, at least 2x2", path, b.Dx(), b.Dy())
+	}
+	m := NewDataMatrix[float32](b.Dx(), b.Dy())
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			// Gray16 keeps all 16 bits, 8-bit values scale exactly to 0..0xffff
+			gray := color.Gray16Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16)
+			m.set(float32(gray.Y)/0xffff, x, y)
+		}
+	}
+	return m, nil
+}
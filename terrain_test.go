@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func write_png(t *testing.T, path string, img image.Image) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadHeightmap(t *testing.T) {
+	dir := t.TempDir()
+
+	// a ramp rising along x, 8-bit quantizes it, 16-bit keeps the small steps
+	const w, h = 40, 20
+	gray8 := image.NewGray(image.Rect(0, 0, w, h))
+	gray16 := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := float64(x) / (w - 1) * 0.01
+			gray8.SetGray(x, y, color.Gray{uint8(math.Round(v * 0xff))})
+			gray16.SetGray16(x, y, color.Gray16{uint16(math.Round(v * 0xffff))})
+		}
+	}
+	gray16.SetGray16(0, h-1, color.Gray16{0xffff})
+	write_png(t, filepath.Join(dir, "8.png"), gray8)
+	write_png(t, filepath.Join(dir, "16.png"), gray16)
+
+	m8, err := load_heightmap(filepath.Join(dir, "8.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m16, err := load_heightmap(filepath.Join(dir, "16.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m16.W != w || m16.H != h {
+		t.Fatalf("loaded %dx%d, want %dx%d", m16.W, m16.H, w, h)
+	}
+	if v := m16.get(0, h-1); v != 1 {
+		t.Errorf("white loaded as %v", v)
+	}
+	distinct8, distinct16 := map[float32]bool{}, map[float32]bool{}
+	for x := range w {
+		distinct8[m8.get(x, 0)] = true
+		distinct16[m16.get(x, 0)] = true
+		want := float64(x) / (w - 1) * 0.01
+		if got := float64(m16.get(x, 0)); math.Abs(got-want) > 1e-4 {
+			t.Errorf("16-bit height %d is %v, want %v", x, got, want)
+		}
+	}
+	if len(distinct8) > 4 || len(distinct16) != w {
+		t.Errorf("%d distinct 8-bit and %d 16-bit heights on a ramp of %d, want at most 4 and %d", len(distinct8), len(distinct16), w, w)
+	}
+
+	// the z extent follows the aspect ratio, the top row is the far edge
+	terrain, err := build_solid(&SolidDef{Type: "terrain", Path: filepath.Join(dir, "16.png"), Size: 10, Height: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := terrain.(*Terrain)
+	if tr.size_z != 5 {
+		t.Errorf("z extent %v, want 5", tr.size_z)
+	}
+	if near, far := tr.height_at(-4.9, 2.4), tr.height_at(-4.9, -2.4); near < 1 || far > 0.1 {
+		t.Errorf("white corner at %v on the near edge, %v on the far edge", near, far)
+	}
+	ray := Ray{origin: Vec3{-4.9, 5, 2.4}, dir: Vec3{0, -1, 0}}
+	if d, solid := (Solids{terrain}).trace(&ray, SOLID_MAX_DISTANCE); solid == nil || math.Abs(d-(5-tr.height_at(-4.9, 2.4))) > 0.05 {
+		t.Errorf("hit %v at %v, want the peak", solid, d)
+	}
+
+	if _, err := load_heightmap(filepath.Join(dir, "missing.png")); err == nil {
+		t.Error("loaded a missing heightmap")
+	}
+}
+
+// One raised corner makes the bilinear cell steepest at that corner, √2 times the slope of its edges
+func TestTerrainRaisedCorner(t *testing.T) {
+	heights := NewDataMatrix[float32](2, 2)
+	heights.set(1, 1, 1)
+	// samples one unit apart, one unit high
+	terrain := NewTerrain(heights, Vec3{}, 2, 1, Vec3Fill(0.5))
+	if want := 1 / math.Sqrt(1+2); math.Abs(terrain.lipschitz-want) > 1e-12 {
+		t.Errorf("lipschitz %v, want %v for a slope of √2", terrain.lipschitz, want)
+	}
+	// the sdf changes no faster than the distance between points
+	rng := rand.New(rand.NewSource(3))
+	for range 20000 {
+		a := Vec3{rng.Float64() - 0.5, rng.Float64() * 1.2, rng.Float64() - 0.5}
+		b := a.Add(Vec3{rng.Float64() - 0.5, rng.Float64() - 0.5, rng.Float64() - 0.5}.Scale(0.02))
+		if change, distance := math.Abs(terrain.sdf(a)-terrain.sdf(b)), b.Sub(a).Len(); change > distance*(1+1e-9) {
+			t.Fatalf("sdf changes %v between %v and %v, %v apart", change, a, b, distance)
+		}
+	}
+}
@@ -10,7 +10,16 @@ type State struct {
 	image_target *ImageTarget
 	camera       *Camera
 	light        *Light
-	sphere       *Sphere
+	shape        Shape          // sphere unless the scene file sets one
+	layer        *CloudLayer    // from the scene file, rendered instead of the shape when set
+	layer_def    *CloudLayerDef // the scene file's layer, presets are applied on top of it
+	emission     *Emission      // from the scene file, light given off by the shape's volume
+	lightning    *Lightning     // from the scene file, or created by the L key
+	solids       Solids         // from the scene file
+	fog          *HeightFog     // from the scene file, nil for clear air
+	god_rays     *GodRays       // from the scene file, or created by the G key
+	shadow_grid  *ShadowGrid    // from the scene file, or toggled by the T key
+	macro_grid   *MacroGrid     // from the scene file, or toggled by the E key
 	noises       *Noises
 	texture      *rl.Texture2D
 }
@@ -44,16 +53,42 @@ const (
 type DensityType = int
 
 const (
-	DensityType_PerlinRuntime = 1
-	DensityType_PerlinPreCalc = 2
-	DensityType_Uniform       = 3
+	DensityType_PerlinRuntime    = 1
+	DensityType_PerlinPreCalc    = 2
+	DensityType_Uniform          = 3
+	DensityType_Graph            = 4 // noise graph from the scene file
+	DensityType_Wispy            = 5
+	DensityType_Voxel            = 6 // imported voxel volume from the scene file
+	DensityType_Fluid            = 7 // smoke simulation density
+	DensityType_FluidTemperature = 8 // smoke simulation temperature
 )
 
+var density_type_names = map[string]DensityType{
+	"perlin_runtime":    DensityType_PerlinRuntime,
+	"perlin_precalc":    DensityType_PerlinPreCalc,
+	"uniform":           DensityType_Uniform,
+	"graph":             DensityType_Graph,
+	"wispy":             DensityType_Wispy,
+	"voxel":             DensityType_Voxel,
+	"fluid":             DensityType_Fluid,
+	"fluid_temperature": DensityType_FluidTemperature,
+}
+
 type RenderParameters struct {
-	img    *ImageTarget
-	camera *Camera
-	light  *Light
-	sphere *Sphere
-	noises *Noises
-	time   float64
+	img         *ImageTarget
+	camera      *Camera
+	light       *Light
+	shape       Shape
+	layer       *CloudLayer
+	emission    *Emission // of the shape's volume
+	lightning   *Lightning
+	solids      Solids
+	fog         *HeightFog
+	god_rays    *GodRays
+	shadow_grid *ShadowGrid // precomputed light transmittance through the shape, nil marches to the light
+	macro_grid  *MacroGrid  // empty space in the shape, nil samples all of it
+
+	solid_depth float64 // per view ray, distance to the solid it hits, clouds behind it aren't marched. 0 for none
+	noises      *Noises
+	time        float64
 }
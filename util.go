@@ -47,6 +47,18 @@ func pixel_from_float4(fcol [4]float64) Pixel {
 	return p
 }
 
+// a in front of b, both not premultiplied
+func composite_over(a, b Vec4) Vec4 {
+	alpha := a.W + b.W*(1-a.W)
+	if alpha <= 0 {
+		return Vec4{}
+	}
+	front := Vec3{a.X, a.Y, a.Z}.Scale(a.W)
+	back := Vec3{b.X, b.Y, b.Z}.Scale(b.W * (1 - a.W))
+	c := front.Add(back).Scale(1 / alpha)
+	return Vec4{c.X, c.Y, c.Z, alpha}
+}
+
 func byte_color_value_from_float(f float64) byte {
 	f_clamped := clamp01(f)
 	vb := byte(f_clamped * 255)
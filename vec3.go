@@ -100,3 +100,22 @@ func Vec3Fill(v float64) Vec3 {
 func Vec3Make(x, y, z float64) Vec3 {
 	return Vec3{X: x, Y: y, Z: z}
 }
+
+func Vec3Min(a, b Vec3) Vec3 {
+	return Vec3{X: min(a.X, b.X), Y: min(a.Y, b.Y), Z: min(a.Z, b.Z)}
+}
+
+func Vec3Max(a, b Vec3) Vec3 {
+	return Vec3{X: max(a.X, b.X), Y: max(a.Y, b.Y), Z: max(a.Z, b.Z)}
+}
+
+// component by axis index, 0 = X, 1 = Y, 2 = Z
+func (v Vec3) Axis(i int) float64 {
+	switch i {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// Bounding volume hierarchy over the axis-aligned boxes of many volumes, split by the binned surface area heuristic:
+// the cost of a split is the traversal plus the volumes on each side weighted by the chance a ray through the node
+// crosses that side's box, its area over the node's. When volumes move, the boxes above them are refitted in place.
+
+type VolumeBVHNode struct {
+	min, max     Vec3
+	parent       int32 // -1 at the root
+	left, right  int32 // child node indices, for inner nodes
+	first, count int32 // range of order, leaf when count > 0
+}
+
+type VolumeBVH struct {
+	nodes      []VolumeBVHNode
+	order      []int32 // volume indices, every leaf a contiguous range
+	leaf       []int32 // node holding each volume
+	built_cost float64 // of the last full build
+	rebuilds   int
+}
+
+func NewVolumeBVH(lo, hi []Vec3) *VolumeBVH {
+	bvh := &VolumeBVH{}
+	bvh.build(lo, hi)
+	return bvh
+}
+
+// Builds the tree from scratch over the boxes lo[i]..hi[i]
+func (bvh *VolumeBVH) build(lo, hi []Vec3) {
+	n := len(lo)
+	bvh.nodes = bvh.nodes[:0]
+	bvh.order = make([]int32, n)
+	bvh.leaf = make([]int32, n)
+	centroids := make([]Vec3, n)
+	for i := range n {
+		bvh.order[i] = int32(i)
+		centroids[i] = lo[i].Add(hi[i]).Scale(0.5)
+	}
+
+	var build func(first, count int, parent int32) int32
+	build = func(first, count int, parent int32) int32 {
+		index := int32(len(bvh.nodes))
+		bvh.nodes = append(bvh.nodes, VolumeBVHNode{})
+		node := VolumeBVHNode{min: Vec3Fill(math.Inf(1)), max: Vec3Fill(math.Inf(-1)), parent: parent}
+		c_min, c_max := node.min, node.max
+		for _, v := range bvh.order[first : first+count] {
+			node.min, node.max = Vec3Min(node.min, lo[v]), Vec3Max(node.max, hi[v])
+			c_min, c_max = Vec3Min(c_min, centroids[v]), Vec3Max(c_max, centroids[v])
+		}
+
+		axis, split, split_cost := best_sah_split(bvh.order[first:first+count], lo, hi, centroids, c_min, c_max, box_area(node.min, node.max))
+		if count == 1 || (count <= VOLUME_BVH_MAX_LEAF && float64(count) <= split_cost) {
+			node.first, node.count = int32(first), int32(count)
+			for _, v := range bvh.order[first : first+count] {
+				bvh.leaf[v] = index
+			}
+			bvh.nodes[index] = node
+			return index
+		}
+
+		half := count / 2 // every centroid in the same place, any split will do
+		if axis >= 0 {
+			half = 0
+			for i := first; i < first+count; i++ {
+				if sah_bin(centroids[bvh.order[i]], axis, c_min, c_max) < split {
+					bvh.order[i], bvh.order[first+half] = bvh.order[first+half], bvh.order[i]
+					half++
+				}
+			}
+		}
+		node.left = build(first, half, index)
+		node.right = build(first+half, count-half, index)
+		bvh.nodes[index] = node
+		return index
+	}
+	if n > 0 {
+		build(0, n, -1)
+	}
+	bvh.built_cost = bvh.cost()
+	bvh.rebuilds++
+}
+
+// Axis and first bin of the right side of the cheapest split, axis -1 when the centroids can't be told apart
+func best_sah_split(volumes []int32, lo, hi, centroids []Vec3, c_min, c_max Vec3, area float64) (axis, split int, cost float64) {
+	axis, cost = -1, math.Inf(1)
+	if area <= 0 {
+		return
+	}
+	type bin struct {
+		min, max Vec3
+		count    int
+	}
+	for a := range 3 {
+		if c_max.Axis(a) <= c_min.Axis(a) {
+			continue
+		}
+		var bins [VOLUME_BVH_BINS]bin
+		for i := range bins {
+			bins[i].min, bins[i].max = Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+		}
+		for _, v := range volumes {
+			b := &bins[sah_bin(centroids[v], a, c_min, c_max)]
+			b.min, b.max = Vec3Min(b.min, lo[v]), Vec3Max(b.max, hi[v])
+			b.count++
+		}
+		// area and count of everything left of each bin boundary, then sweep from the right
+		var left_area [VOLUME_BVH_BINS]float64
+		var left_count [VOLUME_BVH_BINS]int
+		acc := bin{min: Vec3Fill(math.Inf(1)), max: Vec3Fill(math.Inf(-1))}
+		for i := range VOLUME_BVH_BINS - 1 {
+			acc.min, acc.max, acc.count = Vec3Min(acc.min, bins[i].min), Vec3Max(acc.max, bins[i].max), acc.count+bins[i].count
+			left_area[i+1], left_count[i+1] = box_area(acc.min, acc.max), acc.count
+		}
+		acc = bin{min: Vec3Fill(math.Inf(1)), max: Vec3Fill(math.Inf(-1))}
+		for i := VOLUME_BVH_BINS - 1; i > 0; i-- {
+			acc.min, acc.max, acc.count = Vec3Min(acc.min, bins[i].min), Vec3Max(acc.max, bins[i].max), acc.count+bins[i].count
+			if acc.count == 0 || left_count[i] == 0 {
+				continue
+			}
+			c := VOLUME_BVH_TRAVERSAL_COST + (left_area[i]*float64(left_count[i])+box_area(acc.min, acc.max)*float64(acc.count))/area
+			if c < cost {
+				axis, split, cost = a, i, c
+			}
+		}
+	}
+	return
+}
+
+func sah_bin(centroid Vec3, axis int, c_min, c_max Vec3) int {
+	f := (centroid.Axis(axis) - c_min.Axis(axis)) / (c_max.Axis(axis) - c_min.Axis(axis))
+	return min(int(f*VOLUME_BVH_BINS), VOLUME_BVH_BINS-1)
+}
+
+// Surface area of a box, 0 for an empty one
+func box_area(lo, hi Vec3) float64 {
+	d := Vec3Max(hi.Sub(lo), Vec3{})
+	return 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+// Expected cost of a ray through the root's box by the surface area heuristic, in volume sdf evaluations
+func (bvh *VolumeBVH) cost() float64 {
+	if len(bvh.nodes) == 0 {
+		return 0
+	}
+	root_area := box_area(bvh.nodes[0].min, bvh.nodes[0].max)
+	if root_area <= 0 {
+		return 0
+	}
+	sum := 0.0
+	for i := range bvh.nodes {
+		node := &bvh.nodes[i]
+		chance := box_area(node.min, node.max) / root_area
+		if node.count > 0 {
+			sum += chance * float64(node.count)
+		} else {
+			sum += chance * VOLUME_BVH_TRAVERSAL_COST
+		}
+	}
+	return sum
+}
+
+// Fits the boxes above the moved volumes to them again, keeping the tree as it is. Walks up from each volume's leaf
+// until a box stays the same.
+func (bvh *VolumeBVH) refit(lo, hi []Vec3, moved []int32) {
+	for _, v := range moved {
+		for index := bvh.leaf[v]; index >= 0; {
+			node := &bvh.nodes[index]
+			box_min, box_max := Vec3Fill(math.Inf(1)), Vec3Fill(math.Inf(-1))
+			if node.count > 0 {
+				for _, w := range bvh.order[node.first : node.first+node.count] {
+					box_min, box_max = Vec3Min(box_min, lo[w]), Vec3Max(box_max, hi[w])
+				}
+			} else {
+				l, r := &bvh.nodes[node.left], &bvh.nodes[node.right]
+				box_min, box_max = Vec3Min(l.min, r.min), Vec3Max(l.max, r.max)
+			}
+			if box_min == node.min && box_max == node.max {
+				break
+			}
+			node.min, node.max = box_min, box_max
+			index = node.parent
+		}
+	}
+}
+
+// Where the ray from origin along dir passes through the volumes' boxes before t_max, sorted by entry and merged
+// where they overlap
+func (bvh *VolumeBVH) intervals(origin, dir Vec3, t_max float64, lo, hi []Vec3) []RayInterval {
+	if len(bvh.nodes) == 0 {
+		return nil
+	}
+	hits := []RayInterval{}
+	stack := make([]int32, 0, 64)
+	stack = append(stack, 0)
+	for len(stack) > 0 {
+		node := &bvh.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		if _, ok := ray_box_interval(origin, dir, node.min, node.max, t_max); !ok {
+			continue
+		}
+		if node.count > 0 {
+			for _, v := range bvh.order[node.first : node.first+node.count] {
+				if hit, ok := ray_box_interval(origin, dir, lo[v], hi[v], t_max); ok {
+					hits = append(hits, hit)
+				}
+			}
+			continue
+		}
+		stack = append(stack, node.left, node.right)
+	}
+
+	slices.SortFunc(hits, func(a, b RayInterval) int {
+		return cmp_float(a.t0, b.t0)
+	})
+	merged := hits[:0]
+	for _, hit := range hits {
+		if last := len(merged) - 1; last >= 0 && hit.t0 <= merged[last].t1 {
+			merged[last].t1 = max(merged[last].t1, hit.t1)
+			continue
+		}
+		merged = append(merged, hit)
+	}
+	return merged
+}
+
+// Slab test, the stretch of the ray between 0 and t_max inside the box
+func ray_box_interval(origin, dir, lo, hi Vec3, t_max float64) (RayInterval, bool) {
+	hit := RayInterval{0, t_max}
+	for axis := range 3 {
+		o, d := origin.Axis(axis), dir.Axis(axis)
+		if d == 0 {
+			if o < lo.Axis(axis) || o > hi.Axis(axis) {
+				return hit, false
+			}
+			continue
+		}
+		t0, t1 := (lo.Axis(axis)-o)/d, (hi.Axis(axis)-o)/d
+		hit.t0 = max(hit.t0, min(t0, t1))
+		hit.t1 = min(hit.t1, max(t0, t1))
+	}
+	return hit, hit.t0 <= hit.t1
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Binary format for baked Matrix3D volumes, little-endian:
+//
+//	magic        [6]byte "GCVOL\x00"
+//	version      uint16
+//	value type   uint8 (1 = float32, 2 = float64)
+//	W, H, D      uint32
+//	seed         int64
+//	params hash  uint64
+//	params size  uint32, followed by the generator params as JSON
+//	payload      zlib compressed values in Matrix3D memory order (z-x-y)
+
+const VOLUME_FILE_VERSION = 1
+const VOLUME_FILE_MAX_VALUES = 1 << 28 // 1024x512x512, 2 GiB of float64
+
+var volume_file_magic = [6]byte{'G', 'C', 'V', 'O', 'L', 0}
+
+const (
+	VolumeValueType_Float32 uint8 = 1
+	VolumeValueType_Float64 uint8 = 2
+)
+
+var ErrVolumeFileStale = errors.New("volume file params don't match")
+
+// Everything that affects the generated values, the cache is keyed by its hash
+type NoiseGridParams struct {
+	Generator  string  `json:"generator"`
+	Dim        int     `json:"dim"`
+	Alpha      float64 `json:"alpha"`
+	Beta       float64 `json:"beta"`
+	Iterations int32   `json:"iterations"`
+	Scale      float64 `json:"scale"`
+	Seed       int64   `json:"seed"`
+}
+
+func (p NoiseGridParams) hash() uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, uint16(VOLUME_FILE_VERSION))
+	data, _ := json.Marshal(p)
+	h.Write(data)
+	return h.Sum64()
+}
+
+type NoiseGridGenerator = func(params NoiseGridParams, progress func(done, total int)) *Matrix3D[float64]
+
+type VolumeFileHeader struct {
+	Magic      [6]byte
+	Version    uint16
+	ValueType  uint8
+	W, H, D    uint32
+	Seed       int64
+	ParamsHash uint64
+	ParamsSize uint32
+}
+
+func volume_value_type[T float32 | float64]() uint8 {
+	var zero T
+	if _, ok := any(zero).(float32); ok {
+		return VolumeValueType_Float32
+	}
+	return VolumeValueType_Float64
+}
+
+func write_volume_file[T float32 | float64](path string, m *Matrix3D[T], params NoiseGridParams) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// write next to the target and rename, so a crash never leaves a truncated cache behind
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = encode_volume(f, m, params)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func encode_volume[T float32 | float64](w io.Writer, m *Matrix3D[T], params NoiseGridParams) error {
+	params_json, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	header := VolumeFileHeader{
+		Magic:      volume_file_magic,
+		Version:    VOLUME_FILE_VERSION,
+		ValueType:  volume_value_type[T](),
+		W:          uint32(m.W),
+		H:          uint32(m.H),
+		D:          uint32(m.D),
+		Seed:       params.Seed,
+		ParamsHash: params.hash(),
+		ParamsSize: uint32(len(params_json)),
+	}
+	if err := binary.Write(bw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if _, err := bw.Write(params_json); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(bw)
+	if err := binary.Write(zw, binary.LittleEndian, m.values); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Reads a volume baked with the given params, ErrVolumeFileStale if it was baked with different ones
+func read_volume_file[T float32 | float64](path string, params NoiseGridParams) (*Matrix3D[T], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, header, err := decode_volume[T](f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if header.ParamsHash != params.hash() || m.W != params.Dim || m.H != params.Dim || m.D != params.Dim {
+		return nil, ErrVolumeFileStale
+	}
+	return m, nil
+}
+
+func decode_volume[T float32 | float64](r io.Reader) (*Matrix3D[T], *VolumeFileHeader, error) {
+	br := bufio.NewReader(r)
+	var header VolumeFileHeader
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil {
+		return nil, nil, err
+	}
+	if header.Magic != volume_file_magic {
+		return nil, nil, errors.New("not a volume file")
+	}
+	if header.Version != VOLUME_FILE_VERSION {
+		return nil, nil, fmt.Errorf("unsupported volume file version %d", header.Version)
+	}
+	if header.ValueType != volume_value_type[T]() {
+		return nil, nil, fmt.Errorf("volume value type %d, expected %d", header.ValueType, volume_value_type[T]())
+	}
+	if _, err := br.Discard(int(header.ParamsSize)); err != nil {
+		return nil, nil, err
+	}
+	count := uint64(header.W) * uint64(header.H) * uint64(header.D)
+	if count == 0 || count > VOLUME_FILE_MAX_VALUES {
+		return nil, nil, fmt.Errorf("volume of %dx%dx%d values, at most %d", header.W, header.H, header.D, VOLUME_FILE_MAX_VALUES)
+	}
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	// read what the payload holds before allocating what the header claims, a short payload only costs its size
+	size := int64(count) * int64(binary.Size(T(0)))
+	payload, err := io.ReadAll(io.LimitReader(zr, size+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(payload)) != size {
+		return nil, nil, fmt.Errorf("payload of %d bytes, the header says %d", len(payload), size)
+	}
+	m := NewMatrix3D[T](int(header.W), int(header.H), int(header.D))
+	if err := binary.Read(bytes.NewReader(payload), binary.LittleEndian, m.values); err != nil {
+		return nil, nil, err
+	}
+	return m, &header, nil
+}
+
+// Loads the cached volume when it was baked with the same params, otherwise generates and caches it
+func load_or_generate_volume(path string, params NoiseGridParams, generate NoiseGridGenerator) *Matrix3D[float64] {
+	m, err := read_volume_file[float64](path, params)
+	if err == nil {
+		return m
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("regenerating", path+":", err)
+	}
+	m = generate(params, nil)
+	if err := write_volume_file(path, m, params); err != nil {
+		fmt.Println("caching", path+":", err)
+	}
+	return m
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// The noise volumes NewNoises caches go to a temporary directory, not cache/ in the repository
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "goclouds-cache")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	noise_cache_dir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func test_volume_params(dim int) NoiseGridParams {
+	return NoiseGridParams{Generator: "test", Dim: dim, Alpha: 0.8, Beta: 1, Iterations: 2, Scale: 8, Seed: 7}
+}
+
+func test_volume(dim int) *Matrix3D[float64] {
+	m := NewMatrix3D[float64](dim, dim, dim)
+	for i := range m.values {
+		m.values[i] = float64(i%97) / 96
+	}
+	return m
+}
+
+func TestVolumeFileRoundTrip(t *testing.T) {
+	params := test_volume_params(6)
+	m := test_volume(6)
+	var buf bytes.Buffer
+	if err := encode_volume(&buf, m, params); err != nil {
+		t.Fatal(err)
+	}
+	decoded, header, err := decode_volume[float64](bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ParamsHash != params.hash() || header.Seed != params.Seed {
+		t.Errorf("header %+v for params %+v", header, params)
+	}
+	if decoded.W != 6 || decoded.H != 6 || decoded.D != 6 || !slices.Equal(decoded.values, m.values) {
+		t.Error("decoded values differ")
+	}
+	if _, _, err := decode_volume[float32](bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("decoded float64 values as float32")
+	}
+
+	// float32 volumes too
+	m32 := NewMatrix3D[float32](3, 4, 5)
+	for i := range m32.values {
+		m32.values[i] = float32(i) * 0.5
+	}
+	buf.Reset()
+	if err := encode_volume(&buf, m32, params); err != nil {
+		t.Fatal(err)
+	}
+	decoded32, _, err := decode_volume[float32](&buf)
+	if err != nil || decoded32.W != 3 || decoded32.H != 4 || decoded32.D != 5 || !slices.Equal(decoded32.values, m32.values) {
+		t.Errorf("float32 round trip: %v", err)
+	}
+}
+
+func TestVolumeFileCorrupt(t *testing.T) {
+	params := test_volume_params(4)
+	var buf bytes.Buffer
+	if err := encode_volume(&buf, test_volume(4), params); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	// W, H and D follow the magic, version and value type
+	dims_at := 6 + 2 + 1
+	with_dims := func(w, h, d uint32) []byte {
+		data := bytes.Clone(valid)
+		binary.LittleEndian.PutUint32(data[dims_at:], w)
+		binary.LittleEndian.PutUint32(data[dims_at+4:], h)
+		binary.LittleEndian.PutUint32(data[dims_at+8:], d)
+		return data
+	}
+	for name, data := range map[string][]byte{
+		"terabytes":      with_dims(1<<20, 1<<20, 1<<10),
+		"empty":          with_dims(0, 4, 4),
+		"larger payload": with_dims(8, 8, 8),
+		"smaller":        with_dims(2, 2, 2),
+		"truncated":      valid[:len(valid)-10],
+	} {
+		if _, _, err := decode_volume[float64](bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
+
+func TestLoadOrGenerateVolume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "test.gcvol")
+	generated := 0
+	generate := func(params NoiseGridParams, progress func(done, total int)) *Matrix3D[float64] {
+		generated++
+		m := test_volume(params.Dim)
+		m.values[0] = params.Scale
+		return m
+	}
+	params := test_volume_params(4)
+	first := load_or_generate_volume(path, params, generate)
+	second := load_or_generate_volume(path, params, generate)
+	if generated != 1 || !slices.Equal(first.values, second.values) {
+		t.Fatalf("generated %d times for the same params", generated)
+	}
+
+	// other params don't match the cached hash, the volume is generated again and replaces the cache
+	params.Scale = 4
+	if _, err := read_volume_file[float64](path, params); !errors.Is(err, ErrVolumeFileStale) {
+		t.Errorf("reading with other params: %v", err)
+	}
+	regenerated := load_or_generate_volume(path, params, generate)
+	if generated != 2 || regenerated.values[0] != 4 {
+		t.Errorf("generated %d times, first value %v", generated, regenerated.values[0])
+	}
+	if cached, err := read_volume_file[float64](path, params); err != nil || cached.values[0] != 4 {
+		t.Errorf("the cache wasn't replaced: %v", err)
+	}
+
+	// a corrupt file is regenerated too
+	if err := os.WriteFile(path, []byte("GCVOL\x00garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	load_or_generate_volume(path, params, generate)
+	if generated != 3 {
+		t.Errorf("a corrupt cache wasn't regenerated")
+	}
+}
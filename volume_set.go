@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Many separate cloud volumes marched as one shape. The sdf only evaluates the volumes whose boxes in the
+// hierarchy are nearer than the closest one found so far, and view rays are only traced along the stretches that
+// cross a volume's box, jumping the gaps in between. Drifting volumes wrap around inside the field; the hierarchy is
+// refitted as they move and rebuilt once refitting has made it VOLUME_BVH_REBUILD_RATIO times costlier.
+
+type VolumeSet struct {
+	volumes []Shape
+	base    []Vec3 // each volume's bounding sphere center as built
+	drift   []Vec3 // world units per second
+	field   [2]Vec3
+
+	offsets []Vec3 // translation of each volume at time at
+	lo, hi  []Vec3 // each volume's box at time at
+	at      float64
+	moved   []int32
+	bvh     *VolumeBVH
+
+	bounds    Sphere
+	max_depth float64
+}
+
+// Drifting volumes wrap around on the axes the field box is wider than zero
+func NewVolumeSet(volumes []Shape, drift []Vec3, field_min, field_max Vec3) *VolumeSet {
+	n := len(volumes)
+	s := &VolumeSet{
+		volumes: volumes,
+		base:    make([]Vec3, n),
+		drift:   drift,
+		field:   [2]Vec3{field_min, field_max},
+		offsets: make([]Vec3, n),
+		lo:      make([]Vec3, n),
+		hi:      make([]Vec3, n),
+	}
+	lo, hi := field_min, field_max
+	for i, v := range volumes {
+		b := v.bounding_sphere()
+		s.base[i] = b.C
+		s.place(i)
+		// drifting volumes reach the field's edges
+		lo, hi = Vec3Min(Vec3Min(lo, s.lo[i]), field_min.Sub(Vec3Fill(b.R))), Vec3Max(Vec3Max(hi, s.hi[i]), field_max.Add(Vec3Fill(b.R)))
+		s.max_depth = max(s.max_depth, v.depth())
+	}
+	s.bounds = Sphere{C: lo.Add(hi).Scale(0.5), R: hi.Sub(lo).Len() / 2}
+	s.bvh = NewVolumeBVH(s.lo, s.hi)
+	return s
+}
+
+// Moves volume i to where it drifted at time at, wrapped into the field
+func (s *VolumeSet) place(i int) {
+	c := s.base[i].Add(s.drift[i].Scale(s.at))
+	wrapped := [3]float64{c.X, c.Y, c.Z}
+	for axis := range 3 {
+		lo, extent := s.field[0].Axis(axis), s.field[1].Axis(axis)-s.field[0].Axis(axis)
+		if extent > 0 && s.drift[i].Axis(axis) != 0 {
+			wrapped[axis] = lo + math.Mod(math.Mod(wrapped[axis]-lo, extent)+extent, extent)
+		}
+	}
+	s.offsets[i] = Vec3{wrapped[0], wrapped[1], wrapped[2]}.Sub(s.base[i])
+	r := Vec3Fill(s.volumes[i].bounding_sphere().R)
+	c = s.base[i].Add(s.offsets[i])
+	s.lo[i], s.hi[i] = c.Sub(r), c.Add(r)
+}
+
+// Moves the drifting volumes to time t and refits the hierarchy, before the frame is rendered
+func (s *VolumeSet) advance(t float64) {
+	if t == s.at {
+		return
+	}
+	s.at = t
+	s.moved = s.moved[:0]
+	for i := range s.volumes {
+		if s.drift[i] != (Vec3{}) {
+			s.place(i)
+			s.moved = append(s.moved, int32(i))
+		}
+	}
+	if len(s.moved) == 0 {
+		return
+	}
+	s.bvh.refit(s.lo, s.hi, s.moved)
+	if s.bvh.cost() > VOLUME_BVH_REBUILD_RATIO*s.bvh.built_cost {
+		s.bvh.build(s.lo, s.hi)
+	}
+}
+
+// Smallest sdf of the volumes, visiting the nearer child first and skipping boxes farther than the closest volume.
+// Once inside a volume only the boxes containing p can go deeper.
+func (s *VolumeSet) sdf(p Vec3) float64 {
+	type entry struct {
+		node        int32
+		distance_sq float64 // to its box, when it was pushed
+	}
+	nodes := s.bvh.nodes
+	best := math.Inf(1)
+	stack := make([]entry, 0, 64)
+	stack = append(stack, entry{0, box_distance_sq(p, nodes[0].min, nodes[0].max)})
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		reach := max(best, 0)
+		if e.distance_sq > 0 && e.distance_sq >= reach*reach {
+			continue
+		}
+		node := &nodes[e.node]
+		if node.count > 0 {
+			for _, v := range s.bvh.order[node.first : node.first+node.count] {
+				if d := box_distance_sq(p, s.lo[v], s.hi[v]); d > 0 && d >= reach*reach {
+					continue
+				}
+				best = min(best, s.volumes[v].sdf(p.Sub(s.offsets[v])))
+				reach = max(best, 0)
+			}
+			continue
+		}
+		l, r := &nodes[node.left], &nodes[node.right]
+		near, far := entry{node.left, box_distance_sq(p, l.min, l.max)}, entry{node.right, box_distance_sq(p, r.min, r.max)}
+		if far.distance_sq < near.distance_sq {
+			near, far = far, near
+		}
+		stack = append(stack, far, near)
+	}
+	return best
+}
+
+func (s *VolumeSet) bounding_sphere() Sphere {
+	return s.bounds
+}
+
+func (s *VolumeSet) depth() float64 {
+	return s.max_depth
+}
+
+// Stretches of the ray through the volumes' boxes up to t_max, in order
+func (s *VolumeSet) intervals(ray *Ray, t_max float64) []RayInterval {
+	return s.bvh.intervals(ray.origin, ray.dir, t_max, s.lo, s.hi)
+}
+
+// Spheres of radius 0.5 to 1.5 times radius scattered over a flat box, a deck of small clouds. Each drifts at 0.5
+// to 1.5 times drift, so the deck shears apart.
+func generate_volume_field(rng *rand.Rand, field_min, field_max Vec3, radius float64, count int, drift Vec3) ([]Shape, []Vec3) {
+	volumes := make([]Shape, count)
+	drifts := make([]Vec3, count)
+	extent := field_max.Sub(field_min)
+	for i := range count {
+		c := field_min.Add(Vec3{extent.X * rng.Float64(), extent.Y * rng.Float64(), extent.Z * rng.Float64()})
+		volumes[i] = &Sphere{C: c, R: radius * (0.5 + rng.Float64())}
+		drifts[i] = drift.Scale(0.5 + rng.Float64())
+	}
+	return volumes, drifts
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func test_volume_field(count int, drift Vec3) *VolumeSet {
+	rng := rand.New(rand.NewSource(1))
+	lo, hi := Vec3{-4, -0.5, -10}, Vec3{4, 0.5, -2}
+	volumes, drifts := generate_volume_field(rng, lo, hi, 0.15, count, drift)
+	return NewVolumeSet(volumes, drifts, lo, hi)
+}
+
+// the smallest sdf of every volume, what the hierarchy saves evaluating
+func volume_set_sdf_every(s *VolumeSet, p Vec3) float64 {
+	best := math.Inf(1)
+	for i, v := range s.volumes {
+		best = min(best, v.sdf(p.Sub(s.offsets[i])))
+	}
+	return best
+}
+
+func TestVolumeSetSdf(t *testing.T) {
+	s := test_volume_field(1000, Vec3{})
+	rng := rand.New(rand.NewSource(2))
+	for range 2000 {
+		p := Vec3{rng.Float64()*12 - 6, rng.Float64()*3 - 1.5, rng.Float64()*12 - 12}
+		if got, want := s.sdf(p), volume_set_sdf_every(s, p); math.Abs(got-want) > 1e-12 {
+			t.Fatalf("sdf at %v is %v, every volume gives %v", p, got, want)
+		}
+	}
+	// inside a volume the deepest one counts
+	c := s.volumes[0].bounding_sphere().C
+	if got, want := s.sdf(c), volume_set_sdf_every(s, c); got != want || got >= 0 {
+		t.Errorf("sdf at a volume's center is %v, want %v", got, want)
+	}
+}
+
+func TestVolumeBVHIntervals(t *testing.T) {
+	s := test_volume_field(1000, Vec3{})
+	rng := rand.New(rand.NewSource(3))
+	for range 200 {
+		ray := Ray{origin: Vec3{0, 0, 1}, dir: Vec3{rng.Float64()*0.8 - 0.4, rng.Float64()*0.2 - 0.1, -1}.Normalized()}
+		intervals := s.intervals(&ray, 20)
+		for i, interval := range intervals {
+			if interval.t0 > interval.t1 || (i > 0 && interval.t0 <= intervals[i-1].t1) {
+				t.Fatalf("intervals %v aren't sorted and apart", intervals)
+			}
+		}
+		covered := func(t float64) bool {
+			for _, interval := range intervals {
+				if t >= interval.t0 && t <= interval.t1 {
+					return true
+				}
+			}
+			return false
+		}
+		// every box the ray crosses is covered, and points in the gaps are in no box
+		for v := range s.volumes {
+			if hit, ok := ray_box_interval(ray.origin, ray.dir, s.lo[v], s.hi[v], 20); ok && (!covered(hit.t0) || !covered(hit.t1)) {
+				t.Fatalf("box %d crossed over %v isn't covered by %v", v, hit, intervals)
+			}
+		}
+		for d := 0.0; d < 20; d += 0.01 {
+			if !covered(d) && volume_set_sdf_every(s, ray.origin.Add(ray.dir.Scale(d))) <= 0 {
+				t.Fatalf("a volume at %v is outside the intervals %v", d, intervals)
+			}
+		}
+	}
+}
+
+func TestVolumeSetDrift(t *testing.T) {
+	s := test_volume_field(1000, Vec3{0.5, 0, 0.1})
+	built := s.bvh.rebuilds
+	rng := rand.New(rand.NewSource(4))
+	for _, time := range []float64{0.1, 0.5, 2, 10, 40} {
+		s.advance(time)
+		for i := range s.volumes {
+			c := s.base[i].Add(s.offsets[i])
+			if c.X < s.field[0].X || c.X > s.field[1].X || c.Z < s.field[0].Z || c.Z > s.field[1].Z {
+				t.Fatalf("volume %d drifted out of the field to %v", i, c)
+			}
+		}
+		for range 200 {
+			p := Vec3{rng.Float64()*10 - 5, rng.Float64()*2 - 1, rng.Float64()*10 - 11}
+			if got, want := s.sdf(p), volume_set_sdf_every(s, p); math.Abs(got-want) > 1e-12 {
+				t.Fatalf("at %vs the refitted sdf at %v is %v, every volume gives %v", time, p, got, want)
+			}
+		}
+		if cost := s.bvh.cost(); cost > VOLUME_BVH_REBUILD_RATIO*s.bvh.built_cost {
+			t.Errorf("at %vs the tree costs %v, built at %v", time, cost, s.bvh.built_cost)
+		}
+	}
+	// a small step only refits, drifting far shuffles the volumes and makes a rebuild pay off
+	if s.bvh.rebuilds == built {
+		t.Error("the tree was never rebuilt")
+	}
+	rebuilds := s.bvh.rebuilds
+	s.advance(40.001)
+	if s.bvh.rebuilds != rebuilds {
+		t.Error("the tree was rebuilt for a millisecond of drift")
+	}
+}
+
+func TestVolumeSetRender(t *testing.T) {
+	prev := density_type
+	density_type = DensityType_Uniform
+	defer func() { density_type = prev }()
+
+	rp := bench_render_parameters()
+	rp.img = &ImageTarget{Pixels: make([]Pixel, 160*120), W: 160, H: 120}
+	s := test_volume_field(300, Vec3{})
+	rp.shape = s
+	ray_march(rp)
+	with_intervals := append([]Pixel{}, rp.img.Pixels...)
+
+	// the same volumes marched as any other shape, sphere tracing the gaps with one jump budget per ray
+	rp.shape = &struct{ *VolumeSet }{s}
+	ray_march(rp)
+	covered, missed := 0, 0
+	for i, p := range rp.img.Pixels {
+		if p.A > 0 {
+			covered++
+		}
+		if int(p.A) > int(with_intervals[i].A)+8 {
+			missed++
+		}
+	}
+	if covered == 0 || missed > covered/50 {
+		t.Errorf("marching the intervals missed %d of the %d pixels covered marching the whole shape", missed, covered)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Exports density fields as voxel grids for other tools: raw float32 (with the same .json sidecar the importer reads),
+// NRRD, and a metadata JSON with the world bounds and voxel size.
+
+type DensityFunc = func(point Vec3, noises *Noises, time float64) float64
+
+type VoxelExportMeta struct {
+	BoundsMin   [3]float64 `json:"bounds_min"`
+	BoundsMax   [3]float64 `json:"bounds_max"`
+	VoxelSize   [3]float64 `json:"voxel_size"`
+	Resolution  [3]int     `json:"resolution"`
+	DensityType string     `json:"density_type,omitempty"`
+	Time        float64    `json:"time"`
+	Files       []string   `json:"files"`
+}
+
+// Samples density at voxel centers of a res[0] x res[1] x res[2] grid spanning the world box
+func sample_density_grid(
+	density DensityFunc,
+	noises *Noises,
+	time float64,
+	bounds_min, bounds_max Vec3,
+	res [3]int,
+	progress func(done, total int),
+) *Matrix3D[float32] {
+	voxel := voxel_size(bounds_min, bounds_max, res)
+	m := NewMatrix3D[float32](res[0], res[1], res[2])
+	fill_matrix3D_parallel(m, bake_workers, progress, func(x, y, z int) float32 {
+		p := Vec3{
+			X: bounds_min.X + (float64(x)+0.5)*voxel.X,
+			Y: bounds_min.Y + (float64(y)+0.5)*voxel.Y,
+			Z: bounds_min.Z + (float64(z)+0.5)*voxel.Z,
+		}
+		return float32(density(p, noises, time))
+	})
+	return m
+}
+
+func voxel_size(bounds_min, bounds_max Vec3, res [3]int) Vec3 {
+	size := bounds_max.Sub(bounds_min)
+	return Vec3{size.X / float64(res[0]), size.Y / float64(res[1]), size.Z / float64(res[2])}
+}
+
+// x-fastest little-endian float32 values
+func write_voxel_values(w io.Writer, m *Matrix3D[float32]) error {
+	bw := bufio.NewWriter(w)
+	row := make([]float32, m.W)
+	for z := range m.D {
+		for y := range m.H {
+			for x := range m.W {
+				row[x] = m.values[y*m.W*m.D+x*m.D+z]
+			}
+			if err := binary.Write(bw, binary.LittleEndian, row); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Writes path and its path.json sidecar
+func write_raw_volume(path string, m *Matrix3D[float32]) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write_voxel_values(f, m)
+	if cerr := f.Close(); err == nil {
+		err = cerr // a full disk may only show when the file is closed
+	}
+	if err != nil {
+		return err
+	}
+	header := RawVolumeHeader{
+		Dims:   [3]int{m.W, m.H, m.D},
+		Type:   "float32",
+		Endian: "little",
+	}
+	data, err := json.MarshalIndent(header, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".json", data, 0o644)
+}
+
+// gzip encoded NRRD with the world placement, space origin is the center of the first voxel
+func write_nrrd(path string, m *Matrix3D[float32], bounds_min, voxel Vec3) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write_nrrd_to(f, m, bounds_min, voxel)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func write_nrrd_to(w io.Writer, m *Matrix3D[float32], bounds_min, voxel Vec3) error {
+	origin := bounds_min.Add(voxel.Scale(0.5))
+	_, err := fmt.Fprintf(w, "NRRD0004\n"+
+		"# goclouds density export\n"+
+		"type: float\n"+
+		"dimension: 3\n"+
+		"space dimension: 3\n"+
+		"sizes: %d %d %d\n"+
+		"space directions: (%g,0,0) (0,%g,0) (0,0,%g)\n"+
+		"space origin: (%g,%g,%g)\n"+
+		"kinds: domain domain domain\n"+
+		"endian: little\n"+
+		"encoding: gzip\n"+
+		"\n",
+		m.W, m.H, m.D,
+		voxel.X, voxel.Y, voxel.Z,
+		origin.X, origin.Y, origin.Z,
+	)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := write_voxel_values(zw, m); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Writes <base>.raw (+ sidecar) and/or <base>.nrrd, and <base>.meta.json
+func export_density_grid(base string, m *Matrix3D[float32], meta VoxelExportMeta, raw, nrrd bool) error {
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return err
+	}
+	bounds_min := Vec3{meta.BoundsMin[0], meta.BoundsMin[1], meta.BoundsMin[2]}
+	voxel := Vec3{meta.VoxelSize[0], meta.VoxelSize[1], meta.VoxelSize[2]}
+	if raw {
+		if err := write_raw_volume(base+".raw", m); err != nil {
+			return err
+		}
+		meta.Files = append(meta.Files, filepath.Base(base)+".raw")
+	}
+	if nrrd {
+		if err := write_nrrd(base+".nrrd", m, bounds_min, voxel); err != nil {
+			return err
+		}
+		meta.Files = append(meta.Files, filepath.Base(base)+".nrrd")
+	}
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(base+".meta.json", data, 0o644)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Exported grids load back unchanged through the importer, with the placement in the metadata
+func TestExportDensityGrid(t *testing.T) {
+	bounds_min, bounds_max := Vec3{-1, 0, 2}, Vec3{1, 0.5, 5}
+	res := [3]int{8, 4, 6}
+	// a density that tells every voxel center apart
+	density := func(p Vec3, noises *Noises, time float64) float64 {
+		return p.X + 10*p.Y + 100*p.Z + time
+	}
+	m := sample_density_grid(density, nil, 0.25, bounds_min, bounds_max, res, nil)
+	voxel := voxel_size(bounds_min, bounds_max, res)
+	if got := m.get(0, 0, 0); math.Abs(float64(got)-density(bounds_min.Add(voxel.Scale(0.5)), nil, 0.25)) > 1e-4 {
+		t.Errorf("first voxel %v isn't sampled at its center", got)
+	}
+
+	base := filepath.Join(t.TempDir(), "out", "clouds")
+	meta := VoxelExportMeta{
+		BoundsMin:  [3]float64{bounds_min.X, bounds_min.Y, bounds_min.Z},
+		BoundsMax:  [3]float64{bounds_max.X, bounds_max.Y, bounds_max.Z},
+		VoxelSize:  [3]float64{voxel.X, voxel.Y, voxel.Z},
+		Resolution: res,
+		Time:       0.25,
+	}
+	if err := export_density_grid(base, m, meta, true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".raw", ".nrrd"} {
+		loaded, err := load_voxel_grid(base + ext)
+		if err != nil {
+			t.Fatalf("%s: %v", ext, err)
+		}
+		if loaded.W != res[0] || loaded.H != res[1] || loaded.D != res[2] || !slices.Equal(loaded.values, m.values) {
+			t.Errorf("%s loaded %dx%dx%d different values", ext, loaded.W, loaded.H, loaded.D)
+		}
+	}
+
+	data, err := os.ReadFile(base + ".meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written VoxelExportMeta
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.BoundsMin != meta.BoundsMin || written.BoundsMax != meta.BoundsMax || written.Resolution != res {
+		t.Errorf("metadata placement %+v", written)
+	}
+	want_voxel := [3]float64{0.25, 0.125, 0.5}
+	for i := range 3 {
+		if math.Abs(written.VoxelSize[i]-want_voxel[i]) > 1e-12 {
+			t.Errorf("voxel size %v, want %v", written.VoxelSize, want_voxel)
+		}
+	}
+	if !slices.Equal(written.Files, []string{"clouds.raw", "clouds.nrrd"}) {
+		t.Errorf("metadata lists %v", written.Files)
+	}
+
+	// the NRRD places the first voxel's center at the space origin
+	header, err := os.ReadFile(base + ".nrrd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"space origin: (-0.875,0.0625,2.25)", "space directions: (0.25,0,0) (0,0.125,0) (0,0,0.5)"} {
+		if !strings.Contains(string(header), line) {
+			t.Errorf("NRRD header lacks %q", line)
+		}
+	}
+}
+
+func TestExportCommandBounds(t *testing.T) {
+	for _, args := range [][]string{
+		{"-min", "0,0,0", "-max", "1,0,1"},
+		{"-min", "0,0,2", "-max", "1,1,1"},
+	} {
+		if err := export_command(args); err == nil || !strings.Contains(err.Error(), "above -min") {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// External voxel volumes as cloud density: raw grids with a JSON sidecar, NRRD, and a sparse brick format of our own.
+// File data is x-fastest (x, then y, then z), converted to the Matrix3D z-x-y layout on load.
+// Integer values are normalized to [0, 1], float values are kept as they are.
+
+type VoxelVolume struct {
+	grid          *Matrix3D[float32]
+	center        Vec3 // world position of the grid's center
+	size          Vec3 // world extent of the whole grid
+	cos_yaw       float64
+	sin_yaw       float64 // rotation around the y axis
+	density_scale float64
+}
+
+func NewVoxelVolume(grid *Matrix3D[float32], center, size Vec3, yaw_degrees, density_scale float64) *VoxelVolume {
+	yaw := yaw_degrees * math.Pi / 180
+	return &VoxelVolume{
+		grid:          grid,
+		center:        center,
+		size:          size,
+		cos_yaw:       math.Cos(yaw),
+		sin_yaw:       math.Sin(yaw),
+		density_scale: density_scale,
+	}
+}
+
+// Density at a world position, 0 outside the grid's box
+func (v *VoxelVolume) sample(p Vec3) float64 {
+	d := p.Sub(v.center)
+	// inverse yaw, world to grid space
+	local := Vec3{
+		X: d.X*v.cos_yaw - d.Z*v.sin_yaw,
+		Y: d.Y,
+		Z: d.X*v.sin_yaw + d.Z*v.cos_yaw,
+	}
+	u := local.X/v.size.X + 0.5
+	w := local.Y/v.size.Y + 0.5
+	t := local.Z/v.size.Z + 0.5
+	if u < 0 || u > 1 || w < 0 || w > 1 || t < 0 || t > 1 {
+		return 0
+	}
+	g := v.grid
+	val := matrix3D_sample_trilinear(g, u*float64(g.W)-0.5, w*float64(g.H)-0.5, t*float64(g.D)-0.5)
+	return val * v.density_scale
+}
+
+// Loads by extension: .nrrd/.nhdr, .gcsparse, anything else is raw with a <path>.json sidecar
+func load_voxel_grid(path string) (*Matrix3D[float32], error) {
+	var m *Matrix3D[float32]
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".nrrd", ".nhdr":
+		m, err = load_nrrd(path)
+	case ".gcsparse":
+		m, err = load_sparse_volume(path)
+	default:
+		m, err = load_raw_volume(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+type VoxelValueType = int
+
+const (
+	VoxelValueType_Uint8   VoxelValueType = 0
+	VoxelValueType_Uint16  VoxelValueType = 1
+	VoxelValueType_Int16   VoxelValueType = 2
+	VoxelValueType_Float32 VoxelValueType = 3
+	VoxelValueType_Float64 VoxelValueType = 4
+)
+
+var voxel_value_sizes = [...]int{1, 2, 2, 4, 8}
+
+const VOXEL_VOLUME_MAX_VALUES = 1 << 28 // 1024x512x512, 1 GiB of float32
+
+// Dimensions from a file header, bounded a factor at a time so their product can't overflow
+func check_voxel_dims(w, h, d int) error {
+	if w <= 0 || h <= 0 || d <= 0 || w > VOXEL_VOLUME_MAX_VALUES || h > VOXEL_VOLUME_MAX_VALUES || d > VOXEL_VOLUME_MAX_VALUES ||
+		w*h > VOXEL_VOLUME_MAX_VALUES || w*h*d > VOXEL_VOLUME_MAX_VALUES {
+		return fmt.Errorf("invalid dimensions %dx%dx%d, at most %d values", w, h, d, VOXEL_VOLUME_MAX_VALUES)
+	}
+	return nil
+}
+
+// Reads w*h*d x-fastest values into a new grid
+func read_voxel_values(r io.Reader, value_type VoxelValueType, order binary.ByteOrder, w, h, d int) (*Matrix3D[float32], error) {
+	if err := check_voxel_dims(w, h, d); err != nil {
+		return nil, err
+	}
+	// read what the file holds before allocating what the header claims, a short file only costs its size
+	size := voxel_value_sizes[value_type]
+	data, err := io.ReadAll(io.LimitReader(r, int64(w*h*d*size)))
+	if err != nil {
+		return nil, fmt.Errorf("reading %dx%dx%d values: %w", w, h, d, err)
+	}
+	if len(data) != w*h*d*size {
+		return nil, fmt.Errorf("reading %dx%dx%d values: %d of %d bytes", w, h, d, len(data), w*h*d*size)
+	}
+
+	m := NewMatrix3D[float32](w, h, d)
+	i := 0
+	for z := range d {
+		for y := range h {
+			for x := range w {
+				b := data[i*size:]
+				var v float32
+				switch value_type {
+				case VoxelValueType_Uint8:
+					v = float32(b[0]) / math.MaxUint8
+				case VoxelValueType_Uint16:
+					v = float32(order.Uint16(b)) / math.MaxUint16
+				case VoxelValueType_Int16:
+					v = float32(int16(order.Uint16(b))) / math.MaxInt16
+				case VoxelValueType_Float32:
+					v = math.Float32frombits(order.Uint32(b))
+				case VoxelValueType_Float64:
+					v = float32(math.Float64frombits(order.Uint64(b)))
+				}
+				m.values[y*w*d+x*d+z] = v
+				i++
+			}
+		}
+	}
+	return m, nil
+}
+
+// Raw
+
+// Sidecar <raw file>.json next to a headerless raw grid
+type RawVolumeHeader struct {
+	Dims   [3]int `json:"dims"`   // x, y, z
+	Type   string `json:"type"`   // uint8, uint16, int16, float32, float64
+	Endian string `json:"endian"` // little (default) or big
+}
+
+var raw_value_types = map[string]VoxelValueType{
+	"uint8":   VoxelValueType_Uint8,
+	"uint16":  VoxelValueType_Uint16,
+	"int16":   VoxelValueType_Int16,
+	"float32": VoxelValueType_Float32,
+	"float64": VoxelValueType_Float64,
+}
+
+func load_raw_volume(path string) (*Matrix3D[float32], error) {
+	header_data, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("raw volume sidecar: %w", err)
+	}
+	var header RawVolumeHeader
+	if err := json.Unmarshal(header_data, &header); err != nil {
+		return nil, fmt.Errorf("raw volume sidecar: %w", err)
+	}
+	value_type, ok := raw_value_types[header.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported raw value type %q", header.Type)
+	}
+	order, err := byte_order(header.Endian)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read_voxel_values(bufio.NewReader(f), value_type, order, header.Dims[0], header.Dims[1], header.Dims[2])
+}
+
+func byte_order(endian string) (binary.ByteOrder, error) {
+	switch endian {
+	case "", "little":
+		return binary.LittleEndian, nil
+	case "big":
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("unknown endian %q", endian)
+}
+
+// NRRD, https://teem.sourceforge.net/nrrd/format.html
+// 3D scalar grids with raw or gzip encoding, attached or detached ("data file") data
+
+var nrrd_value_types = map[string]VoxelValueType{
+	"uchar": VoxelValueType_Uint8, "unsigned char": VoxelValueType_Uint8, "uint8": VoxelValueType_Uint8, "uint8_t": VoxelValueType_Uint8,
+	"ushort": VoxelValueType_Uint16, "unsigned short": VoxelValueType_Uint16, "unsigned short int": VoxelValueType_Uint16,
+	"uint16": VoxelValueType_Uint16, "uint16_t": VoxelValueType_Uint16,
+	"short": VoxelValueType_Int16, "short int": VoxelValueType_Int16, "signed short": VoxelValueType_Int16,
+	"signed short int": VoxelValueType_Int16, "int16": VoxelValueType_Int16, "int16_t": VoxelValueType_Int16,
+	"float":  VoxelValueType_Float32,
+	"double": VoxelValueType_Float64,
+}
+
+func load_nrrd(path string) (*Matrix3D[float32], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(magic, "NRRD000") {
+		return nil, errors.New("not a NRRD file")
+	}
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			break // detached header without a trailing blank line
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break // data follows
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ": "); ok {
+			fields[key] = strings.TrimSpace(value)
+		}
+		// "key:=value" pairs are free-form, ignored
+	}
+
+	if fields["dimension"] != "3" {
+		return nil, fmt.Errorf("only 3D NRRD is supported, dimension: %q", fields["dimension"])
+	}
+	value_type, ok := nrrd_value_types[fields["type"]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported NRRD type %q", fields["type"])
+	}
+	var dims [3]int
+	sizes := strings.Fields(fields["sizes"])
+	if len(sizes) != 3 {
+		return nil, fmt.Errorf("invalid NRRD sizes %q", fields["sizes"])
+	}
+	for i, s := range sizes {
+		if dims[i], err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("invalid NRRD sizes %q", fields["sizes"])
+		}
+	}
+	order, err := byte_order(fields["endian"])
+	if err != nil {
+		return nil, err
+	}
+
+	var data io.Reader = r
+	data_file := fields["data file"]
+	if data_file == "" {
+		data_file = fields["datafile"]
+	}
+	if data_file != "" {
+		if !filepath.IsAbs(data_file) {
+			data_file = filepath.Join(filepath.Dir(path), data_file)
+		}
+		df, err := os.Open(data_file)
+		if err != nil {
+			return nil, err
+		}
+		defer df.Close()
+		data = bufio.NewReader(df)
+	}
+
+	switch fields["encoding"] {
+	case "raw":
+	case "gzip", "gz":
+		zr, err := gzip.NewReader(data)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		data = zr
+	default:
+		return nil, fmt.Errorf("unsupported NRRD encoding %q", fields["encoding"])
+	}
+	return read_voxel_values(data, value_type, order, dims[0], dims[1], dims[2])
+}
+
+// Sparse brick grid (.gcsparse), little-endian:
+//
+//	magic       [8]byte "GCSPARSE"
+//	version     uint16 = 1
+//	W, H, D     uint32 grid size in voxels
+//	brick size  uint8 B, bricks are B^3 voxels, edge bricks are cropped to the grid
+//	background  float32, value of voxels not covered by any brick
+//	count       uint32 number of bricks
+//	bricks      count times: bx, by, bz uint16 brick coordinates, then B^3 float32 values x-fastest
+//
+// Only bricks with a value other than the background are stored, which suits clouds with lots of empty space.
+
+var sparse_volume_magic = [8]byte{'G', 'C', 'S', 'P', 'A', 'R', 'S', 'E'}
+
+type SparseVolumeHeader struct {
+	Magic      [8]byte
+	Version    uint16
+	W, H, D    uint32
+	BrickSize  uint8
+	Background float32
+	Count      uint32
+}
+
+type SparseBrickCoords struct {
+	X, Y, Z uint16
+}
+
+func load_sparse_volume(path string) (*Matrix3D[float32], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var header SparseVolumeHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != sparse_volume_magic {
+		return nil, errors.New("not a sparse volume file")
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported sparse volume version %d", header.Version)
+	}
+	if header.BrickSize == 0 {
+		return nil, errors.New("sparse volume brick size is 0")
+	}
+	w, h, d := int(header.W), int(header.H), int(header.D)
+	if err := check_voxel_dims(w, h, d); err != nil {
+		return nil, err
+	}
+	b := int(header.BrickSize)
+
+	m := NewMatrix3D[float32](w, h, d)
+	if header.Background != 0 {
+		for i := range m.values {
+			m.values[i] = header.Background
+		}
+	}
+	brick := make([]float32, b*b*b)
+	for range header.Count {
+		var c SparseBrickCoords
+		if err := binary.Read(r, binary.LittleEndian, &c); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, brick); err != nil {
+			return nil, err
+		}
+		i := 0
+		for bz := range b {
+			for by := range b {
+				for bx := range b {
+					x, y, z := int(c.X)*b+bx, int(c.Y)*b+by, int(c.Z)*b+bz
+					if x < w && y < h && z < d {
+						m.values[y*w*d+x*d+z] = brick[i]
+					}
+					i++
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func write_sparse_volume(path string, m *Matrix3D[float32], brick_size int, background float32) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write_sparse_volume_to(f, m, brick_size, background)
+	if cerr := f.Close(); err == nil {
+		err = cerr // a full disk may only show when the file is closed
+	}
+	return err
+}
+
+func write_sparse_volume_to(w io.Writer, m *Matrix3D[float32], brick_size int, background float32) error {
+	bw := bufio.NewWriter(w)
+
+	b := brick_size
+	bricks_x, bricks_y, bricks_z := (m.W+b-1)/b, (m.H+b-1)/b, (m.D+b-1)/b
+	var coords []SparseBrickCoords
+	var values []float32
+	brick := make([]float32, b*b*b)
+	for cz := range bricks_z {
+		for cy := range bricks_y {
+			for cx := range bricks_x {
+				empty := true
+				i := 0
+				for bz := range b {
+					for by := range b {
+						for bx := range b {
+							x, y, z := cx*b+bx, cy*b+by, cz*b+bz
+							v := background
+							if x < m.W && y < m.H && z < m.D {
+								v = m.values[y*m.W*m.D+x*m.D+z]
+							}
+							empty = empty && v == background
+							brick[i] = v
+							i++
+						}
+					}
+				}
+				if !empty {
+					coords = append(coords, SparseBrickCoords{uint16(cx), uint16(cy), uint16(cz)})
+					values = append(values, brick...)
+				}
+			}
+		}
+	}
+
+	header := SparseVolumeHeader{
+		Magic:      sparse_volume_magic,
+		Version:    1,
+		W:          uint32(m.W),
+		H:          uint32(m.H),
+		D:          uint32(m.D),
+		BrickSize:  uint8(b),
+		Background: background,
+		Count:      uint32(len(coords)),
+	}
+	if err := binary.Write(bw, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	n := b * b * b
+	for i, c := range coords {
+		if err := binary.Write(bw, binary.LittleEndian, &c); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, values[i*n:(i+1)*n]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
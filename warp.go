@@ -0,0 +1,32 @@
+package main
+
+// Density-level domain modifiers: the sample point is displaced before the density is evaluated.
+// Both fields scroll with the wind over time, which turns straight translation into wispy, swirling edges.
+
+// Displacement by a vector gradient-noise field, up to amplitude in each axis
+func domain_warp(p Vec3, scale, amplitude float64, wind Vec3, noises *Noises, time float64) Vec3 {
+	q := p.Sub(wind.Scale(time)).Scale(scale)
+	offset := Vec3{
+		X: noises.fast_noise.gradient3(q.X, q.Y, q.Z),
+		Y: noises.fast_noise.gradient3(q.X+17.3, q.Y-9.1, q.Z+3.7), // decorrelate the components
+		Z: noises.fast_noise.gradient3(q.X-5.9, q.Y+23.4, q.Z-13.2),
+	}
+	return p.Add(offset.Scale(amplitude))
+}
+
+// Advects the point through a divergence-free curl-noise velocity field in a few Euler steps.
+// Unlike plain warping it doesn't compress or tear the density, it swirls it.
+// The curl is about 4 long on average, it is capped at 1 so the point moves at most amplitude.
+func curl_advect(p Vec3, scale, amplitude float64, steps int, wind Vec3, noises *Noises, time float64) Vec3 {
+	step := amplitude / float64(max(steps, 1))
+	drift := wind.Scale(time)
+	for range steps {
+		q := p.Sub(drift).Scale(scale)
+		v := noises.fast_noise.curl3_vec(q)
+		if l := v.Len(); l > 1 {
+			v = v.Scale(1 / l)
+		}
+		p = p.Add(v.Scale(step))
+	}
+	return p
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWarp(t *testing.T) {
+	noises := &Noises{fast_noise: NewFastNoise(1)}
+	wind := Vec3{0.4, 0, 0.6}
+	points := make([]Vec3, 500)
+	for i := range points {
+		f := float64(i)
+		points[i] = Vec3{f*0.037 - 9, f*0.011 - 2, f*0.053 - 13}
+	}
+
+	// domain warp moves up to amplitude in each axis, curl advection up to amplitude in all
+	moved := 0.0
+	for _, p := range points {
+		d := domain_warp(p, 2, 0.25, wind, noises, 3).Sub(p)
+		if max(math.Abs(d.X), math.Abs(d.Y), math.Abs(d.Z)) > 0.25 {
+			t.Fatalf("domain warp moved %v by %v", p, d)
+		}
+		c := curl_advect(p, 0.8, 0.3, 3, wind, noises, 3).Sub(p)
+		if c.Len() > 0.3+1e-9 {
+			t.Fatalf("curl advection moved %v by %v", p, c.Len())
+		}
+		moved += d.Len() + c.Len()
+	}
+	if moved == 0 {
+		t.Error("nothing moved")
+	}
+
+	// no amplitude or no steps leave the density as it was
+	input := &NoiseSourceNode{kind: NoiseKind_Gradient, scale: 3}
+	for _, node := range []NoiseNode{
+		&DomainWarpNode{input: input, scale: 2, amplitude: 0, wind: wind},
+		&CurlWarpNode{input: input, scale: 0.8, amplitude: 0, steps: 2, wind: wind},
+		&CurlWarpNode{input: input, scale: 0.8, amplitude: 0.3, steps: 0, wind: wind},
+	} {
+		for _, p := range points {
+			if v, want := node.eval(p, noises, 3), input.eval(p, noises, 3); v != want {
+				t.Fatalf("%+v at %v: %v, want %v", node, p, v, want)
+			}
+		}
+	}
+
+	// the warp field travels with the wind: after time, the point the wind carried there is warped the same way
+	for _, p := range points[:50] {
+		carried := p.Add(wind.Scale(2))
+		d0 := domain_warp(p, 2, 0.25, wind, noises, 0).Sub(p)
+		d2 := domain_warp(carried, 2, 0.25, wind, noises, 2).Sub(carried)
+		c0 := curl_advect(p, 0.8, 0.3, 3, wind, noises, 0).Sub(p)
+		c2 := curl_advect(carried, 0.8, 0.3, 3, wind, noises, 2).Sub(carried)
+		if d0.Sub(d2).Len() > 1e-9 || c0.Sub(c2).Len() > 1e-9 {
+			t.Fatalf("at %v the warp moved by %v and %v", p, d2.Sub(d0), c2.Sub(c0))
+		}
+		if d0.Sub(domain_warp(p, 2, 0.25, wind, noises, 2).Sub(p)).Len() == 0 {
+			t.Fatalf("the warp at %v stays still over time", p)
+		}
+	}
+}
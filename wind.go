@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Wind that changes direction and speed with altitude, plus curl-noise turbulence that is carried along with the air
+// and slowly changes shape. Densities sample their noise where the air at the sample point was `time` ago,
+// so clouds lean with the wind shear and billow instead of sliding as one block.
+
+type WindLayer struct {
+	altitude float64
+	velocity Vec3
+}
+
+type WindField struct {
+	layers           []WindLayer // by increasing altitude, the velocity is interpolated between them and held beyond
+	turbulence       float64     // displacement of the curl noise, world units
+	turbulence_scale float64     // frequency of the curl noise
+	evolution        float64     // how fast the turbulence changes shape
+	shear_memory     float64     // seconds, see drift
+}
+
+var default_wind = WindField{
+	layers: []WindLayer{
+		{altitude: 0, velocity: Vec3{0.25, 0, 0.45}},
+		{altitude: 3, velocity: Vec3{0.6, 0, 0.4}},
+		{altitude: 8, velocity: Vec3{1.2, 0.02, 0.1}},
+	},
+	turbulence:       0.15,
+	turbulence_scale: 0.5,
+	evolution:        0.05,
+	shear_memory:     3,
+}
+
+// Velocity at a height, zero without wind
+func (w *WindField) velocity(altitude float64) Vec3 {
+	if w == nil || len(w.layers) == 0 {
+		return Vec3{}
+	}
+	i := sort.Search(len(w.layers), func(i int) bool { return w.layers[i].altitude > altitude })
+	if i == 0 {
+		return w.layers[0].velocity
+	}
+	if i == len(w.layers) {
+		return w.layers[i-1].velocity
+	}
+	a, b := w.layers[i-1], w.layers[i]
+	t := inverse_lerp(a.altitude, b.altitude, altitude)
+	return a.velocity.Scale(1 - t).Add(b.velocity.Scale(t))
+}
+
+// Curl noise offset at a point of the (already advected) air, evolving over time
+func (w *WindField) turbulence_offset(q Vec3, noises *Noises, time float64) Vec3 {
+	if w == nil || w.turbulence == 0 {
+		return Vec3{}
+	}
+	c := q.Scale(w.turbulence_scale)
+	c.Y += time * w.evolution // moving through the field along an axis the air doesn't travel changes its shape
+	return noises.fast_noise.curl3_vec(c).Scale(w.turbulence)
+}
+
+// How far the air at p has travelled in time, for clouds carried by the wind at ref_altitude: along that wind, plus
+// the difference to the wind at p's altitude. Noise clouds don't dissipate and re-form like real ones and the shear
+// would smear them without bound, so it is only remembered for shear_memory seconds and they just lean.
+func (w *WindField) drift(p Vec3, time, ref_altitude float64) Vec3 {
+	ref := w.velocity(ref_altitude)
+	shear := w.velocity(p.Y).Sub(ref)
+	shear_time := time
+	if w.shear_memory > 0 {
+		shear_time = w.shear_memory * (1 - math.Exp(-time/w.shear_memory))
+	}
+	return ref.Scale(time).Add(shear.Scale(shear_time))
+}
+
+// Where the noise is sampled for p: back along the drift scaled by speed, then through the turbulence
+func (w *WindField) advect(p Vec3, noises *Noises, time, speed, ref_altitude float64) Vec3 {
+	if w == nil {
+		return p
+	}
+	q := p.Sub(w.drift(p, time, ref_altitude).Scale(speed))
+	return q.Add(w.turbulence_offset(q, noises, time))
+}
+
+// Lookups for a shape noise and a detail noise moving at different speeds, the detail slides over the shape by the
+// speed difference and shares its turbulence
+func (w *WindField) advect_shape_detail(p Vec3, noises *Noises, time, ref_altitude, shape_speed, detail_speed float64) (shape, detail Vec3) {
+	if w == nil {
+		return p, p
+	}
+	drift := w.drift(p, time, ref_altitude)
+	shape = p.Sub(drift.Scale(shape_speed))
+	shape = shape.Add(w.turbulence_offset(shape, noises, time))
+	detail = shape.Sub(drift.Scale(detail_speed - shape_speed))
+	return shape, detail
+}
+
+// Scene file representation of the wind
+type WindDef struct {
+	Layers          []WindLayerDef `json:"layers"`
+	Turbulence      float64        `json:"turbulence,omitempty"`
+	TurbulenceScale float64        `json:"turbulence_scale,omitempty"`
+	Evolution       float64        `json:"evolution,omitempty"`
+	ShearMemory     float64        `json:"shear_memory,omitempty"` // seconds, 0 keeps shearing forever
+}
+
+type WindLayerDef struct {
+	Altitude  float64 `json:"altitude"`
+	Direction float64 `json:"direction"` // degrees on the xz plane, 0 blows towards +x, 90 towards +z
+	Speed     float64 `json:"speed"`
+	Vertical  float64 `json:"vertical,omitempty"` // updraft
+}
+
+func build_wind(def *WindDef) (*WindField, error) {
+	or_default := func(v, d float64) float64 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	wind := WindField{
+		turbulence:       def.Turbulence,
+		turbulence_scale: or_default(def.TurbulenceScale, 0.5),
+		evolution:        def.Evolution,
+		shear_memory:     def.ShearMemory,
+	}
+	for _, l := range def.Layers {
+		rad := l.Direction * math.Pi / 180
+		wind.layers = append(wind.layers, WindLayer{
+			altitude: l.Altitude,
+			velocity: Vec3{math.Cos(rad) * l.Speed, l.Vertical, math.Sin(rad) * l.Speed},
+		})
+	}
+	sort.SliceStable(wind.layers, func(i, j int) bool { return wind.layers[i].altitude < wind.layers[j].altitude })
+	for i := 1; i < len(wind.layers); i++ {
+		if wind.layers[i].altitude == wind.layers[i-1].altitude {
+			return nil, fmt.Errorf("two wind layers at altitude %v", wind.layers[i].altitude)
+		}
+	}
+	return &wind, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestWindField(t *testing.T) {
+	wind, err := build_wind(&WindDef{Layers: []WindLayerDef{
+		{Altitude: 4, Direction: 90, Speed: 2},
+		{Altitude: 0, Direction: 0, Speed: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	near := func(a, b Vec3) bool {
+		return a.Sub(b).Len() < 1e-9
+	}
+	// held below the lowest and above the highest layer, interpolated between
+	for _, c := range []struct {
+		altitude float64
+		want     Vec3
+	}{
+		{-1, Vec3{1, 0, 0}},
+		{0, Vec3{1, 0, 0}},
+		{1, Vec3{0.75, 0, 0.5}},
+		{4, Vec3{0, 0, 2}},
+		{10, Vec3{0, 0, 2}},
+	} {
+		if v := wind.velocity(c.altitude); !near(v, c.want) {
+			t.Errorf("velocity at %v: got %v, want %v", c.altitude, v, c.want)
+		}
+	}
+
+	// without turbulence the lookup goes straight back along the wind
+	noises := &Noises{fast_noise: NewFastNoise(1)}
+	p := Vec3{3, 1, -2}
+	shape, detail := wind.advect_shape_detail(p, noises, 2, 1, 1, 1.5)
+	if !near(shape, Vec3{1.5, 1, -3}) || !near(detail, Vec3{0.75, 1, -3.5}) {
+		t.Errorf("advected to %v and %v", shape, detail)
+	}
+	// carried by the wind at altitude 0, the shear at p's altitude only adds up to shear_memory seconds
+	wind.shear_memory = 1
+	if d := wind.drift(p, 1000, 0); !near(d, Vec3{1000 - 0.25, 0, 0.5}) {
+		t.Errorf("drift with shear memory %v", d)
+	}
+
+	// turbulence moves lookups by about its strength, and differently over time
+	wind.turbulence, wind.evolution = 0.1, 0.05
+	a := wind.advect(p, noises, 0, 0, 0)
+	b := wind.advect(p, noises, 50, 0, 0)
+	if d := a.Sub(p).Len(); d == 0 || d > 1 {
+		t.Errorf("turbulence offset %v", d)
+	}
+	if near(a, b) {
+		t.Error("turbulence doesn't evolve")
+	}
+
+	var none *WindField
+	if q := none.advect(p, noises, 5, 1, 0); q != p {
+		t.Errorf("no wind moved %v to %v", p, q)
+	}
+}